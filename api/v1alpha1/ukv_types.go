@@ -17,7 +17,9 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
@@ -25,6 +27,11 @@ import (
 
 // UStoreSpec defines the desired state of UStore
 // +kubebuilder:validation:XValidation:rule="!has(oldSelf.dbType) || has(self.dbType)", message="DB Type value is required once set"
+// +kubebuilder:validation:XValidation:rule="has(self.dbConfigMapName) != has(self.engineConfig)", message="Exactly one of dbConfigMapName or engineConfig is required"
+// +kubebuilder:validation:XValidation:rule="!has(self.engineConfig) || !has(self.engineConfig.leveldb) || self.dbType == 'leveldb'", message="engineConfig.leveldb requires dbType leveldb"
+// +kubebuilder:validation:XValidation:rule="!has(self.engineConfig) || !has(self.engineConfig.rocksdb) || self.dbType == 'rocksdb'", message="engineConfig.rocksdb requires dbType rocksdb"
+// +kubebuilder:validation:XValidation:rule="!has(self.engineConfig) || !has(self.engineConfig.udisk) || self.dbType == 'udisk'", message="engineConfig.udisk requires dbType udisk"
+// +kubebuilder:validation:XValidation:rule="!has(self.autoTuneMemory) || !self.autoTuneMemory || has(self.engineConfig)", message="autoTuneMemory requires engineConfig"
 type UStoreSpec struct {
 	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
@@ -34,15 +41,33 @@ type UStoreSpec struct {
 	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="Value is immutable"
 	DBType string `json:"dbType,omitempty"`
 
-	// DB Config Map name is required.
-	// +kubebuilder:validation:Required
+	// DB Config Map name holding a hand-written config.json. Required unless engineConfig is set.
 	DBConfigMapName string `json:"dbConfigMapName,omitempty"`
 
+	// Engine Config from which the operator renders and owns the DB config map.
+	// The data directory is derived from the first volume mount path.
+	EngineConfig *EngineConfig `json:"engineConfig,omitempty"`
+
 	// DB Port to connect clients.
 	DBServicePort int `json:"dbServicePort,omitempty"`
 
+	// Service exposing the DB port to clients. Defaults to a ClusterIP Service.
+	Service *ServiceSpec `json:"service,omitempty"`
+
+	// Exposes the Arrow Flight endpoint outside the cluster, through an OpenShift Route, or a Gateway API
+	// GRPCRoute or TLSRoute when gateway is set.
+	Expose *ExposeSpec `json:"expose,omitempty"`
+
 	// List of persistent volumes to be attached. Required by some DB Types.
 	Volumes []Persistence `json:"volumes,omitempty"`
+
+	// Workload Kind used to run UStore. With StatefulSet every replica gets its own
+	// volumes and a stable network identity. Immutable once set.
+	// +kubebuilder:validation:Enum:="Deployment";"StatefulSet"
+	// +kubebuilder:default:="Deployment"
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="Value is immutable"
+	WorkloadKind string `json:"workloadKind,omitempty"`
+
 	// +kubebuilder:default:=1
 	NumOfInstances int32 `json:"numOfInstances,omitempty"`
 
@@ -52,19 +77,358 @@ type UStoreSpec struct {
 	// Concurrency (cores) limit for this UStore.
 	ConcurrencyLimit string `json:"concurrencyLimit,omitempty"`
 
+	// Compute resources of the UStore container, including ephemeral-storage and hugepages.
+	// Limits set here override memoryLimit and concurrencyLimit. Requests default to 200m CPU and 100Mi memory,
+	// capped by the limits.
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+	// Set the requests equal to the limits, giving the pods the Guaranteed QoS class
+	// so they are the last to be evicted under node pressure.
+	GuaranteedQoS bool `json:"guaranteedQoS,omitempty"`
+
+	// Derive the engine cache, write buffer and open files limits of the rendered config from the
+	// memory and CPU limits, so lowering the limits does not get the pods OOM-killed.
+	// Options set in engineConfig take precedence. Requires engineConfig.
+	AutoTuneMemory bool `json:"autoTuneMemory,omitempty"`
+
+	// Disruption budget of the UStore pods. Defaults to one unavailable replica when numOfInstances is above 1.
+	Disruption *DisruptionSpec `json:"disruption,omitempty"`
+
 	// Optionally define labels for an affinity to run UStore on specific cluster nodes.
 	NodeAffinityLabels []NodeAffinityLabel `json:"nodeAffinityLabels,omitempty"`
+
+	// Node labels the UStore pods require. The backup and restore Jobs get the same node selector.
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+
+	// Tolerations of the UStore pods, e.g. for the taints of dedicated storage nodes.
+	// The backup and restore Jobs get the same tolerations.
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+
+	// Anti-affinity between the pods of this UStore, spreading the replicas over nodes.
+	PodAntiAffinity *PodAntiAffinitySpec `json:"podAntiAffinity,omitempty"`
+
+	// Topology spread constraints of the UStore pods, e.g. across zones.
+	// A constraint without labelSelector selects the pods of this UStore.
+	TopologySpreadConstraints []corev1.TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+
+	// Priority Class of the UStore pods.
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+
+	// Security context of the UStore pods, replacing the default one: non-root, RuntimeDefault seccomp profile
+	// and, outside OpenShift, user, group and fsGroup 1000.
+	PodSecurityContext *corev1.PodSecurityContext `json:"podSecurityContext,omitempty"`
+
+	// Security context of the UStore container, replacing the default one: no privilege escalation, all capabilities
+	// dropped and a read-only root file system. E.g. udisk may need IPC_LOCK or an unconfined seccomp profile for direct I/O.
+	ContainerSecurityContext *corev1.SecurityContext `json:"containerSecurityContext,omitempty"`
+
+	// Image of the UStore server. Defaults to the operator image of the DB Type.
+	Image string `json:"image,omitempty"`
+
+	// Image Pull Policy of the UStore server image.
+	// +kubebuilder:validation:Enum:="Always";"IfNotPresent";"Never"
+	ImagePullPolicy corev1.PullPolicy `json:"imagePullPolicy,omitempty"`
+
+	// Image Pull Secrets used by the UStore pods and jobs. For udisk, defaults to the operator pull secret
+	// of the udisk image.
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+
+	// Version of the UStore server, used as the tag of the image. Changing it upgrades the UStore
+	// to a newer release of the same major version, at most one minor version ahead.
+	// +kubebuilder:validation:Pattern:="^v?[0-9]+\\.[0-9]+\\.[0-9]+$"
+	Version string `json:"version,omitempty"`
+
+	// Upgrade configures how version upgrades are rolled out.
+	Upgrade *UpgradeSpec `json:"upgrade,omitempty"`
+
+	// Tuning of the TCP probes of the UStore container. The startup probe of leveldb, rocksdb and udisk
+	// allows 30 minutes by default, so a large database can open and replay its WAL.
+	Probes *ProbesSpec `json:"probes,omitempty"`
+
+	// Defaults for the UStoreSnapshots taken of this UStore.
+	Snapshots *SnapshotsSpec `json:"snapshots,omitempty"`
+
+	// Persistence Retention decides what happens to the volumes when the UStore is deleted.
+	// Delete removes them, Retain keeps the claims for a new UStore of the same name to adopt,
+	// and Snapshot takes a final UStoreSnapshot, named <name>-final-<unix time>, before removing them.
+	// +kubebuilder:validation:Enum:="Delete";"Retain";"Snapshot"
+	// +kubebuilder:default:="Delete"
+	PersistenceRetention string `json:"persistenceRetention,omitempty"`
+}
+
+// Policies supported by UStoreSpec.PersistenceRetention.
+const (
+	PersistenceRetentionDelete   = "Delete"
+	PersistenceRetentionRetain   = "Retain"
+	PersistenceRetentionSnapshot = "Snapshot"
+)
+
+// Defines how the UStore Service is exposed
+type ServiceSpec struct {
+	// Type of the Service.
+	// +kubebuilder:validation:Enum:="ClusterIP";"NodePort";"LoadBalancer"
+	// +kubebuilder:default:="ClusterIP"
+	Type corev1.ServiceType `json:"type,omitempty"`
+	// Annotations of the Service, e.g. to configure a cloud load balancer.
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Client CIDRs allowed through the load balancer. LoadBalancer only.
+	LoadBalancerSourceRanges []string `json:"loadBalancerSourceRanges,omitempty"`
+	// Port opened on every node, allocated by the cluster when unset. NodePort and LoadBalancer only.
+	// +kubebuilder:validation:Minimum:=1
+	// +kubebuilder:validation:Maximum:=65535
+	NodePort int32 `json:"nodePort,omitempty"`
+	// Route the connections of a client to the same pod.
+	// +kubebuilder:validation:Enum:="None";"ClientIP"
+	SessionAffinity corev1.ServiceAffinity `json:"sessionAffinity,omitempty"`
+	// Local keeps the client source IP and only routes to pods on the receiving node. NodePort and LoadBalancer only.
+	// +kubebuilder:validation:Enum:="Cluster";"Local"
+	ExternalTrafficPolicy corev1.ServiceExternalTrafficPolicy `json:"externalTrafficPolicy,omitempty"`
+}
+
+// Defines how the Arrow Flight endpoint is exposed outside the cluster
+// +kubebuilder:validation:XValidation:rule="!(has(self.route) && has(self.gateway))", message="At most one of route or gateway may be set"
+type ExposeSpec struct {
+	// Host name clients connect to. Generated by the OpenShift router when unset.
+	Host string `json:"host,omitempty"`
+	// Options of the OpenShift Route, used when gateway is not set.
+	Route *RouteExposeSpec `json:"route,omitempty"`
+	// Exposes the endpoint through a Gateway API route attached to existing Gateways.
+	Gateway *GatewayExposeSpec `json:"gateway,omitempty"`
+}
+
+// Defines the TLS termination of the OpenShift Route
+type RouteExposeSpec struct {
+	// Passthrough leaves TLS to the UStore server, reencrypt terminates it at the router and opens a new TLS connection to the server,
+	// edge terminates it at the router and sends plain HTTP/2 to the server. Passthrough and reencrypt are rejected, as the UStore
+	// server does not serve TLS. Defaults to edge, which requires HTTP/2 enabled on the ingress controller, the router
+	// then uses HTTP/2 to the server as the Service port has the h2c appProtocol.
+	// +kubebuilder:validation:Enum:="passthrough";"reencrypt";"edge"
+	Termination string `json:"termination,omitempty"`
+	// CA certificate in PEM format the router uses to verify the server with reencrypt.
+	DestinationCACertificate string `json:"destinationCACertificate,omitempty"`
+}
+
+// Defines the Gateway API route of the UStore
+type GatewayExposeSpec struct {
+	// Kind of route: GRPCRoute for a Gateway terminating TLS, TLSRoute to pass TLS through to the server, which is rejected
+	// as the UStore server does not serve TLS.
+	// +kubebuilder:validation:Enum:="GRPCRoute";"TLSRoute"
+	// +kubebuilder:default:="GRPCRoute"
+	Kind string `json:"kind,omitempty"`
+	// Gateways the route attaches to.
+	// +kubebuilder:validation:MinItems:=1
+	ParentRefs []GatewayParentRef `json:"parentRefs"`
+}
+
+// References a Gateway listener
+type GatewayParentRef struct {
+	// Name of the Gateway.
+	Name string `json:"name"`
+	// Namespace of the Gateway, the UStore namespace when unset.
+	Namespace string `json:"namespace,omitempty"`
+	// Name of the Gateway listener.
+	SectionName string `json:"sectionName,omitempty"`
+}
+
+// Kinds of exposure reported in ExposeStatus.Kind.
+const (
+	ExposeKindRoute     = "Route"
+	ExposeKindGRPCRoute = "GRPCRoute"
+	ExposeKindTLSRoute  = "TLSRoute"
+)
+
+// TLS terminations of the OpenShift Route.
+const (
+	RouteTerminationPassthrough = "passthrough"
+	RouteTerminationReencrypt   = "reencrypt"
+	RouteTerminationEdge        = "edge"
+)
+
+// Reports the route exposing the UStore outside the cluster
+type ExposeStatus struct {
+	// Kind of the route.
+	Kind string `json:"kind"`
+	// Name of the route, empty while it cannot be created.
+	Name string `json:"name,omitempty"`
+	// Host name clients connect to.
+	Host string `json:"host,omitempty"`
+	// The route was admitted by the router or accepted by a Gateway.
+	Accepted bool `json:"accepted,omitempty"`
+	// Details, e.g. why the route is not accepted.
+	Message string `json:"message,omitempty"`
 }
 
+// Defines the PodDisruptionBudget of the UStore pods. At most one of minAvailable or maxUnavailable may be set.
+// +kubebuilder:validation:XValidation:rule="!(has(self.minAvailable) && has(self.maxUnavailable))", message="At most one of minAvailable or maxUnavailable may be set"
+type DisruptionSpec struct {
+	// Number or percentage of pods that must stay available during voluntary disruptions such as node drains.
+	// +kubebuilder:validation:XIntOrString
+	MinAvailable *intstr.IntOrString `json:"minAvailable,omitempty"`
+	// Number or percentage of pods that may be unavailable during voluntary disruptions such as node drains.
+	// +kubebuilder:validation:XIntOrString
+	MaxUnavailable *intstr.IntOrString `json:"maxUnavailable,omitempty"`
+}
+
+// Defines the probes of the UStore container
+type ProbesSpec struct {
+	// Startup probe, holding back the liveness and readiness probes until the server listens.
+	Startup *ProbeSpec `json:"startup,omitempty"`
+	// Readiness probe, removing the pod from the Service endpoints while it fails.
+	Readiness *ProbeSpec `json:"readiness,omitempty"`
+	// Liveness probe, restarting the container when it fails.
+	Liveness *ProbeSpec `json:"liveness,omitempty"`
+}
+
+// Defines the thresholds of a probe. Unset fields keep the operator defaults.
+type ProbeSpec struct {
+	// Disable the probe.
+	Disabled bool `json:"disabled,omitempty"`
+	// +kubebuilder:validation:Minimum:=0
+	InitialDelaySeconds *int32 `json:"initialDelaySeconds,omitempty"`
+	// +kubebuilder:validation:Minimum:=1
+	PeriodSeconds *int32 `json:"periodSeconds,omitempty"`
+	// +kubebuilder:validation:Minimum:=1
+	TimeoutSeconds *int32 `json:"timeoutSeconds,omitempty"`
+	// Minimum consecutive successes for the probe to be considered successful, only tunable for readiness.
+	// +kubebuilder:validation:Minimum:=1
+	SuccessThreshold *int32 `json:"successThreshold,omitempty"`
+	// +kubebuilder:validation:Minimum:=1
+	FailureThreshold *int32 `json:"failureThreshold,omitempty"`
+}
+
+// Defines how a UStore is upgraded to a new version
+type UpgradeSpec struct {
+	// Backup taken before the pods are upgraded. The upgrade fails if the backup does.
+	Backup *BackupDestination `json:"backup,omitempty"`
+	// Time the upgraded pods have to become ready before the previous version is restored.
+	// +kubebuilder:default:="10m"
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+}
+
+// Upgrade phases reported in UStoreStatus.UpgradePhase.
+const (
+	// The pre-upgrade backup is being taken.
+	UpgradePhaseBackingUp = "BackingUp"
+	// The pods are being rolled out with the target version.
+	UpgradePhaseUpgrading = "Upgrading"
+	// The pods run the target version.
+	UpgradePhaseSucceeded = "Succeeded"
+	// The upgraded pods were not ready within the timeout and run the current version again.
+	UpgradePhaseRolledBack = "RolledBack"
+	// The target version is not a supported upgrade or the pre-upgrade backup failed.
+	UpgradePhaseFailed = "Failed"
+)
+
+// Defines how CSI volume snapshots of a UStore are taken
+type SnapshotsSpec struct {
+	// VolumeSnapshotClass used for the snapshots. Empty uses the cluster default class.
+	VolumeSnapshotClassName string `json:"volumeSnapshotClassName,omitempty"`
+	// Scale the UStore to zero replicas while the snapshots are cut, so the data on disk is
+	// consistent rather than only crash-consistent. The UStore is unavailable meanwhile.
+	ScaleToZero bool `json:"scaleToZero,omitempty"`
+}
+
+// Workload kinds supported by UStoreSpec.WorkloadKind.
+const (
+	WorkloadKindDeployment  = "Deployment"
+	WorkloadKindStatefulSet = "StatefulSet"
+)
+
 // Defines a persistence used by the DB
 type Persistence struct {
 	// Size of the requested volume in Gi, Mi, Ti etc'
-	// +kubebuilder:validation:Pattern:="^[1-9][0-9]{0,3}[KMGTPE]{1}i"
+	// +kubebuilder:validation:Pattern:="^[1-9][0-9]{0,3}[KMGTPE]{1}i$"
 	Size string `json:"size,omitempty"`
 	// Path to mount inside UStore container. This must correspond with the data path in config map.
 	MountPath string `json:"mountPath,omitempty"`
 	// +kubebuilder:validation:Enum:="ReadWriteOnce";"ReadWriteMany"
 	AccessMode string `json:"accessMode,omitempty"`
+	// Storage Class of the claim. Unset uses the cluster default class, an empty string requests a volume without class.
+	StorageClassName *string `json:"storageClassName,omitempty"`
+	// Volume Mode of the claim. Block exposes the raw device at the mount path and is only supported by udisk.
+	// +kubebuilder:validation:Enum:="Filesystem";"Block"
+	VolumeMode string `json:"volumeMode,omitempty"`
+	// Labels added to the claim.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Annotations added to the claim.
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Selector over the persistent volumes the claim may bind to, e.g. pre-provisioned local NVMe volumes.
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+	// Data Source to populate a new claim from, a VolumeSnapshot (e.g. one listed in a UStoreSnapshot status)
+	// or a PersistentVolumeClaim to clone. Only used when the claim is created.
+	DataSource *corev1.TypedLocalObjectReference `json:"dataSource,omitempty"`
+}
+
+// Defines the engine options rendered into config.json. Only the section matching the DB Type may be set;
+// ucset has no tunable engine options.
+type EngineConfig struct {
+	// Options of the leveldb engine.
+	LevelDB *LevelDBConfig `json:"leveldb,omitempty"`
+	// Options of the rocksdb engine.
+	RocksDB *RocksDBConfig `json:"rocksdb,omitempty"`
+	// Options of the udisk engine.
+	UDisk *UDiskConfig `json:"udisk,omitempty"`
+}
+
+// Defines leveldb options. Sizes are in bytes.
+type LevelDBConfig struct {
+	// Amount of data to build up in memory before converting to a sorted on-disk file.
+	WriteBufferSize *int64 `json:"writeBufferSize,omitempty"`
+	// Maximum size of a single table file.
+	MaxFileSize *int64 `json:"maxFileSize,omitempty"`
+	// Number of open files that can be used by the DB, -1 for unlimited.
+	MaxOpenFiles *int32 `json:"maxOpenFiles,omitempty"`
+	// Size of the block cache.
+	CacheSize *int64 `json:"cacheSize,omitempty"`
+	// Block compression.
+	// +kubebuilder:validation:Enum:="none";"snappy"
+	Compression string `json:"compression,omitempty"`
+}
+
+// Defines rocksdb options. Sizes are in bytes.
+type RocksDBConfig struct {
+	// Amount of data to build up in a memtable before flushing to disk.
+	WriteBufferSize *int64 `json:"writeBufferSize,omitempty"`
+	// Maximum number of memtables, both active and immutable.
+	// +kubebuilder:validation:Minimum=1
+	MaxWriteBufferNumber *int32 `json:"maxWriteBufferNumber,omitempty"`
+	// Number of open files that can be used by the DB, -1 for unlimited.
+	MaxOpenFiles *int32 `json:"maxOpenFiles,omitempty"`
+	// Target file size for compaction.
+	TargetFileSizeBase *int64 `json:"targetFileSizeBase,omitempty"`
+	// Maximum total data size for level 1.
+	MaxBytesForLevelBase *int64 `json:"maxBytesForLevelBase,omitempty"`
+	// Block compression.
+	// +kubebuilder:validation:Enum:="kNoCompression";"kSnappyCompression";"kLZ4Compression";"kZSTD"
+	Compression string `json:"compression,omitempty"`
+}
+
+// Defines udisk options. Sizes are given with a unit, e.g. 100MB or 4GB.
+type UDiskConfig struct {
+	// Memory the engine may use.
+	// +kubebuilder:validation:Pattern:="^[0-9]+[KMGT]?B$"
+	MemoryLimit string `json:"memoryLimit,omitempty"`
+	// Size of the read cache.
+	// +kubebuilder:validation:Pattern:="^[0-9]+[KMGT]?B$"
+	CacheLimit string `json:"cacheLimit,omitempty"`
+	// Size of the write buffer.
+	// +kubebuilder:validation:Pattern:="^[0-9]+[KMGT]?B$"
+	WriteBufferMaxBytes string `json:"writeBufferMaxBytes,omitempty"`
+	// Number of worker threads.
+	Threads *int32 `json:"threads,omitempty"`
+	// Depth of the I/O queue.
+	IOQueueDepth *int32 `json:"ioQueueDepth,omitempty"`
+	// Data directories created under the data directory.
+	DataDirectories []DataDirectory `json:"dataDirectories,omitempty"`
+}
+
+// Defines a udisk data directory
+type DataDirectory struct {
+	// Sub directory of the data directory.
+	// +kubebuilder:validation:Pattern:="^[a-zA-Z0-9_.-]+$"
+	SubPath string `json:"subPath"`
+	// Maximum size of the directory, e.g. 5GB.
+	// +kubebuilder:validation:Pattern:="^[0-9]+[KMGT]?B$"
+	MaxSize string `json:"maxSize,omitempty"`
 }
 
 // Defines affinity used by UStore. learn more in https://kubernetes.io/docs/concepts/scheduling-eviction/assign-pod-node/
@@ -73,22 +437,145 @@ type NodeAffinityLabel struct {
 	Label string `json:"label,omitempty"`
 	// Label value of the cluster nodes to match
 	Value string `json:"value,omitempty"`
+	// Label values of the cluster nodes to match, used instead of value by In and NotIn
+	Values []string `json:"values,omitempty"`
+	// Operator relating the label to the values. Exists and DoesNotExist take no value, Gt and Lt a single integer.
+	// +kubebuilder:validation:Enum:="In";"NotIn";"Exists";"DoesNotExist";"Gt";"Lt"
+	// +kubebuilder:default:="In"
+	Operator corev1.NodeSelectorOperator `json:"operator,omitempty"`
+	// Require the label, rather than prefer it. All required labels must match.
+	Required bool `json:"required,omitempty"`
 	// Weight of this preference in the range 1-100
 	Weight int32 `json:"weight,omitempty"`
 }
 
+// Defines the anti-affinity between the pods of a UStore
+type PodAntiAffinitySpec struct {
+	// Required refuses to schedule two pods in the same topology domain, Preferred avoids it when possible.
+	// +kubebuilder:validation:Enum:="Required";"Preferred"
+	// +kubebuilder:default:="Preferred"
+	Type string `json:"type,omitempty"`
+	// Node label defining the topology domain.
+	// +kubebuilder:default:="kubernetes.io/hostname"
+	TopologyKey string `json:"topologyKey,omitempty"`
+}
+
+// Pod anti-affinity types supported by PodAntiAffinitySpec.Type.
+const (
+	PodAntiAffinityRequired  = "Required"
+	PodAntiAffinityPreferred = "Preferred"
+)
+
+// Condition types reported in UStoreStatus.Conditions.
+const (
+	// UStore is serving clients: all desired replicas are available and the service exists.
+	ConditionAvailable = "Available"
+	// UStore workload is being created or rolled out.
+	ConditionProgressing = "Progressing"
+	// UStore failed to reconcile or its workload cannot reach the desired state.
+	ConditionDegraded = "Degraded"
+	// All persistent volume claims of the UStore are bound.
+	ConditionStorageReady = "StorageReady"
+	// The DB config map exists and holds a valid config.json.
+	ConditionConfigValid = "ConfigValid"
+	// All persistent volume claims of the UStore have the size requested in spec.volumes.
+	ConditionStorageResized = "StorageResized"
+)
+
+// Resize states reported in VolumeStatus.ResizeStatus.
+const (
+	// The claim expansion was requested and the volume is being expanded.
+	ResizeStatusInProgress = "Resizing"
+	// The volume was expanded and the file system is resized once a pod mounts it.
+	ResizeStatusFileSystemResizePending = "FileSystemResizePending"
+	// The StorageClass of the claim does not allow volume expansion.
+	ResizeStatusExpansionNotAllowed = "ExpansionNotAllowed"
+	// The requested size is smaller than the claim, which cannot shrink.
+	ResizeStatusShrinkNotSupported = "ShrinkNotSupported"
+)
+
+// Reports the size of a persistent volume claim backing a UStore volume
+type VolumeStatus struct {
+	// Name of the claim.
+	ClaimName string `json:"claimName"`
+	// Mount path of the volume in the UStore container.
+	MountPath string `json:"mountPath"`
+	// Size requested in spec.volumes.
+	RequestedSize string `json:"requestedSize,omitempty"`
+	// Capacity of the bound volume.
+	Capacity string `json:"capacity,omitempty"`
+	// Resize progress, empty when the claim has the requested size.
+	ResizeStatus string `json:"resizeStatus,omitempty"`
+}
+
+// Reports the engine options derived from the resource limits. Sizes are in bytes.
+type MemoryTuningStatus struct {
+	// Memory limit the options were derived from.
+	MemoryLimit string `json:"memoryLimit"`
+	// Size of the block cache.
+	BlockCacheSize int64 `json:"blockCacheSize,omitempty"`
+	// Size of a single write buffer (memtable).
+	WriteBufferSize int64 `json:"writeBufferSize,omitempty"`
+	// Number of write buffers the write buffer size was divided among.
+	MaxWriteBufferNumber int32 `json:"maxWriteBufferNumber,omitempty"`
+	// Number of open files that can be used by the DB.
+	MaxOpenFiles int32 `json:"maxOpenFiles,omitempty"`
+	// Number of background threads, derived from the CPU limit.
+	BackgroundThreads int32 `json:"backgroundThreads,omitempty"`
+}
+
 // UStoreStatus defines the observed state of UStore
 type UStoreStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
-	DeploymentStatus string `json:"deploymentStatus,omitempty"`
-	DeploymentName   string `json:"deploymentName,omitempty"`
-	ServiceStatus    string `json:"serviceStatus,omitempty"`
-	ServiceUrl       string `json:"serviceUrl,omitempty"`
+	DeploymentName  string `json:"deploymentName,omitempty"`
+	StatefulSetName string `json:"statefulSetName,omitempty"`
+	// Address clients connect to: the load balancer address once assigned, the cluster DNS name otherwise.
+	ServiceUrl string `json:"serviceUrl,omitempty"`
+	// Port opened on every node by a NodePort or LoadBalancer Service.
+	NodePort int32 `json:"nodePort,omitempty"`
+	// Route exposing the UStore outside the cluster.
+	Expose *ExposeStatus `json:"expose,omitempty"`
+
+	// Size and resize progress of every claim backing spec.volumes.
+	Volumes []VolumeStatus `json:"volumes,omitempty"`
+
+	// Version the UStore pods run.
+	CurrentVersion string `json:"currentVersion,omitempty"`
+	// Version requested in spec.version.
+	TargetVersion string `json:"targetVersion,omitempty"`
+	// Progress of the upgrade to the target version.
+	UpgradePhase string `json:"upgradePhase,omitempty"`
+	// Details of the upgrade phase, e.g. why an upgrade failed.
+	UpgradeMessage string `json:"upgradeMessage,omitempty"`
+	// Time the pods started rolling out with the target version.
+	UpgradeStartTime *metav1.Time `json:"upgradeStartTime,omitempty"`
+	// Name of the UStoreBackup taken before the upgrade.
+	UpgradeBackupName string `json:"upgradeBackupName,omitempty"`
+
+	// Engine options derived from the resource limits when autoTuneMemory is set.
+	MemoryTuning *MemoryTuningStatus `json:"memoryTuning,omitempty"`
+
+	// Hash of the DB config map content applied to the UStore pods.
+	ConfigHash string `json:"configHash,omitempty"`
+
+	// The generation of the UStore spec that was last reconciled.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions describe the current state of the UStore.
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="DB Type",type=string,JSONPath=`.spec.dbType`
+//+kubebuilder:printcolumn:name="Version",type=string,JSONPath=`.status.currentVersion`
+//+kubebuilder:printcolumn:name="Available",type=string,JSONPath=`.status.conditions[?(@.type=="Available")].status`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // UStore is the Schema for the UStores API
 type UStore struct {
@@ -0,0 +1,485 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apimachinery/pkg/util/version"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// DBConfigKey is the config map key holding the UStore config.
+const DBConfigKey = "config.json"
+
+// Defaults applied by the UStore defaulting webhook.
+const (
+	DefaultDBServicePort    = 38709
+	DefaultConcurrencyLimit = "1"
+	DefaultVolumeSize       = "10Gi"
+	DefaultVolumeMountPath  = "/mnt/disk1/"
+	DefaultVolumeAccessMode = "ReadWriteOnce"
+)
+
+// defaultMemoryLimits holds the default memory limit per DB Type.
+var defaultMemoryLimits = map[string]string{
+	"ucset":   "1Gi",
+	"leveldb": "1Gi",
+	"rocksdb": "2Gi",
+	"udisk":   "3Gi",
+}
+
+// log is for logging in this package.
+var ustorelog = logf.Log.WithName("ustore-resource")
+
+// SetupWebhookWithManager registers the UStore defaulting and validating webhooks with the manager.
+func (r *UStore) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		WithDefaulter(&ustoreDefaulter{}).
+		WithValidator(&ustoreValidator{Client: mgr.GetClient()}).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/mutate-unum-cloud-v1alpha1-ustore,mutating=true,failurePolicy=fail,sideEffects=None,groups=unum.cloud,resources=ustores,verbs=create;update,versions=v1alpha1,name=mustore.kb.io,admissionReviewVersions=v1
+
+// ustoreDefaulter defaults UStores. The webhooks can be disabled, e.g. with ENABLE_WEBHOOKS=false,
+// so the controllers rely neither on these defaults nor on the checks of ustoreValidator and guard
+// against missing and invalid values themselves.
+type ustoreDefaulter struct{}
+
+var _ webhook.CustomDefaulter = &ustoreDefaulter{}
+
+// Default implements webhook.CustomDefaulter so a webhook will be registered for the type.
+func (d *ustoreDefaulter) Default(ctx context.Context, obj runtime.Object) error {
+	ustore := obj.(*UStore)
+	ustorelog.Info("default", "name", ustore.Name)
+	req, err := admission.RequestFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	ustore.defaults(req.Operation == admissionv1.Create)
+	return nil
+}
+
+// defaults fills the fields a minimal UStore (name and dbType) leaves empty. The default volume
+// is only added on create, so an update never mounts a new volume the user did not ask for.
+func (r *UStore) defaults(create bool) {
+	spec := &r.Spec
+
+	if spec.DBServicePort == 0 {
+		spec.DBServicePort = DefaultDBServicePort
+	}
+	if spec.MemoryLimit == "" {
+		spec.MemoryLimit = defaultMemoryLimits[spec.DBType]
+	}
+	if spec.ConcurrencyLimit == "" {
+		spec.ConcurrencyLimit = DefaultConcurrencyLimit
+	}
+	if spec.DBConfigMapName == "" && spec.EngineConfig == nil {
+		// let the operator render the config with the engine defaults
+		spec.EngineConfig = &EngineConfig{}
+	}
+	if create && PersistentDBType(spec.DBType) && len(spec.Volumes) == 0 {
+		spec.Volumes = []Persistence{{
+			Size:      DefaultVolumeSize,
+			MountPath: DefaultVolumeMountPath,
+		}}
+	}
+	for i := range spec.Volumes {
+		if spec.Volumes[i].AccessMode == "" {
+			spec.Volumes[i].AccessMode = DefaultVolumeAccessMode
+		}
+	}
+}
+
+//+kubebuilder:webhook:path=/validate-unum-cloud-v1alpha1-ustore,mutating=false,failurePolicy=fail,sideEffects=None,groups=unum.cloud,resources=ustores,verbs=create;update,versions=v1alpha1,name=vustore.kb.io,admissionReviewVersions=v1
+
+// ustoreValidator validates UStores, including the referenced DB config map.
+type ustoreValidator struct {
+	client.Client
+}
+
+var _ webhook.CustomValidator = &ustoreValidator{}
+
+// ValidateCreate implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *ustoreValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	ustore := obj.(*UStore)
+	ustorelog.Info("validate create", "name", ustore.Name)
+	return nil, v.validate(ctx, ustore, nil)
+}
+
+// ValidateUpdate implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *ustoreValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	ustore := newObj.(*UStore)
+	ustorelog.Info("validate update", "name", ustore.Name)
+	if !ustore.DeletionTimestamp.IsZero() {
+		// allow finalizers to be removed from a UStore being deleted
+		return nil, nil
+	}
+	if equality.Semantic.DeepEqual(ustore.Spec, oldObj.(*UStore).Spec) {
+		// metadata only changes, e.g. finalizers and annotations set by the operator
+		return nil, nil
+	}
+	return nil, v.validate(ctx, ustore, oldObj.(*UStore))
+}
+
+// ValidateDelete implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *ustoreValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+// validate checks the UStore, and on update the changes from old, which is nil on create.
+func (v *ustoreValidator) validate(ctx context.Context, ustore *UStore, old *UStore) error {
+	allErrs := validateSpec(&ustore.Spec, field.NewPath("spec"))
+	if old != nil {
+		allErrs = append(allErrs, validateVolumeUpdates(&ustore.Spec, &old.Spec, field.NewPath("spec"))...)
+		allErrs = append(allErrs, validateVersionUpdate(ustore, old, field.NewPath("spec", "version"))...)
+	}
+
+	if ustore.Spec.EngineConfig == nil && ustore.Spec.DBConfigMapName != "" {
+		if err := v.validateConfigMap(ctx, ustore); err != nil {
+			allErrs = append(allErrs, err)
+		}
+	}
+
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("UStore").GroupKind(), ustore.Name, allErrs)
+}
+
+// validateSpec runs the cross-field checks the CRD schema cannot express.
+func validateSpec(spec *UStoreSpec, specPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	if spec.DBType == "" {
+		allErrs = append(allErrs, field.Required(specPath.Child("dbType"), "DB Type is required"))
+	}
+	if spec.DBServicePort < 1 || spec.DBServicePort > 65535 {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("dbServicePort"), spec.DBServicePort, "must be a port number between 1 and 65535"))
+	}
+	allErrs = append(allErrs, validateQuantity(spec.MemoryLimit, specPath.Child("memoryLimit"))...)
+	allErrs = append(allErrs, validateQuantity(spec.ConcurrencyLimit, specPath.Child("concurrencyLimit"))...)
+	allErrs = append(allErrs, validateResources(spec, specPath.Child("resources"))...)
+	allErrs = append(allErrs, validateService(spec.Service, specPath.Child("service"))...)
+	allErrs = append(allErrs, validateExpose(spec.Expose, specPath.Child("expose"))...)
+	if engineConfig := spec.EngineConfig; engineConfig != nil && engineConfig.RocksDB != nil {
+		if number := engineConfig.RocksDB.MaxWriteBufferNumber; number != nil && *number < 1 {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("engineConfig", "rocksdb", "maxWriteBufferNumber"), *number, "must be at least 1"))
+		}
+	}
+	for i, label := range spec.NodeAffinityLabels {
+		allErrs = append(allErrs, validateNodeAffinityLabel(label, specPath.Child("nodeAffinityLabels").Index(i))...)
+	}
+
+	if PersistentDBType(spec.DBType) && len(spec.Volumes) == 0 {
+		allErrs = append(allErrs, field.Required(specPath.Child("volumes"), fmt.Sprintf("DB Type %s requires at least one volume", spec.DBType)))
+	}
+
+	mountPaths := map[string]bool{}
+	for i, volume := range spec.Volumes {
+		volumePath := specPath.Child("volumes").Index(i)
+		allErrs = append(allErrs, validateQuantity(volume.Size, volumePath.Child("size"))...)
+		allErrs = append(allErrs, validateDataSource(volume.DataSource, volumePath.Child("dataSource"))...)
+		if volume.VolumeMode == string(corev1.PersistentVolumeBlock) && spec.DBType != "udisk" {
+			allErrs = append(allErrs, field.Invalid(volumePath.Child("volumeMode"), volume.VolumeMode, "Block volumes are only supported by udisk"))
+		}
+		if volume.MountPath == "" {
+			allErrs = append(allErrs, field.Required(volumePath.Child("mountPath"), "mount path is required"))
+			continue
+		}
+		if !path.IsAbs(volume.MountPath) {
+			allErrs = append(allErrs, field.Invalid(volumePath.Child("mountPath"), volume.MountPath, "must be an absolute path"))
+		}
+		mountPath := path.Clean(volume.MountPath)
+		if mountPaths[mountPath] {
+			allErrs = append(allErrs, field.Duplicate(volumePath.Child("mountPath"), volume.MountPath))
+		}
+		mountPaths[mountPath] = true
+	}
+
+	return allErrs
+}
+
+// validateVolumeUpdates rejects shrinking a volume and changing the claim fields Kubernetes
+// does not allow to change on an existing claim. Volumes are matched by mount path.
+func validateVolumeUpdates(spec *UStoreSpec, oldSpec *UStoreSpec, specPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	oldVolumes := map[string]Persistence{}
+	for _, volume := range oldSpec.Volumes {
+		oldVolumes[path.Clean(volume.MountPath)] = volume
+	}
+	for i, volume := range spec.Volumes {
+		oldVolume, found := oldVolumes[path.Clean(volume.MountPath)]
+		if !found {
+			continue
+		}
+		volumePath := specPath.Child("volumes").Index(i)
+		newQuantity, newErr := resource.ParseQuantity(volume.Size)
+		oldQuantity, oldErr := resource.ParseQuantity(oldVolume.Size)
+		if newErr == nil && oldErr == nil && newQuantity.Cmp(oldQuantity) < 0 {
+			allErrs = append(allErrs, field.Invalid(volumePath.Child("size"), volume.Size,
+				fmt.Sprintf("volumes cannot shrink, the current size is %s", oldVolume.Size)))
+		}
+		if volumeMode(volume) != volumeMode(oldVolume) {
+			allErrs = append(allErrs, field.Forbidden(volumePath.Child("volumeMode"), "cannot be changed on an existing volume"))
+		}
+		if !equality.Semantic.DeepEqual(volume.StorageClassName, oldVolume.StorageClassName) {
+			allErrs = append(allErrs, field.Forbidden(volumePath.Child("storageClassName"), "cannot be changed on an existing volume"))
+		}
+		if !equality.Semantic.DeepEqual(volume.Selector, oldVolume.Selector) {
+			allErrs = append(allErrs, field.Forbidden(volumePath.Child("selector"), "cannot be changed on an existing volume"))
+		}
+	}
+	return allErrs
+}
+
+// volumeMode returns the volume mode of a volume, Filesystem when unset.
+func volumeMode(volume Persistence) string {
+	if volume.VolumeMode == "" {
+		return string(corev1.PersistentVolumeFilesystem)
+	}
+	return volume.VolumeMode
+}
+
+// validateDataSource accepts the data sources a claim can be populated from: a VolumeSnapshot or a claim to clone.
+func validateDataSource(dataSource *corev1.TypedLocalObjectReference, fieldPath *field.Path) field.ErrorList {
+	if dataSource == nil {
+		return nil
+	}
+	apiGroup := ""
+	if dataSource.APIGroup != nil {
+		apiGroup = *dataSource.APIGroup
+	}
+	switch {
+	case dataSource.Kind == "VolumeSnapshot" && apiGroup == "snapshot.storage.k8s.io":
+	case dataSource.Kind == "PersistentVolumeClaim" && apiGroup == "":
+	default:
+		return field.ErrorList{field.NotSupported(fieldPath.Child("kind"), dataSource.Kind, []string{"VolumeSnapshot", "PersistentVolumeClaim"})}
+	}
+	if dataSource.Name == "" {
+		return field.ErrorList{field.Required(fieldPath.Child("name"), "data source name is required")}
+	}
+	return nil
+}
+
+// validateResources rejects requests above the limits, including the memoryLimit and concurrencyLimit shorthands.
+func validateResources(spec *UStoreSpec, fieldPath *field.Path) field.ErrorList {
+	if spec.Resources == nil || spec.GuaranteedQoS {
+		// guaranteed requests are set to the limits
+		return nil
+	}
+	limits := corev1.ResourceList{}
+	if quantity, err := resource.ParseQuantity(spec.MemoryLimit); err == nil {
+		limits[corev1.ResourceMemory] = quantity
+	}
+	if quantity, err := resource.ParseQuantity(spec.ConcurrencyLimit); err == nil {
+		limits[corev1.ResourceCPU] = quantity
+	}
+	for name, quantity := range spec.Resources.Limits {
+		limits[name] = quantity
+	}
+
+	allErrs := field.ErrorList{}
+	for name, request := range spec.Resources.Requests {
+		if limit, found := limits[name]; found && request.Cmp(limit) > 0 {
+			allErrs = append(allErrs, field.Invalid(fieldPath.Child("requests").Key(string(name)), request.String(),
+				fmt.Sprintf("must be less than or equal to the %s limit %s", name, limit.String())))
+		}
+	}
+	return allErrs
+}
+
+// validateService rejects the external options on a Service type that does not use them.
+func validateService(service *ServiceSpec, fieldPath *field.Path) field.ErrorList {
+	if service == nil {
+		return nil
+	}
+	allErrs := field.ErrorList{}
+	external := service.Type == corev1.ServiceTypeNodePort || service.Type == corev1.ServiceTypeLoadBalancer
+	if service.NodePort != 0 && !external {
+		allErrs = append(allErrs, field.Forbidden(fieldPath.Child("nodePort"), "requires type NodePort or LoadBalancer"))
+	}
+	if service.ExternalTrafficPolicy != "" && !external {
+		allErrs = append(allErrs, field.Forbidden(fieldPath.Child("externalTrafficPolicy"), "requires type NodePort or LoadBalancer"))
+	}
+	if len(service.LoadBalancerSourceRanges) > 0 && service.Type != corev1.ServiceTypeLoadBalancer {
+		allErrs = append(allErrs, field.Forbidden(fieldPath.Child("loadBalancerSourceRanges"), "requires type LoadBalancer"))
+	}
+	for i, sourceRange := range service.LoadBalancerSourceRanges {
+		if _, _, err := net.ParseCIDR(sourceRange); err != nil {
+			allErrs = append(allErrs, field.Invalid(fieldPath.Child("loadBalancerSourceRanges").Index(i), sourceRange, "must be a CIDR, e.g. 10.0.0.0/8"))
+		}
+	}
+	return allErrs
+}
+
+// validateExpose rejects the routes that pass TLS through to the server, which does not serve it.
+func validateExpose(expose *ExposeSpec, fieldPath *field.Path) field.ErrorList {
+	if expose == nil {
+		return nil
+	}
+	if expose.Gateway != nil && expose.Gateway.Kind == ExposeKindTLSRoute {
+		return field.ErrorList{field.Invalid(fieldPath.Child("gateway", "kind"), expose.Gateway.Kind, "the UStore server does not serve TLS")}
+	}
+	if expose.Route != nil && expose.Route.Termination != "" && expose.Route.Termination != RouteTerminationEdge {
+		return field.ErrorList{field.Invalid(fieldPath.Child("route", "termination"), expose.Route.Termination, "the UStore server does not serve TLS")}
+	}
+	return nil
+}
+
+// validateNodeAffinityLabel checks the values and weight fit the operator and the kind of term.
+func validateNodeAffinityLabel(label NodeAffinityLabel, fieldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if label.Label == "" {
+		allErrs = append(allErrs, field.Required(fieldPath.Child("label"), "label is required"))
+	}
+	values := NodeAffinityValues(label)
+	switch label.Operator {
+	case corev1.NodeSelectorOpExists, corev1.NodeSelectorOpDoesNotExist:
+		if len(values) > 0 {
+			allErrs = append(allErrs, field.Forbidden(fieldPath.Child("values"), fmt.Sprintf("operator %s takes no value", label.Operator)))
+		}
+	case corev1.NodeSelectorOpGt, corev1.NodeSelectorOpLt:
+		if len(values) != 1 {
+			allErrs = append(allErrs, field.Invalid(fieldPath.Child("values"), values, fmt.Sprintf("operator %s takes a single value", label.Operator)))
+		} else if _, err := strconv.ParseInt(values[0], 10, 64); err != nil {
+			allErrs = append(allErrs, field.Invalid(fieldPath.Child("values"), values, fmt.Sprintf("operator %s takes an integer", label.Operator)))
+		}
+	default:
+		if len(values) == 0 {
+			allErrs = append(allErrs, field.Required(fieldPath.Child("value"), "a value is required"))
+		}
+	}
+	if !label.Required && (label.Weight < 1 || label.Weight > 100) {
+		allErrs = append(allErrs, field.Invalid(fieldPath.Child("weight"), label.Weight, "must be in the range 1-100 for a preferred label"))
+	}
+	return allErrs
+}
+
+// NodeAffinityValues returns the values of the label, or its single value.
+func NodeAffinityValues(label NodeAffinityLabel) []string {
+	if len(label.Values) > 0 {
+		return label.Values
+	}
+	if label.Value != "" {
+		return []string{label.Value}
+	}
+	return nil
+}
+
+func validateQuantity(value string, fieldPath *field.Path) field.ErrorList {
+	if value == "" {
+		return field.ErrorList{field.Required(fieldPath, "a quantity is required")}
+	}
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return field.ErrorList{field.Invalid(fieldPath, value, err.Error())}
+	}
+	if quantity.Sign() <= 0 {
+		return field.ErrorList{field.Invalid(fieldPath, value, "must be greater than zero")}
+	}
+	return nil
+}
+
+// PersistentDBType reports whether the DB Type keeps its data on a volume.
+func PersistentDBType(dbType string) bool {
+	return dbType == "leveldb" || dbType == "rocksdb" || dbType == "udisk"
+}
+
+func (v *ustoreValidator) validateConfigMap(ctx context.Context, ustore *UStore) *field.Error {
+	fieldPath := field.NewPath("spec", "dbConfigMapName")
+	configMap := &corev1.ConfigMap{}
+	err := v.Get(ctx, types.NamespacedName{Name: ustore.Spec.DBConfigMapName, Namespace: ustore.Namespace}, configMap)
+	if err != nil && apierrors.IsNotFound(err) {
+		return field.NotFound(fieldPath, ustore.Spec.DBConfigMapName)
+	} else if err != nil {
+		return field.InternalError(fieldPath, err)
+	}
+	if err := ValidateDBConfig(configMap); err != nil {
+		return field.Invalid(fieldPath, ustore.Spec.DBConfigMapName, err.Error())
+	}
+	return nil
+}
+
+// validateVersionUpdate checks that a new spec.version is a supported upgrade from the version the pods run.
+// Going back to the current version cancels an upgrade and is always allowed.
+func validateVersionUpdate(ustore *UStore, old *UStore, fieldPath *field.Path) field.ErrorList {
+	currentVersion := old.Status.CurrentVersion
+	if currentVersion == "" {
+		currentVersion = old.Spec.Version
+	}
+	if ustore.Spec.Version == old.Spec.Version || ustore.Spec.Version == "" || currentVersion == "" {
+		return nil
+	}
+	if err := ValidateUpgrade(currentVersion, ustore.Spec.Version); err != nil {
+		return field.ErrorList{field.Invalid(fieldPath, ustore.Spec.Version, err.Error())}
+	}
+	return nil
+}
+
+// ValidateUpgrade returns an error unless the target version is the current one or a supported
+// upgrade of it: a newer release of the same major version, at most one minor version ahead.
+func ValidateUpgrade(currentVersion string, targetVersion string) error {
+	current, err := version.ParseGeneric(currentVersion)
+	if err != nil {
+		return fmt.Errorf("current version %s is invalid: %v", currentVersion, err)
+	}
+	target, err := version.ParseGeneric(targetVersion)
+	if err != nil {
+		return fmt.Errorf("target version %s is invalid: %v", targetVersion, err)
+	}
+	switch {
+	case target.LessThan(current):
+		return fmt.Errorf("downgrades are not supported, the current version is %s", currentVersion)
+	case target.Major() != current.Major():
+		return fmt.Errorf("upgrades across major versions are not supported, the current version is %s", currentVersion)
+	case target.Minor() > current.Minor()+1:
+		return fmt.Errorf("upgrades may skip no minor version, upgrade to %d.%d first", current.Major(), current.Minor()+1)
+	}
+	return nil
+}
+
+// ValidateDBConfig returns an error if the config map has no parsable config.json.
+func ValidateDBConfig(configMap *corev1.ConfigMap) error {
+	config, ok := configMap.Data[DBConfigKey]
+	if !ok {
+		return fmt.Errorf("ConfigMap %s has no %s key", configMap.Name, DBConfigKey)
+	}
+	if !json.Valid([]byte(config)) {
+		return fmt.Errorf("ConfigMap %s key %s is not valid JSON", configMap.Name, DBConfigKey)
+	}
+	return nil
+}
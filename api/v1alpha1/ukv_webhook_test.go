@@ -0,0 +1,282 @@
+package v1alpha1
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestDefault(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation admissionv1.Operation
+		volumes   []Persistence
+		expected  []Persistence
+	}{
+		{
+			name:      "default volume on create",
+			operation: admissionv1.Create,
+			expected:  []Persistence{{Size: DefaultVolumeSize, MountPath: DefaultVolumeMountPath, AccessMode: DefaultVolumeAccessMode}},
+		},
+		{
+			name:      "no default volume on update",
+			operation: admissionv1.Update,
+			expected:  nil,
+		},
+		{
+			name:      "access mode of the requested volumes",
+			operation: admissionv1.Update,
+			volumes:   []Persistence{{Size: "1Gi", MountPath: "/mnt/ustore"}},
+			expected:  []Persistence{{Size: "1Gi", MountPath: "/mnt/ustore", AccessMode: DefaultVolumeAccessMode}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ustore := &UStore{Spec: UStoreSpec{DBType: "rocksdb", Volumes: test.volumes}}
+			ctx := admission.NewContextWithRequest(context.Background(), admission.Request{
+				AdmissionRequest: admissionv1.AdmissionRequest{Operation: test.operation},
+			})
+			if err := (&ustoreDefaulter{}).Default(ctx, ustore); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !equality.Semantic.DeepEqual(ustore.Spec.Volumes, test.expected) {
+				t.Errorf("expected volumes %v, got %v", test.expected, ustore.Spec.Volumes)
+			}
+		})
+	}
+}
+
+func TestValidateSpec(t *testing.T) {
+	validSpec := func() *UStoreSpec {
+		return &UStoreSpec{
+			DBType:           "rocksdb",
+			DBServicePort:    8081,
+			MemoryLimit:      "1Gi",
+			ConcurrencyLimit: "1",
+			Volumes:          []Persistence{{MountPath: "/mnt/ustore", Size: "1Gi"}},
+		}
+	}
+	writeBuffers := func(number int32) *EngineConfig {
+		return &EngineConfig{RocksDB: &RocksDBConfig{MaxWriteBufferNumber: &number}}
+	}
+	tests := []struct {
+		name     string
+		mutate   func(spec *UStoreSpec)
+		expected []string
+	}{
+		{
+			name:   "valid",
+			mutate: func(spec *UStoreSpec) {},
+		},
+		{
+			name:     "missing DB type",
+			mutate:   func(spec *UStoreSpec) { spec.DBType = "" },
+			expected: []string{"Required value: spec.dbType"},
+		},
+		{
+			name:     "port out of range",
+			mutate:   func(spec *UStoreSpec) { spec.DBServicePort = 70000 },
+			expected: []string{"Invalid value: spec.dbServicePort"},
+		},
+		{
+			name:     "invalid memory limit",
+			mutate:   func(spec *UStoreSpec) { spec.MemoryLimit = "lots" },
+			expected: []string{"Invalid value: spec.memoryLimit"},
+		},
+		{
+			name: "requests above the limits",
+			mutate: func(spec *UStoreSpec) {
+				spec.Resources = &corev1.ResourceRequirements{Requests: corev1.ResourceList{
+					corev1.ResourceMemory: resource.MustParse("2Gi"),
+				}}
+			},
+			expected: []string{"Invalid value: spec.resources.requests[memory]"},
+		},
+		{
+			name: "guaranteed requests follow the limits",
+			mutate: func(spec *UStoreSpec) {
+				spec.GuaranteedQoS = true
+				spec.Resources = &corev1.ResourceRequirements{Requests: corev1.ResourceList{
+					corev1.ResourceMemory: resource.MustParse("2Gi"),
+				}}
+			},
+		},
+		{
+			name:     "zero concurrency limit",
+			mutate:   func(spec *UStoreSpec) { spec.ConcurrencyLimit = "0" },
+			expected: []string{"Invalid value: spec.concurrencyLimit"},
+		},
+		{
+			name:   "one write buffer",
+			mutate: func(spec *UStoreSpec) { spec.EngineConfig = writeBuffers(1) },
+		},
+		{
+			name:     "zero write buffers",
+			mutate:   func(spec *UStoreSpec) { spec.EngineConfig = writeBuffers(0) },
+			expected: []string{"Invalid value: spec.engineConfig.rocksdb.maxWriteBufferNumber"},
+		},
+		{
+			name:     "negative write buffers",
+			mutate:   func(spec *UStoreSpec) { spec.EngineConfig = writeBuffers(-1) },
+			expected: []string{"Invalid value: spec.engineConfig.rocksdb.maxWriteBufferNumber"},
+		},
+		{
+			name:     "persistent DB type without volumes",
+			mutate:   func(spec *UStoreSpec) { spec.Volumes = nil },
+			expected: []string{"Required value: spec.volumes"},
+		},
+		{
+			name:   "in-memory DB type without volumes",
+			mutate: func(spec *UStoreSpec) { spec.DBType = "ucset"; spec.Volumes = nil },
+		},
+		{
+			name: "external options on a ClusterIP Service",
+			mutate: func(spec *UStoreSpec) {
+				spec.Service = &ServiceSpec{
+					Type:                     corev1.ServiceTypeClusterIP,
+					NodePort:                 30000,
+					LoadBalancerSourceRanges: []string{"10.0.0.0"},
+				}
+			},
+			expected: []string{
+				"Forbidden: spec.service.nodePort",
+				"Forbidden: spec.service.loadBalancerSourceRanges",
+				"Invalid value: spec.service.loadBalancerSourceRanges[0]",
+			},
+		},
+		{
+			name:   "default route",
+			mutate: func(spec *UStoreSpec) { spec.Expose = &ExposeSpec{Route: &RouteExposeSpec{}} },
+		},
+		{
+			name: "edge route",
+			mutate: func(spec *UStoreSpec) {
+				spec.Expose = &ExposeSpec{Route: &RouteExposeSpec{Termination: RouteTerminationEdge}}
+			},
+		},
+		{
+			name: "passthrough route",
+			mutate: func(spec *UStoreSpec) {
+				spec.Expose = &ExposeSpec{Route: &RouteExposeSpec{Termination: RouteTerminationPassthrough}}
+			},
+			expected: []string{"Invalid value: spec.expose.route.termination"},
+		},
+		{
+			name: "reencrypt route",
+			mutate: func(spec *UStoreSpec) {
+				spec.Expose = &ExposeSpec{Route: &RouteExposeSpec{Termination: RouteTerminationReencrypt}}
+			},
+			expected: []string{"Invalid value: spec.expose.route.termination"},
+		},
+		{
+			name: "TLSRoute",
+			mutate: func(spec *UStoreSpec) {
+				spec.Expose = &ExposeSpec{Gateway: &GatewayExposeSpec{Kind: ExposeKindTLSRoute}}
+			},
+			expected: []string{"Invalid value: spec.expose.gateway.kind"},
+		},
+		{
+			name: "GRPCRoute",
+			mutate: func(spec *UStoreSpec) {
+				spec.Expose = &ExposeSpec{Gateway: &GatewayExposeSpec{Kind: ExposeKindGRPCRoute}}
+			},
+		},
+		{
+			name: "volume errors",
+			mutate: func(spec *UStoreSpec) {
+				spec.Volumes = []Persistence{
+					{MountPath: "/mnt/ustore", Size: "1Gi"},
+					{MountPath: "/mnt/ustore/", Size: "1Gi"},
+					{MountPath: "data", Size: "1Gi"},
+					{Size: "1Gi"},
+					{MountPath: "/mnt/disk", Size: "ten gigs"},
+				}
+			},
+			expected: []string{
+				"Duplicate value: spec.volumes[1].mountPath",
+				"Invalid value: spec.volumes[2].mountPath",
+				"Required value: spec.volumes[3].mountPath",
+				"Invalid value: spec.volumes[4].size",
+			},
+		},
+		{
+			name: "unsupported data source",
+			mutate: func(spec *UStoreSpec) {
+				spec.Volumes[0].DataSource = &corev1.TypedLocalObjectReference{Kind: "ConfigMap", Name: "data"}
+			},
+			expected: []string{"Unsupported value: spec.volumes[0].dataSource.kind"},
+		},
+		{
+			name: "data source without a name",
+			mutate: func(spec *UStoreSpec) {
+				spec.Volumes[0].DataSource = &corev1.TypedLocalObjectReference{Kind: "PersistentVolumeClaim"}
+			},
+			expected: []string{"Required value: spec.volumes[0].dataSource.name"},
+		},
+		{
+			name: "block volume on udisk",
+			mutate: func(spec *UStoreSpec) {
+				spec.DBType = "udisk"
+				spec.Volumes[0].VolumeMode = string(corev1.PersistentVolumeBlock)
+			},
+		},
+		{
+			name:     "block volume on rocksdb",
+			mutate:   func(spec *UStoreSpec) { spec.Volumes[0].VolumeMode = string(corev1.PersistentVolumeBlock) },
+			expected: []string{"Invalid value: spec.volumes[0].volumeMode"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spec := validSpec()
+			test.mutate(spec)
+			errs := validateSpec(spec, field.NewPath("spec"))
+			found := []string{}
+			for _, err := range errs {
+				found = append(found, err.Type.String()+": "+err.Field)
+			}
+			if strings.Join(found, "\n") != strings.Join(test.expected, "\n") {
+				t.Errorf("expected errors %q, got %q", test.expected, found)
+			}
+		})
+	}
+}
+
+func TestValidateUpgrade(t *testing.T) {
+	tests := []struct {
+		name    string
+		current string
+		target  string
+		valid   bool
+	}{
+		{name: "same version", current: "0.3.0", target: "0.3.0", valid: true},
+		{name: "patch release", current: "0.3.0", target: "0.3.2", valid: true},
+		{name: "next minor version", current: "0.3.2", target: "0.4.0", valid: true},
+		{name: "skipped minor version", current: "0.3.0", target: "0.5.0"},
+		{name: "downgrade", current: "0.4.0", target: "0.3.9"},
+		{name: "major version", current: "0.9.0", target: "1.0.0"},
+		{name: "invalid current version", current: "latest", target: "0.3.0"},
+		{name: "invalid target version", current: "0.3.0", target: "latest"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateUpgrade(test.current, test.target)
+			if test.valid && err != nil {
+				t.Errorf("expected %s to %s to be valid, got %v", test.current, test.target, err)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("expected %s to %s to be rejected", test.current, test.target)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Phases reported by UStoreBackup and UStoreRestore.
+const (
+	PhasePending   = "Pending"
+	PhaseRunning   = "Running"
+	PhaseCompleted = "Completed"
+	PhaseFailed    = "Failed"
+)
+
+// UStoreBackupSpec defines the desired state of UStoreBackup
+type UStoreBackupSpec struct {
+	// Name of the UStore in the same namespace to back up. Immutable.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="Value is immutable"
+	UStoreName string `json:"ustoreName"`
+
+	// Destination of the backup archive. Immutable.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="Value is immutable"
+	Destination BackupDestination `json:"destination"`
+}
+
+// Defines where a backup archive is stored. Exactly one of s3 or pvc must be set.
+// +kubebuilder:validation:XValidation:rule="has(self.s3) != has(self.pvc)", message="Exactly one of s3 or pvc is required"
+type BackupDestination struct {
+	// S3 compatible object storage, e.g. AWS S3 or MinIO.
+	S3 *S3Destination `json:"s3,omitempty"`
+	// Existing persistent volume claim in the UStore namespace.
+	PVC *PVCDestination `json:"pvc,omitempty"`
+}
+
+// Defines an S3 compatible bucket
+type S3Destination struct {
+	// Endpoint URL of the object storage, e.g. http://minio.minio.svc:9000. Empty for AWS S3.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Bucket name.
+	// +kubebuilder:validation:Required
+	Bucket string `json:"bucket"`
+	// Key prefix of the archives inside the bucket.
+	Prefix string `json:"prefix,omitempty"`
+	// Region of the bucket.
+	Region string `json:"region,omitempty"`
+	// Name of a secret with AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY keys.
+	// +kubebuilder:validation:Required
+	CredentialsSecretName string `json:"credentialsSecretName"`
+}
+
+// Defines a persistent volume claim holding backup archives
+type PVCDestination struct {
+	// Name of the claim.
+	// +kubebuilder:validation:Required
+	ClaimName string `json:"claimName"`
+	// Directory inside the claim.
+	SubPath string `json:"subPath,omitempty"`
+}
+
+// UStoreBackupStatus defines the observed state of UStoreBackup
+type UStoreBackupStatus struct {
+	// Phase of the backup: Pending, Running, Completed or Failed.
+	Phase string `json:"phase,omitempty"`
+	// Human readable details about the phase.
+	Message string `json:"message,omitempty"`
+	// Name of the Job taking the backup.
+	JobName string `json:"jobName,omitempty"`
+	// Location of the archive, s3://<bucket>/<key> or pvc://<claim>/<path>.
+	Location string `json:"location,omitempty"`
+	// Size of the archive in bytes.
+	Size int64 `json:"size,omitempty"`
+	// SHA-256 checksum of the archive.
+	Checksum string `json:"checksum,omitempty"`
+	// Time the backup Job started.
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+	// Time the backup Job completed.
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	// Duration of the backup.
+	Duration string `json:"duration,omitempty"`
+	// Spec of the UStore at the time of the backup, used to provision restores.
+	SourceSpec *UStoreSpec `json:"sourceSpec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="UStore",type=string,JSONPath=`.spec.ustoreName`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Size",type=integer,JSONPath=`.status.size`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// UStoreBackup is the Schema for the ustorebackups API.
+// The volumes are archived while the UStore keeps running, file by file, so the archive is not
+// a point-in-time copy: RocksDB and LevelDB may need a repair, or fail to open, once restored.
+// For a consistent copy, take a UStoreSnapshot with scaleToZero.
+type UStoreBackup struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   UStoreBackupSpec   `json:"spec,omitempty"`
+	Status UStoreBackupStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// UStoreBackupList contains a list of UStoreBackup
+type UStoreBackupList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []UStoreBackup `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&UStoreBackup{}, &UStoreBackupList{})
+}
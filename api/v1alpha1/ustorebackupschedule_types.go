@@ -0,0 +1,104 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// UStoreBackupScheduleSpec defines the desired state of UStoreBackupSchedule
+type UStoreBackupScheduleSpec struct {
+	// Name of the UStore in the same namespace to back up.
+	// +kubebuilder:validation:Required
+	UStoreName string `json:"ustoreName"`
+
+	// Schedule in cron format, e.g. "0 2 * * *" or "@daily".
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength=1
+	Schedule string `json:"schedule"`
+
+	// Destination of the backup archives.
+	// +kubebuilder:validation:Required
+	Destination BackupDestination `json:"destination"`
+
+	// Which completed backups to keep. All backups are kept when empty.
+	Retention BackupRetention `json:"retention,omitempty"`
+
+	// Suspend stops creating new backups. Retention is still applied.
+	Suspend bool `json:"suspend,omitempty"`
+}
+
+// Defines which completed backups of a schedule are kept. A backup is kept if any rule keeps it.
+// Failed backups older than the last completed one are always removed.
+type BackupRetention struct {
+	// Number of most recent completed backups to keep.
+	// +kubebuilder:validation:Minimum=1
+	KeepLast *int32 `json:"keepLast,omitempty"`
+	// Number of days for which the most recent completed backup of each day is kept.
+	// +kubebuilder:validation:Minimum=1
+	KeepDaily *int32 `json:"keepDaily,omitempty"`
+}
+
+// UStoreBackupScheduleStatus defines the observed state of UStoreBackupSchedule
+type UStoreBackupScheduleStatus struct {
+	// Time of the last run, which created a backup or was skipped while a backup was in progress.
+	LastScheduleTime *metav1.Time `json:"lastScheduleTime,omitempty"`
+	// Name of the most recent completed backup.
+	LastSuccessfulBackup string `json:"lastSuccessfulBackup,omitempty"`
+	// Completion time of the most recent completed backup.
+	LastSuccessfulTime *metav1.Time `json:"lastSuccessfulTime,omitempty"`
+	// Name of the most recent failed backup.
+	LastFailedBackup string `json:"lastFailedBackup,omitempty"`
+	// Completion time of the most recent failed backup.
+	LastFailedTime *metav1.Time `json:"lastFailedTime,omitempty"`
+	// Failure message of the most recent failed backup.
+	LastFailureMessage string `json:"lastFailureMessage,omitempty"`
+	// Names of the backups still running.
+	Active []string `json:"active,omitempty"`
+	// Human readable details, e.g. an invalid schedule.
+	Message string `json:"message,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="UStore",type=string,JSONPath=`.spec.ustoreName`
+//+kubebuilder:printcolumn:name="Schedule",type=string,JSONPath=`.spec.schedule`
+//+kubebuilder:printcolumn:name="Suspend",type=boolean,JSONPath=`.spec.suspend`
+//+kubebuilder:printcolumn:name="Last Success",type=date,JSONPath=`.status.lastSuccessfulTime`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// UStoreBackupSchedule is the Schema for the ustorebackupschedules API
+type UStoreBackupSchedule struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   UStoreBackupScheduleSpec   `json:"spec,omitempty"`
+	Status UStoreBackupScheduleStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// UStoreBackupScheduleList contains a list of UStoreBackupSchedule
+type UStoreBackupScheduleList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []UStoreBackupSchedule `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&UStoreBackupSchedule{}, &UStoreBackupScheduleList{})
+}
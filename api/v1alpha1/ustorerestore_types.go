@@ -0,0 +1,83 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// UStoreRestoreSpec defines the desired state of UStoreRestore
+type UStoreRestoreSpec struct {
+	// Name of a completed UStoreBackup in the same namespace. Immutable.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="Value is immutable"
+	BackupName string `json:"backupName"`
+
+	// Name of the new UStore to provision from the backup. It must not exist yet. Immutable.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="Value is immutable"
+	UStoreName string `json:"ustoreName"`
+
+	// Spec of the new UStore. Defaults to the spec of the backed up UStore.
+	// Volumes are matched to the backup by mount path.
+	UStoreSpec *UStoreSpec `json:"ustoreSpec,omitempty"`
+}
+
+// UStoreRestoreStatus defines the observed state of UStoreRestore
+type UStoreRestoreStatus struct {
+	// Phase of the restore: Pending, Running, Completed or Failed.
+	Phase string `json:"phase,omitempty"`
+	// Human readable details about the phase.
+	Message string `json:"message,omitempty"`
+	// Name of the Job restoring the data.
+	JobName string `json:"jobName,omitempty"`
+	// Time the restore Job started.
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+	// Time the restored UStore was created.
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	// Duration of the restore.
+	Duration string `json:"duration,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Backup",type=string,JSONPath=`.spec.backupName`
+//+kubebuilder:printcolumn:name="UStore",type=string,JSONPath=`.spec.ustoreName`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// UStoreRestore is the Schema for the ustorerestores API
+type UStoreRestore struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   UStoreRestoreSpec   `json:"spec,omitempty"`
+	Status UStoreRestoreStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// UStoreRestoreList contains a list of UStoreRestore
+type UStoreRestoreList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []UStoreRestore `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&UStoreRestore{}, &UStoreRestoreList{})
+}
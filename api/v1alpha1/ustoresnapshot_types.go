@@ -0,0 +1,90 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// UStoreSnapshotSpec defines the desired state of UStoreSnapshot
+type UStoreSnapshotSpec struct {
+	// Name of the UStore in the same namespace to snapshot. Immutable.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="Value is immutable"
+	UStoreName string `json:"ustoreName"`
+
+	// VolumeSnapshotClass used for the snapshots. Defaults to spec.snapshots of the UStore.
+	VolumeSnapshotClassName string `json:"volumeSnapshotClassName,omitempty"`
+
+	// Scale the UStore to zero replicas while the snapshots are cut. Defaults to spec.snapshots of the UStore.
+	ScaleToZero *bool `json:"scaleToZero,omitempty"`
+}
+
+// Reports the VolumeSnapshot taken of one UStore claim
+type VolumeSnapshotStatus struct {
+	// Mount path of the volume in the UStore container.
+	MountPath string `json:"mountPath"`
+	// Name of the snapshotted claim.
+	ClaimName string `json:"claimName"`
+	// Name of the VolumeSnapshot, usable as a volume dataSource.
+	VolumeSnapshotName string `json:"volumeSnapshotName"`
+	// Whether the snapshot can be restored from.
+	ReadyToUse bool `json:"readyToUse,omitempty"`
+	// Minimum size of a claim restored from the snapshot.
+	RestoreSize *resource.Quantity `json:"restoreSize,omitempty"`
+}
+
+// UStoreSnapshotStatus defines the observed state of UStoreSnapshot
+type UStoreSnapshotStatus struct {
+	// Phase of the snapshot: Pending, Running, Completed or Failed.
+	Phase string `json:"phase,omitempty"`
+	// Human readable details about the phase.
+	Message string `json:"message,omitempty"`
+	// Snapshots of the UStore claims.
+	Volumes []VolumeSnapshotStatus `json:"volumes,omitempty"`
+	// Time all the snapshots became ready to use.
+	ReadyTime *metav1.Time `json:"readyTime,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="UStore",type=string,JSONPath=`.spec.ustoreName`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// UStoreSnapshot is the Schema for the ustoresnapshots API
+type UStoreSnapshot struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   UStoreSnapshotSpec   `json:"spec,omitempty"`
+	Status UStoreSnapshotStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// UStoreSnapshotList contains a list of UStoreSnapshot
+type UStoreSnapshotList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []UStoreSnapshot `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&UStoreSnapshot{}, &UStoreSnapshotList{})
+}
@@ -22,60 +22,854 @@ limitations under the License.
 package v1alpha1
 
 import (
-	runtime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BackupDestination) DeepCopyInto(out *BackupDestination) {
+	*out = *in
+	if in.S3 != nil {
+		in, out := &in.S3, &out.S3
+		*out = new(S3Destination)
+		**out = **in
+	}
+	if in.PVC != nil {
+		in, out := &in.PVC, &out.PVC
+		*out = new(PVCDestination)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BackupDestination.
+func (in *BackupDestination) DeepCopy() *BackupDestination {
+	if in == nil {
+		return nil
+	}
+	out := new(BackupDestination)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BackupRetention) DeepCopyInto(out *BackupRetention) {
+	*out = *in
+	if in.KeepLast != nil {
+		in, out := &in.KeepLast, &out.KeepLast
+		*out = new(int32)
+		**out = **in
+	}
+	if in.KeepDaily != nil {
+		in, out := &in.KeepDaily, &out.KeepDaily
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BackupRetention.
+func (in *BackupRetention) DeepCopy() *BackupRetention {
+	if in == nil {
+		return nil
+	}
+	out := new(BackupRetention)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DataDirectory) DeepCopyInto(out *DataDirectory) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DataDirectory.
+func (in *DataDirectory) DeepCopy() *DataDirectory {
+	if in == nil {
+		return nil
+	}
+	out := new(DataDirectory)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DisruptionSpec) DeepCopyInto(out *DisruptionSpec) {
+	*out = *in
+	if in.MinAvailable != nil {
+		in, out := &in.MinAvailable, &out.MinAvailable
+		*out = new(intstr.IntOrString)
+		**out = **in
+	}
+	if in.MaxUnavailable != nil {
+		in, out := &in.MaxUnavailable, &out.MaxUnavailable
+		*out = new(intstr.IntOrString)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DisruptionSpec.
+func (in *DisruptionSpec) DeepCopy() *DisruptionSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(DisruptionSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *EngineConfig) DeepCopyInto(out *EngineConfig) {
+	*out = *in
+	if in.LevelDB != nil {
+		in, out := &in.LevelDB, &out.LevelDB
+		*out = new(LevelDBConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.RocksDB != nil {
+		in, out := &in.RocksDB, &out.RocksDB
+		*out = new(RocksDBConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.UDisk != nil {
+		in, out := &in.UDisk, &out.UDisk
+		*out = new(UDiskConfig)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EngineConfig.
+func (in *EngineConfig) DeepCopy() *EngineConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(EngineConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ExposeSpec) DeepCopyInto(out *ExposeSpec) {
+	*out = *in
+	if in.Route != nil {
+		in, out := &in.Route, &out.Route
+		*out = new(RouteExposeSpec)
+		**out = **in
+	}
+	if in.Gateway != nil {
+		in, out := &in.Gateway, &out.Gateway
+		*out = new(GatewayExposeSpec)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExposeSpec.
+func (in *ExposeSpec) DeepCopy() *ExposeSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ExposeSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ExposeStatus) DeepCopyInto(out *ExposeStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExposeStatus.
+func (in *ExposeStatus) DeepCopy() *ExposeStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ExposeStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GatewayExposeSpec) DeepCopyInto(out *GatewayExposeSpec) {
+	*out = *in
+	if in.ParentRefs != nil {
+		in, out := &in.ParentRefs, &out.ParentRefs
+		*out = make([]GatewayParentRef, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GatewayExposeSpec.
+func (in *GatewayExposeSpec) DeepCopy() *GatewayExposeSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(GatewayExposeSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GatewayParentRef) DeepCopyInto(out *GatewayParentRef) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GatewayParentRef.
+func (in *GatewayParentRef) DeepCopy() *GatewayParentRef {
+	if in == nil {
+		return nil
+	}
+	out := new(GatewayParentRef)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LevelDBConfig) DeepCopyInto(out *LevelDBConfig) {
+	*out = *in
+	if in.WriteBufferSize != nil {
+		in, out := &in.WriteBufferSize, &out.WriteBufferSize
+		*out = new(int64)
+		**out = **in
+	}
+	if in.MaxFileSize != nil {
+		in, out := &in.MaxFileSize, &out.MaxFileSize
+		*out = new(int64)
+		**out = **in
+	}
+	if in.MaxOpenFiles != nil {
+		in, out := &in.MaxOpenFiles, &out.MaxOpenFiles
+		*out = new(int32)
+		**out = **in
+	}
+	if in.CacheSize != nil {
+		in, out := &in.CacheSize, &out.CacheSize
+		*out = new(int64)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LevelDBConfig.
+func (in *LevelDBConfig) DeepCopy() *LevelDBConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(LevelDBConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MemoryTuningStatus) DeepCopyInto(out *MemoryTuningStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MemoryTuningStatus.
+func (in *MemoryTuningStatus) DeepCopy() *MemoryTuningStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(MemoryTuningStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *NodeAffinityLabel) DeepCopyInto(out *NodeAffinityLabel) {
 	*out = *in
+	if in.Values != nil {
+		in, out := &in.Values, &out.Values
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeAffinityLabel.
+func (in *NodeAffinityLabel) DeepCopy() *NodeAffinityLabel {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeAffinityLabel)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PVCDestination) DeepCopyInto(out *PVCDestination) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PVCDestination.
+func (in *PVCDestination) DeepCopy() *PVCDestination {
+	if in == nil {
+		return nil
+	}
+	out := new(PVCDestination)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Persistence) DeepCopyInto(out *Persistence) {
+	*out = *in
+	if in.StorageClassName != nil {
+		in, out := &in.StorageClassName, &out.StorageClassName
+		*out = new(string)
+		**out = **in
+	}
+	if in.Labels != nil {
+		in, out := &in.Labels, &out.Labels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Annotations != nil {
+		in, out := &in.Annotations, &out.Annotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Selector != nil {
+		in, out := &in.Selector, &out.Selector
+		*out = new(metav1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.DataSource != nil {
+		in, out := &in.DataSource, &out.DataSource
+		*out = new(v1.TypedLocalObjectReference)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Persistence.
+func (in *Persistence) DeepCopy() *Persistence {
+	if in == nil {
+		return nil
+	}
+	out := new(Persistence)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PodAntiAffinitySpec) DeepCopyInto(out *PodAntiAffinitySpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PodAntiAffinitySpec.
+func (in *PodAntiAffinitySpec) DeepCopy() *PodAntiAffinitySpec {
+	if in == nil {
+		return nil
+	}
+	out := new(PodAntiAffinitySpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProbeSpec) DeepCopyInto(out *ProbeSpec) {
+	*out = *in
+	if in.InitialDelaySeconds != nil {
+		in, out := &in.InitialDelaySeconds, &out.InitialDelaySeconds
+		*out = new(int32)
+		**out = **in
+	}
+	if in.PeriodSeconds != nil {
+		in, out := &in.PeriodSeconds, &out.PeriodSeconds
+		*out = new(int32)
+		**out = **in
+	}
+	if in.TimeoutSeconds != nil {
+		in, out := &in.TimeoutSeconds, &out.TimeoutSeconds
+		*out = new(int32)
+		**out = **in
+	}
+	if in.SuccessThreshold != nil {
+		in, out := &in.SuccessThreshold, &out.SuccessThreshold
+		*out = new(int32)
+		**out = **in
+	}
+	if in.FailureThreshold != nil {
+		in, out := &in.FailureThreshold, &out.FailureThreshold
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProbeSpec.
+func (in *ProbeSpec) DeepCopy() *ProbeSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ProbeSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProbesSpec) DeepCopyInto(out *ProbesSpec) {
+	*out = *in
+	if in.Startup != nil {
+		in, out := &in.Startup, &out.Startup
+		*out = new(ProbeSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Readiness != nil {
+		in, out := &in.Readiness, &out.Readiness
+		*out = new(ProbeSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Liveness != nil {
+		in, out := &in.Liveness, &out.Liveness
+		*out = new(ProbeSpec)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProbesSpec.
+func (in *ProbesSpec) DeepCopy() *ProbesSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ProbesSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RocksDBConfig) DeepCopyInto(out *RocksDBConfig) {
+	*out = *in
+	if in.WriteBufferSize != nil {
+		in, out := &in.WriteBufferSize, &out.WriteBufferSize
+		*out = new(int64)
+		**out = **in
+	}
+	if in.MaxWriteBufferNumber != nil {
+		in, out := &in.MaxWriteBufferNumber, &out.MaxWriteBufferNumber
+		*out = new(int32)
+		**out = **in
+	}
+	if in.MaxOpenFiles != nil {
+		in, out := &in.MaxOpenFiles, &out.MaxOpenFiles
+		*out = new(int32)
+		**out = **in
+	}
+	if in.TargetFileSizeBase != nil {
+		in, out := &in.TargetFileSizeBase, &out.TargetFileSizeBase
+		*out = new(int64)
+		**out = **in
+	}
+	if in.MaxBytesForLevelBase != nil {
+		in, out := &in.MaxBytesForLevelBase, &out.MaxBytesForLevelBase
+		*out = new(int64)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RocksDBConfig.
+func (in *RocksDBConfig) DeepCopy() *RocksDBConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(RocksDBConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RouteExposeSpec) DeepCopyInto(out *RouteExposeSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RouteExposeSpec.
+func (in *RouteExposeSpec) DeepCopy() *RouteExposeSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(RouteExposeSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *S3Destination) DeepCopyInto(out *S3Destination) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new S3Destination.
+func (in *S3Destination) DeepCopy() *S3Destination {
+	if in == nil {
+		return nil
+	}
+	out := new(S3Destination)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServiceSpec) DeepCopyInto(out *ServiceSpec) {
+	*out = *in
+	if in.Annotations != nil {
+		in, out := &in.Annotations, &out.Annotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.LoadBalancerSourceRanges != nil {
+		in, out := &in.LoadBalancerSourceRanges, &out.LoadBalancerSourceRanges
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServiceSpec.
+func (in *ServiceSpec) DeepCopy() *ServiceSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ServiceSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SnapshotsSpec) DeepCopyInto(out *SnapshotsSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SnapshotsSpec.
+func (in *SnapshotsSpec) DeepCopy() *SnapshotsSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(SnapshotsSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UDiskConfig) DeepCopyInto(out *UDiskConfig) {
+	*out = *in
+	if in.Threads != nil {
+		in, out := &in.Threads, &out.Threads
+		*out = new(int32)
+		**out = **in
+	}
+	if in.IOQueueDepth != nil {
+		in, out := &in.IOQueueDepth, &out.IOQueueDepth
+		*out = new(int32)
+		**out = **in
+	}
+	if in.DataDirectories != nil {
+		in, out := &in.DataDirectories, &out.DataDirectories
+		*out = make([]DataDirectory, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UDiskConfig.
+func (in *UDiskConfig) DeepCopy() *UDiskConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(UDiskConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UStore) DeepCopyInto(out *UStore) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UStore.
+func (in *UStore) DeepCopy() *UStore {
+	if in == nil {
+		return nil
+	}
+	out := new(UStore)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *UStore) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UStoreBackup) DeepCopyInto(out *UStoreBackup) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UStoreBackup.
+func (in *UStoreBackup) DeepCopy() *UStoreBackup {
+	if in == nil {
+		return nil
+	}
+	out := new(UStoreBackup)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *UStoreBackup) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UStoreBackupList) DeepCopyInto(out *UStoreBackupList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]UStoreBackup, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UStoreBackupList.
+func (in *UStoreBackupList) DeepCopy() *UStoreBackupList {
+	if in == nil {
+		return nil
+	}
+	out := new(UStoreBackupList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *UStoreBackupList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UStoreBackupSchedule) DeepCopyInto(out *UStoreBackupSchedule) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UStoreBackupSchedule.
+func (in *UStoreBackupSchedule) DeepCopy() *UStoreBackupSchedule {
+	if in == nil {
+		return nil
+	}
+	out := new(UStoreBackupSchedule)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *UStoreBackupSchedule) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UStoreBackupScheduleList) DeepCopyInto(out *UStoreBackupScheduleList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]UStoreBackupSchedule, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UStoreBackupScheduleList.
+func (in *UStoreBackupScheduleList) DeepCopy() *UStoreBackupScheduleList {
+	if in == nil {
+		return nil
+	}
+	out := new(UStoreBackupScheduleList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *UStoreBackupScheduleList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UStoreBackupScheduleSpec) DeepCopyInto(out *UStoreBackupScheduleSpec) {
+	*out = *in
+	in.Destination.DeepCopyInto(&out.Destination)
+	in.Retention.DeepCopyInto(&out.Retention)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UStoreBackupScheduleSpec.
+func (in *UStoreBackupScheduleSpec) DeepCopy() *UStoreBackupScheduleSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(UStoreBackupScheduleSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UStoreBackupScheduleStatus) DeepCopyInto(out *UStoreBackupScheduleStatus) {
+	*out = *in
+	if in.LastScheduleTime != nil {
+		in, out := &in.LastScheduleTime, &out.LastScheduleTime
+		*out = (*in).DeepCopy()
+	}
+	if in.LastSuccessfulTime != nil {
+		in, out := &in.LastSuccessfulTime, &out.LastSuccessfulTime
+		*out = (*in).DeepCopy()
+	}
+	if in.LastFailedTime != nil {
+		in, out := &in.LastFailedTime, &out.LastFailedTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Active != nil {
+		in, out := &in.Active, &out.Active
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeAffinityLabel.
-func (in *NodeAffinityLabel) DeepCopy() *NodeAffinityLabel {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UStoreBackupScheduleStatus.
+func (in *UStoreBackupScheduleStatus) DeepCopy() *UStoreBackupScheduleStatus {
 	if in == nil {
 		return nil
 	}
-	out := new(NodeAffinityLabel)
+	out := new(UStoreBackupScheduleStatus)
 	in.DeepCopyInto(out)
 	return out
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *Persistence) DeepCopyInto(out *Persistence) {
+func (in *UStoreBackupSpec) DeepCopyInto(out *UStoreBackupSpec) {
 	*out = *in
+	in.Destination.DeepCopyInto(&out.Destination)
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Persistence.
-func (in *Persistence) DeepCopy() *Persistence {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UStoreBackupSpec.
+func (in *UStoreBackupSpec) DeepCopy() *UStoreBackupSpec {
 	if in == nil {
 		return nil
 	}
-	out := new(Persistence)
+	out := new(UStoreBackupSpec)
 	in.DeepCopyInto(out)
 	return out
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *UStore) DeepCopyInto(out *UStore) {
+func (in *UStoreBackupStatus) DeepCopyInto(out *UStoreBackupStatus) {
+	*out = *in
+	if in.StartTime != nil {
+		in, out := &in.StartTime, &out.StartTime
+		*out = (*in).DeepCopy()
+	}
+	if in.CompletionTime != nil {
+		in, out := &in.CompletionTime, &out.CompletionTime
+		*out = (*in).DeepCopy()
+	}
+	if in.SourceSpec != nil {
+		in, out := &in.SourceSpec, &out.SourceSpec
+		*out = new(UStoreSpec)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UStoreBackupStatus.
+func (in *UStoreBackupStatus) DeepCopy() *UStoreBackupStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(UStoreBackupStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UStoreList) DeepCopyInto(out *UStoreList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]UStore, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UStoreList.
+func (in *UStoreList) DeepCopy() *UStoreList {
+	if in == nil {
+		return nil
+	}
+	out := new(UStoreList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *UStoreList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UStoreRestore) DeepCopyInto(out *UStoreRestore) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UStore.
-func (in *UStore) DeepCopy() *UStore {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UStoreRestore.
+func (in *UStoreRestore) DeepCopy() *UStoreRestore {
 	if in == nil {
 		return nil
 	}
-	out := new(UStore)
+	out := new(UStoreRestore)
 	in.DeepCopyInto(out)
 	return out
 }
 
 // DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
-func (in *UStore) DeepCopyObject() runtime.Object {
+func (in *UStoreRestore) DeepCopyObject() runtime.Object {
 	if c := in.DeepCopy(); c != nil {
 		return c
 	}
@@ -83,50 +877,283 @@ func (in *UStore) DeepCopyObject() runtime.Object {
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *UStoreList) DeepCopyInto(out *UStoreList) {
+func (in *UStoreRestoreList) DeepCopyInto(out *UStoreRestoreList) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ListMeta.DeepCopyInto(&out.ListMeta)
 	if in.Items != nil {
 		in, out := &in.Items, &out.Items
-		*out = make([]UStore, len(*in))
+		*out = make([]UStoreRestore, len(*in))
 		for i := range *in {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UStoreList.
-func (in *UStoreList) DeepCopy() *UStoreList {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UStoreRestoreList.
+func (in *UStoreRestoreList) DeepCopy() *UStoreRestoreList {
 	if in == nil {
 		return nil
 	}
-	out := new(UStoreList)
+	out := new(UStoreRestoreList)
 	in.DeepCopyInto(out)
 	return out
 }
 
 // DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
-func (in *UStoreList) DeepCopyObject() runtime.Object {
+func (in *UStoreRestoreList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UStoreRestoreSpec) DeepCopyInto(out *UStoreRestoreSpec) {
+	*out = *in
+	if in.UStoreSpec != nil {
+		in, out := &in.UStoreSpec, &out.UStoreSpec
+		*out = new(UStoreSpec)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UStoreRestoreSpec.
+func (in *UStoreRestoreSpec) DeepCopy() *UStoreRestoreSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(UStoreRestoreSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UStoreRestoreStatus) DeepCopyInto(out *UStoreRestoreStatus) {
+	*out = *in
+	if in.StartTime != nil {
+		in, out := &in.StartTime, &out.StartTime
+		*out = (*in).DeepCopy()
+	}
+	if in.CompletionTime != nil {
+		in, out := &in.CompletionTime, &out.CompletionTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UStoreRestoreStatus.
+func (in *UStoreRestoreStatus) DeepCopy() *UStoreRestoreStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(UStoreRestoreStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UStoreSnapshot) DeepCopyInto(out *UStoreSnapshot) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UStoreSnapshot.
+func (in *UStoreSnapshot) DeepCopy() *UStoreSnapshot {
+	if in == nil {
+		return nil
+	}
+	out := new(UStoreSnapshot)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *UStoreSnapshot) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UStoreSnapshotList) DeepCopyInto(out *UStoreSnapshotList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]UStoreSnapshot, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UStoreSnapshotList.
+func (in *UStoreSnapshotList) DeepCopy() *UStoreSnapshotList {
+	if in == nil {
+		return nil
+	}
+	out := new(UStoreSnapshotList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *UStoreSnapshotList) DeepCopyObject() runtime.Object {
 	if c := in.DeepCopy(); c != nil {
 		return c
 	}
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UStoreSnapshotSpec) DeepCopyInto(out *UStoreSnapshotSpec) {
+	*out = *in
+	if in.ScaleToZero != nil {
+		in, out := &in.ScaleToZero, &out.ScaleToZero
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UStoreSnapshotSpec.
+func (in *UStoreSnapshotSpec) DeepCopy() *UStoreSnapshotSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(UStoreSnapshotSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UStoreSnapshotStatus) DeepCopyInto(out *UStoreSnapshotStatus) {
+	*out = *in
+	if in.Volumes != nil {
+		in, out := &in.Volumes, &out.Volumes
+		*out = make([]VolumeSnapshotStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.ReadyTime != nil {
+		in, out := &in.ReadyTime, &out.ReadyTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UStoreSnapshotStatus.
+func (in *UStoreSnapshotStatus) DeepCopy() *UStoreSnapshotStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(UStoreSnapshotStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *UStoreSpec) DeepCopyInto(out *UStoreSpec) {
 	*out = *in
+	if in.EngineConfig != nil {
+		in, out := &in.EngineConfig, &out.EngineConfig
+		*out = new(EngineConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Service != nil {
+		in, out := &in.Service, &out.Service
+		*out = new(ServiceSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Expose != nil {
+		in, out := &in.Expose, &out.Expose
+		*out = new(ExposeSpec)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.Volumes != nil {
 		in, out := &in.Volumes, &out.Volumes
 		*out = make([]Persistence, len(*in))
-		copy(*out, *in)
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Resources != nil {
+		in, out := &in.Resources, &out.Resources
+		*out = new(v1.ResourceRequirements)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Disruption != nil {
+		in, out := &in.Disruption, &out.Disruption
+		*out = new(DisruptionSpec)
+		(*in).DeepCopyInto(*out)
 	}
 	if in.NodeAffinityLabels != nil {
 		in, out := &in.NodeAffinityLabels, &out.NodeAffinityLabels
 		*out = make([]NodeAffinityLabel, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.NodeSelector != nil {
+		in, out := &in.NodeSelector, &out.NodeSelector
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Tolerations != nil {
+		in, out := &in.Tolerations, &out.Tolerations
+		*out = make([]v1.Toleration, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.PodAntiAffinity != nil {
+		in, out := &in.PodAntiAffinity, &out.PodAntiAffinity
+		*out = new(PodAntiAffinitySpec)
+		**out = **in
+	}
+	if in.TopologySpreadConstraints != nil {
+		in, out := &in.TopologySpreadConstraints, &out.TopologySpreadConstraints
+		*out = make([]v1.TopologySpreadConstraint, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.PodSecurityContext != nil {
+		in, out := &in.PodSecurityContext, &out.PodSecurityContext
+		*out = new(v1.PodSecurityContext)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ContainerSecurityContext != nil {
+		in, out := &in.ContainerSecurityContext, &out.ContainerSecurityContext
+		*out = new(v1.SecurityContext)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ImagePullSecrets != nil {
+		in, out := &in.ImagePullSecrets, &out.ImagePullSecrets
+		*out = make([]v1.LocalObjectReference, len(*in))
 		copy(*out, *in)
 	}
+	if in.Upgrade != nil {
+		in, out := &in.Upgrade, &out.Upgrade
+		*out = new(UpgradeSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Probes != nil {
+		in, out := &in.Probes, &out.Probes
+		*out = new(ProbesSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Snapshots != nil {
+		in, out := &in.Snapshots, &out.Snapshots
+		*out = new(SnapshotsSpec)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UStoreSpec.
@@ -142,6 +1169,32 @@ func (in *UStoreSpec) DeepCopy() *UStoreSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *UStoreStatus) DeepCopyInto(out *UStoreStatus) {
 	*out = *in
+	if in.Expose != nil {
+		in, out := &in.Expose, &out.Expose
+		*out = new(ExposeStatus)
+		**out = **in
+	}
+	if in.Volumes != nil {
+		in, out := &in.Volumes, &out.Volumes
+		*out = make([]VolumeStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.UpgradeStartTime != nil {
+		in, out := &in.UpgradeStartTime, &out.UpgradeStartTime
+		*out = (*in).DeepCopy()
+	}
+	if in.MemoryTuning != nil {
+		in, out := &in.MemoryTuning, &out.MemoryTuning
+		*out = new(MemoryTuningStatus)
+		**out = **in
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UStoreStatus.
@@ -153,3 +1206,63 @@ func (in *UStoreStatus) DeepCopy() *UStoreStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UpgradeSpec) DeepCopyInto(out *UpgradeSpec) {
+	*out = *in
+	if in.Backup != nil {
+		in, out := &in.Backup, &out.Backup
+		*out = new(BackupDestination)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Timeout != nil {
+		in, out := &in.Timeout, &out.Timeout
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UpgradeSpec.
+func (in *UpgradeSpec) DeepCopy() *UpgradeSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(UpgradeSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VolumeSnapshotStatus) DeepCopyInto(out *VolumeSnapshotStatus) {
+	*out = *in
+	if in.RestoreSize != nil {
+		in, out := &in.RestoreSize, &out.RestoreSize
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VolumeSnapshotStatus.
+func (in *VolumeSnapshotStatus) DeepCopy() *VolumeSnapshotStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(VolumeSnapshotStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VolumeStatus) DeepCopyInto(out *VolumeStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VolumeStatus.
+func (in *VolumeStatus) DeepCopy() *VolumeStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(VolumeStatus)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -0,0 +1,358 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+	"github.com/opdev/ustore-operator/controllers/utils"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// archiveResult is written by the archive container to its termination message.
+type archiveResult struct {
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
+// archiveScript tars /data into $ARCHIVE and reports its size and checksum.
+const archiveScript = `set -e
+mkdir -p "$(dirname "$ARCHIVE")"
+tar -czf "$ARCHIVE" -C /data .
+SIZE=$(wc -c < "$ARCHIVE")
+CHECKSUM=$(sha256sum "$ARCHIVE" | cut -d' ' -f1)
+printf '{"size":%s,"checksum":"%s"}' "$SIZE" "$CHECKSUM" > /dev/termination-log
+`
+
+func backupJobName(backup *unumv1alpha1.UStoreBackup) string {
+	return backup.Name + "-backup"
+}
+
+func archiveCleanupJobName(backup *unumv1alpha1.UStoreBackup) string {
+	return backup.Name + "-cleanup"
+}
+
+func restoreJobName(restore *unumv1alpha1.UStoreRestore) string {
+	return restore.Name + "-restore"
+}
+
+// backupArchiveKey returns the path of the archive relative to the bucket or claim root.
+func backupArchiveKey(backup *unumv1alpha1.UStoreBackup) string {
+	prefix := ""
+	if backup.Spec.Destination.S3 != nil {
+		prefix = backup.Spec.Destination.S3.Prefix
+	} else if backup.Spec.Destination.PVC != nil {
+		prefix = backup.Spec.Destination.PVC.SubPath
+	}
+	return path.Join(prefix, backup.Spec.UStoreName, backup.Name+".tar.gz")
+}
+
+// backupLocation returns the URL of the archive, s3://<bucket>/<key> or pvc://<claim>/<key>.
+func backupLocation(backup *unumv1alpha1.UStoreBackup) string {
+	if s3 := backup.Spec.Destination.S3; s3 != nil {
+		return fmt.Sprintf("s3://%s/%s", s3.Bucket, backupArchiveKey(backup))
+	}
+	return fmt.Sprintf("pvc://%s/%s", backup.Spec.Destination.PVC.ClaimName, backupArchiveKey(backup))
+}
+
+// backupJobForUStore returns a Job archiving the volumes of the UStore to the backup destination.
+// For a StatefulSet the volumes of the first replica are archived.
+func backupJobForUStore(backup *unumv1alpha1.UStoreBackup, ustoreResource *unumv1alpha1.UStore, images Images, openShift bool) *batchv1.Job {
+	volumes := []corev1.Volume{}
+	volumeMounts := []corev1.VolumeMount{}
+	for i, volume := range ustoreResource.Spec.Volumes {
+		name := fmt.Sprintf("data-%d", i)
+		volumes = append(volumes, claimVolume(name, claimNamesForVolume(ustoreResource, volume)[0], true))
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      name,
+			MountPath: "/data/" + volumeDirName(volume),
+			ReadOnly:  true,
+		})
+	}
+
+	archive := corev1.Container{
+		Name:                     ustore_backup_archive_container,
+		Image:                    images.Backup,
+		Command:                  []string{"sh", "-c", archiveScript},
+		VolumeMounts:             volumeMounts,
+		TerminationMessagePolicy: corev1.TerminationMessageReadFile,
+	}
+	podSpec := corev1.PodSpec{
+		RestartPolicy:    corev1.RestartPolicyNever,
+		Volumes:          volumes,
+		Affinity:         affinityToUStorePods(ustoreResource),
+		NodeSelector:     ustoreResource.Spec.NodeSelector,
+		Tolerations:      ustoreResource.Spec.Tolerations,
+		ImagePullSecrets: ustoreResource.Spec.ImagePullSecrets,
+	}
+
+	if s3 := backup.Spec.Destination.S3; s3 != nil {
+		archivePath := ustore_backup_scratch + "/archive.tar.gz"
+		archive.Env = []corev1.EnvVar{{Name: "ARCHIVE", Value: archivePath}}
+		archive.VolumeMounts = append(archive.VolumeMounts, scratchVolumeMount())
+		podSpec.Volumes = append(podSpec.Volumes, scratchVolume())
+		podSpec.InitContainers = []corev1.Container{archive}
+		podSpec.Containers = []corev1.Container{
+			s3Container("upload", images.BackupS3, s3, "cp", archivePath, fmt.Sprintf("s3://%s/%s", s3.Bucket, backupArchiveKey(backup))),
+		}
+	} else {
+		pvc := backup.Spec.Destination.PVC
+		archive.Env = []corev1.EnvVar{{Name: "ARCHIVE", Value: "/target/" + backupArchiveKey(backup)}}
+		archive.VolumeMounts = append(archive.VolumeMounts, corev1.VolumeMount{Name: "target", MountPath: "/target"})
+		podSpec.Volumes = append(podSpec.Volumes, claimVolume("target", pvc.ClaimName, false))
+		podSpec.Containers = []corev1.Container{archive}
+	}
+
+	return jobForPodSpec(backupJobName(backup), backup.Namespace, ustoreResource, podSpec, openShift)
+}
+
+// restoreJobForUStore returns a Job extracting a backup archive into the claims of the UStore
+// being restored. Volumes are matched to the archive by mount path, and every replica claim
+// of a StatefulSet gets a copy of the data.
+func restoreJobForUStore(restore *unumv1alpha1.UStoreRestore, backup *unumv1alpha1.UStoreBackup, ustoreResource *unumv1alpha1.UStore, images Images, openShift bool) *batchv1.Job {
+	volumes := []corev1.Volume{scratchVolume()}
+	volumeMounts := []corev1.VolumeMount{scratchVolumeMount()}
+	script := []string{
+		"set -e",
+		`[ -z "$CHECKSUM" ] || echo "$CHECKSUM  $ARCHIVE" | sha256sum -c -`,
+		"mkdir -p " + ustore_backup_scratch + "/extract",
+		`tar -xzf "$ARCHIVE" -C ` + ustore_backup_scratch + "/extract",
+	}
+	for _, volume := range ustoreResource.Spec.Volumes {
+		source := fmt.Sprintf("%s/extract/%s", ustore_backup_scratch, volumeDirName(volume))
+		for _, claimName := range claimNamesForVolume(ustoreResource, volume) {
+			volumes = append(volumes, claimVolume(claimName, claimName, false))
+			volumeMounts = append(volumeMounts, corev1.VolumeMount{Name: claimName, MountPath: "/restore/" + claimName})
+			script = append(script, fmt.Sprintf("if [ -d %s ]; then cp -a %s/. /restore/%s/; fi", source, source, claimName))
+		}
+	}
+
+	extract := corev1.Container{
+		Name:         "extract",
+		Image:        images.Backup,
+		Command:      []string{"sh", "-c", strings.Join(script, "\n")},
+		Env:          []corev1.EnvVar{{Name: "CHECKSUM", Value: backup.Status.Checksum}},
+		VolumeMounts: volumeMounts,
+	}
+	podSpec := corev1.PodSpec{
+		RestartPolicy:    corev1.RestartPolicyNever,
+		Volumes:          volumes,
+		NodeSelector:     ustoreResource.Spec.NodeSelector,
+		Tolerations:      ustoreResource.Spec.Tolerations,
+		ImagePullSecrets: ustoreResource.Spec.ImagePullSecrets,
+	}
+
+	if s3 := backup.Spec.Destination.S3; s3 != nil {
+		archivePath := ustore_backup_scratch + "/archive.tar.gz"
+		extract.Env = append(extract.Env, corev1.EnvVar{Name: "ARCHIVE", Value: archivePath})
+		podSpec.InitContainers = []corev1.Container{
+			s3Container("download", images.BackupS3, s3, "cp", fmt.Sprintf("s3://%s/%s", s3.Bucket, backupArchiveKey(backup)), archivePath),
+		}
+	} else {
+		extract.Env = append(extract.Env, corev1.EnvVar{Name: "ARCHIVE", Value: "/source/" + backupArchiveKey(backup)})
+		extract.VolumeMounts = append(extract.VolumeMounts, corev1.VolumeMount{Name: "source", MountPath: "/source", ReadOnly: true})
+		podSpec.Volumes = append(podSpec.Volumes, claimVolume("source", backup.Spec.Destination.PVC.ClaimName, true))
+	}
+	podSpec.Containers = []corev1.Container{extract}
+
+	return jobForPodSpec(restoreJobName(restore), restore.Namespace, ustoreResource, podSpec, openShift)
+}
+
+// archiveCleanupJobForBackup returns a Job deleting the archive of a backup. It runs like the backup Job,
+// with the UStore spec recorded in the backup status as the UStore may be gone.
+func archiveCleanupJobForBackup(backup *unumv1alpha1.UStoreBackup, images Images, openShift bool) *batchv1.Job {
+	ustoreResource := &unumv1alpha1.UStore{
+		ObjectMeta: metav1.ObjectMeta{Name: backup.Spec.UStoreName, Namespace: backup.Namespace},
+		Spec:       *backup.Status.SourceSpec.DeepCopy(),
+	}
+	podSpec := corev1.PodSpec{
+		RestartPolicy:    corev1.RestartPolicyNever,
+		NodeSelector:     ustoreResource.Spec.NodeSelector,
+		Tolerations:      ustoreResource.Spec.Tolerations,
+		ImagePullSecrets: ustoreResource.Spec.ImagePullSecrets,
+	}
+
+	if s3 := backup.Spec.Destination.S3; s3 != nil {
+		podSpec.Volumes = []corev1.Volume{scratchVolume()}
+		podSpec.Containers = []corev1.Container{
+			s3Container("delete", images.BackupS3, s3, "rm", fmt.Sprintf("s3://%s/%s", s3.Bucket, backupArchiveKey(backup))),
+		}
+	} else {
+		podSpec.Volumes = []corev1.Volume{claimVolume("target", backup.Spec.Destination.PVC.ClaimName, false)}
+		podSpec.Containers = []corev1.Container{{
+			Name:         "delete",
+			Image:        images.Backup,
+			Command:      []string{"rm", "-f", "/target/" + backupArchiveKey(backup)},
+			VolumeMounts: []corev1.VolumeMount{{Name: "target", MountPath: "/target"}},
+		}}
+	}
+
+	return jobForPodSpec(archiveCleanupJobName(backup), backup.Namespace, ustoreResource, podSpec, openShift)
+}
+
+// blockVolumes reports whether any UStore volume is a raw block device, which cannot be archived.
+func blockVolumes(ustoreResource *unumv1alpha1.UStore) bool {
+	for _, volume := range ustoreResource.Spec.Volumes {
+		if isBlockVolume(volume) {
+			return true
+		}
+	}
+	return false
+}
+
+// jobForPodSpec returns a Job running the pod spec as the user of the UStore pods, so the archived and
+// restored files keep their owner, with restricted containers. The root file system being read only,
+// the containers get a writable /tmp, also the HOME of aws-cli.
+func jobForPodSpec(name string, namespace string, ustoreResource *unumv1alpha1.UStore, podSpec corev1.PodSpec, openShift bool) *batchv1.Job {
+	podSpec.SecurityContext = podSecurityContextForUStore(ustoreResource, openShift)
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name:         ustore_tmp_volume_name,
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+	})
+	for _, containers := range [][]corev1.Container{podSpec.InitContainers, podSpec.Containers} {
+		for i := range containers {
+			containers[i].SecurityContext = restrictedContainerSecurityContext()
+			containers[i].VolumeMounts = append(containers[i].VolumeMounts, corev1.VolumeMount{Name: ustore_tmp_volume_name, MountPath: "/tmp"})
+		}
+	}
+
+	backoffLimit := int32(2)
+	return &batchv1.Job{
+		ObjectMeta: utils.SetObjectMeta(name, namespace, map[string]string{"app": "ustore-backup", "ownerInstance": ustoreResource.Name}),
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				Spec: podSpec,
+			},
+		},
+	}
+}
+
+// s3Container returns an aws-cli container running an s3 command, e.g. cp with a source and
+// a destination, one of which is an s3:// URL.
+func s3Container(name string, image string, s3 *unumv1alpha1.S3Destination, command ...string) corev1.Container {
+	args := append([]string{"s3"}, command...)
+	if s3.Endpoint != "" {
+		args = append(args, "--endpoint-url", s3.Endpoint)
+	}
+	region := s3.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	return corev1.Container{
+		Name:    name,
+		Image:   image,
+		Command: []string{"aws"},
+		Args:    args,
+		Env: []corev1.EnvVar{
+			secretEnvVar("AWS_ACCESS_KEY_ID", s3.CredentialsSecretName),
+			secretEnvVar("AWS_SECRET_ACCESS_KEY", s3.CredentialsSecretName),
+			{Name: "AWS_DEFAULT_REGION", Value: region},
+			{Name: "HOME", Value: "/tmp"},
+		},
+		VolumeMounts: []corev1.VolumeMount{scratchVolumeMount()},
+	}
+}
+
+func secretEnvVar(key string, secretName string) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: key,
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: secretName},
+				Key:                  key,
+			},
+		},
+	}
+}
+
+func claimVolume(name string, claimName string, readOnly bool) corev1.Volume {
+	return corev1.Volume{
+		Name: name,
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: claimName,
+				ReadOnly:  readOnly,
+			},
+		},
+	}
+}
+
+func scratchVolume() corev1.Volume {
+	return corev1.Volume{
+		Name:         "scratch",
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+	}
+}
+
+func scratchVolumeMount() corev1.VolumeMount {
+	return corev1.VolumeMount{Name: "scratch", MountPath: ustore_backup_scratch}
+}
+
+// affinityToUStorePods prefers the node of the UStore pods so a ReadWriteOnce claim still attached
+// there can be shared. It is not required, a UStore scaled to zero has no pods to schedule next to.
+func affinityToUStorePods(ustoreResource *unumv1alpha1.UStore) *corev1.Affinity {
+	if ustoreResource.Spec.NumOfInstances == 0 {
+		return nil
+	}
+	selector := utils.LabelsForUStore(ustoreResource.Name)
+	if isStatefulSet(ustoreResource) {
+		selector = map[string]string{"statefulset.kubernetes.io/pod-name": ustoreResource.Name + "-0"}
+	}
+	return &corev1.Affinity{
+		PodAffinity: &corev1.PodAffinity{
+			PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{{
+				Weight: 100,
+				PodAffinityTerm: corev1.PodAffinityTerm{
+					LabelSelector: &metav1.LabelSelector{MatchLabels: selector},
+					TopologyKey:   corev1.LabelHostname,
+				},
+			}},
+		},
+	}
+}
+
+// jobFinished reports whether the Job completed or failed, with the failure message.
+func jobFinished(job *batchv1.Job) (bool, string) {
+	for _, c := range job.Status.Conditions {
+		if c.Status != corev1.ConditionTrue {
+			continue
+		}
+		if c.Type == batchv1.JobComplete {
+			return true, ""
+		}
+		if c.Type == batchv1.JobFailed {
+			return true, c.Message
+		}
+	}
+	return false, ""
+}
+
+// readArchiveResult returns the size and checksum reported by the archive container of a Job.
+func readArchiveResult(ctx context.Context, c client.Client, job *batchv1.Job) (*archiveResult, error) {
+	pods := &corev1.PodList{}
+	if err := c.List(ctx, pods, client.InNamespace(job.Namespace), client.MatchingLabels{"job-name": job.Name}); err != nil {
+		return nil, err
+	}
+	for _, pod := range pods.Items {
+		statuses := append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...)
+		for _, status := range statuses {
+			terminated := status.State.Terminated
+			if status.Name != ustore_backup_archive_container || terminated == nil || terminated.ExitCode != 0 {
+				continue
+			}
+			result := &archiveResult{}
+			if err := json.Unmarshal([]byte(terminated.Message), result); err != nil {
+				return nil, fmt.Errorf("failed to parse archive result of Job %s: %w", job.Name, err)
+			}
+			return result, nil
+		}
+	}
+	return nil, fmt.Errorf("no successful archive container found for Job %s", job.Name)
+}
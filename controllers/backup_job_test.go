@@ -0,0 +1,98 @@
+package controllers
+
+import (
+	"testing"
+
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestBackupJobsRunAsNonRoot(t *testing.T) {
+	ustoreResource := &unumv1alpha1.UStore{
+		ObjectMeta: metav1.ObjectMeta{Name: "ustore", Namespace: "default"},
+		Spec: unumv1alpha1.UStoreSpec{
+			NumOfInstances: 1,
+			Volumes:        []unumv1alpha1.Persistence{{MountPath: "/mnt/ustore", Size: "1Gi"}},
+		},
+	}
+	s3 := unumv1alpha1.BackupDestination{S3: &unumv1alpha1.S3Destination{Bucket: "bucket", CredentialsSecretName: "s3"}}
+	pvc := unumv1alpha1.BackupDestination{PVC: &unumv1alpha1.PVCDestination{ClaimName: "backups"}}
+	backup := func(destination unumv1alpha1.BackupDestination) *unumv1alpha1.UStoreBackup {
+		return &unumv1alpha1.UStoreBackup{
+			ObjectMeta: metav1.ObjectMeta{Name: "backup", Namespace: "default"},
+			Spec:       unumv1alpha1.UStoreBackupSpec{UStoreName: "ustore", Destination: destination},
+		}
+	}
+	archived := func(destination unumv1alpha1.BackupDestination) *unumv1alpha1.UStoreBackup {
+		archivedBackup := backup(destination)
+		archivedBackup.Status.SourceSpec = ustoreResource.Spec.DeepCopy()
+		return archivedBackup
+	}
+	restore := &unumv1alpha1.UStoreRestore{ObjectMeta: metav1.ObjectMeta{Name: "restore", Namespace: "default"}}
+	images := Images{}.withDefaults()
+	tests := []struct {
+		name      string
+		job       *batchv1.Job
+		openShift bool
+		user      *int64
+	}{
+		{name: "backup to s3", job: backupJobForUStore(backup(s3), ustoreResource, images, false), user: int64Ptr(ustore_run_as_user)},
+		{name: "backup to a claim", job: backupJobForUStore(backup(pvc), ustoreResource, images, false), user: int64Ptr(ustore_run_as_user)},
+		{name: "restore from s3", job: restoreJobForUStore(restore, backup(s3), ustoreResource, images, false), user: int64Ptr(ustore_run_as_user)},
+		{name: "restore from a claim", job: restoreJobForUStore(restore, backup(pvc), ustoreResource, images, false), user: int64Ptr(ustore_run_as_user)},
+		{name: "delete from s3", job: archiveCleanupJobForBackup(archived(s3), images, false), user: int64Ptr(ustore_run_as_user)},
+		{name: "delete from a claim", job: archiveCleanupJobForBackup(archived(pvc), images, false), user: int64Ptr(ustore_run_as_user)},
+		{name: "openshift assigns the user", job: backupJobForUStore(backup(s3), ustoreResource, images, true), openShift: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			podSpec := test.job.Spec.Template.Spec
+			securityContext := podSpec.SecurityContext
+			if securityContext == nil || securityContext.RunAsNonRoot == nil || !*securityContext.RunAsNonRoot {
+				t.Fatalf("expected a non-root pod, got %+v", securityContext)
+			}
+			if securityContext.SeccompProfile == nil || securityContext.SeccompProfile.Type != corev1.SeccompProfileTypeRuntimeDefault {
+				t.Errorf("expected the RuntimeDefault seccomp profile, got %v", securityContext.SeccompProfile)
+			}
+			if !equality.Semantic.DeepEqual(securityContext.RunAsUser, test.user) || !equality.Semantic.DeepEqual(securityContext.FSGroup, test.user) {
+				t.Errorf("expected user and fsGroup %v, got %v and %v", test.user, securityContext.RunAsUser, securityContext.FSGroup)
+			}
+			tmpVolume := false
+			for _, volume := range podSpec.Volumes {
+				tmpVolume = tmpVolume || (volume.Name == ustore_tmp_volume_name && volume.EmptyDir != nil)
+			}
+			if !tmpVolume {
+				t.Errorf("expected a %s emptyDir, got %v", ustore_tmp_volume_name, podSpec.Volumes)
+			}
+
+			for _, container := range append(podSpec.InitContainers, podSpec.Containers...) {
+				if !equality.Semantic.DeepEqual(container.SecurityContext, restrictedContainerSecurityContext()) {
+					t.Errorf("expected container %s to be restricted, got %+v", container.Name, container.SecurityContext)
+				}
+				tmpMount := false
+				for _, volumeMount := range container.VolumeMounts {
+					tmpMount = tmpMount || (volumeMount.Name == ustore_tmp_volume_name && volumeMount.MountPath == "/tmp")
+				}
+				if !tmpMount {
+					t.Errorf("expected container %s to mount a writable /tmp, got %v", container.Name, container.VolumeMounts)
+				}
+				if container.Image != images.BackupS3 {
+					continue
+				}
+				home := ""
+				for _, env := range container.Env {
+					if env.Name == "HOME" {
+						home = env.Value
+					}
+				}
+				if home != "/tmp" {
+					t.Errorf("expected aws-cli container %s to have its HOME in /tmp, got %q", container.Name, home)
+				}
+			}
+		})
+	}
+}
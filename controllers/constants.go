@@ -1,11 +1,58 @@
 package controllers
 
+import "time"
+
 const (
-	ustore_ce_image          = "quay.io/gurgen_yegoryan/ustore:0.12.1"
-	ustore_ee_image          = "ghcr.io/gurgenyegoryan/udisk:0.1.0"
-	ustore_service_port_name = "db"
-	ustore_config_name       = "config"
-	ustore_container_name    = "ustore"
-	ustore_ee_pull_secret    = "ghcrio"
-	ustore_workdir           = "/var/lib/ustore"
+	ustore_ce_image             = "quay.io/gurgen_yegoryan/ustore:0.12.1"
+	ustore_ee_image             = "ghcr.io/gurgenyegoryan/udisk:0.1.0"
+	ustore_service_port_name    = "db"
+	ustore_service_app_protocol = "h2c"
+	ustore_config_name          = "config"
+	ustore_container_name       = "ustore"
+	ustore_ee_pull_secret       = "ghcrio"
+	ustore_workdir              = "/var/lib/ustore"
+	ustore_data_dir             = ustore_workdir + "/data"
+	ustore_config_key           = "config.json"
+
+	ustore_backup_image              = "docker.io/library/busybox:1.36"
+	ustore_backup_s3_image           = "docker.io/amazon/aws-cli:2.13.0"
+	ustore_backup_archive_container  = "archive"
+	ustore_backup_scratch            = "/work"
+	ustore_restored_from_annotation  = "unum.cloud/restored-from"
+	ustore_backup_schedule_label     = "unum.cloud/backup-schedule"
+	ustore_scheduled_at_annotation   = "unum.cloud/scheduled-at"
+	ustore_snapshot_label            = "unum.cloud/ustore-snapshot"
+	ustore_snapshot_pause_annotation = "unum.cloud/paused-by-snapshot"
+	ustore_backup_pause_annotation   = "unum.cloud/paused-by-backup"
+	ustore_retention_finalizer       = "unum.cloud/persistence-retention"
+	ustore_backup_archive_finalizer  = "unum.cloud/backup-archive"
+
+	ustore_upgrade_timeout = 10 * time.Minute
+	ustore_cpu_request     = "200m"
+	ustore_memory_request  = "100Mi"
+
+	// how long a backup waits for the UStore pods to stop
+	ustore_backup_quiesce_timeout = 5 * time.Minute
+
+	// startup probes allow 1 minute, 30 minutes for engines replaying a WAL
+	ustore_startup_failure_threshold            = 6
+	ustore_persistent_startup_failure_threshold = 180
+
+	// engine options derived by autoTuneMemory
+	ustore_rocksdb_write_buffer_number = 4
+	ustore_max_write_buffer_size       = 256 << 20
+	ustore_memory_per_open_file        = 1 << 20
+	ustore_min_open_files              = 256
+	ustore_max_open_files              = 65536
+
+	// non-root user of the UStore pods outside OpenShift
+	ustore_run_as_user         = 1000
+	ustore_tmp_volume_name     = "tmp"
+	ustore_workdir_volume_name = "workdir"
+
+	ustore_config_hash_annotation = "unum.cloud/config-hash"
+	ustore_configmap_index_field  = ".spec.dbConfigMapName"
+
+	// comma separated keys of the spec.service.annotations set on the Service
+	ustore_managed_annotations_annotation = "unum.cloud/managed-annotations"
 )
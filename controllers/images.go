@@ -0,0 +1,55 @@
+package controllers
+
+import "os"
+
+// Images holds the images the operator runs by default. UStores override the server image
+// with spec.image.
+type Images struct {
+	// UStore is the community edition server image, used by leveldb, rocksdb and ucset.
+	UStore string
+	// UDisk is the enterprise edition server image, used by udisk.
+	UDisk string
+	// UDiskPullSecret is the pull secret of the UDisk image, used when a udisk UStore sets no imagePullSecrets.
+	UDiskPullSecret string
+	// Backup archives and extracts backups.
+	Backup string
+	// BackupS3 uploads and downloads backups to S3 compatible storage.
+	BackupS3 string
+}
+
+// DefaultImages returns the built-in images, overridden by the RELATED_IMAGE_* environment
+// variables OLM sets for disconnected installs.
+func DefaultImages() Images {
+	return Images{
+		UStore:          envOrDefault("RELATED_IMAGE_USTORE", ustore_ce_image),
+		UDisk:           envOrDefault("RELATED_IMAGE_UDISK", ustore_ee_image),
+		UDiskPullSecret: ustore_ee_pull_secret,
+		Backup:          envOrDefault("RELATED_IMAGE_BACKUP", ustore_backup_image),
+		BackupS3:        envOrDefault("RELATED_IMAGE_BACKUP_S3", ustore_backup_s3_image),
+	}
+}
+
+// withDefaults fills the images left empty with the default ones.
+func (i Images) withDefaults() Images {
+	defaults := DefaultImages()
+	if i.UStore == "" {
+		i.UStore = defaults.UStore
+	}
+	if i.UDisk == "" {
+		i.UDisk = defaults.UDisk
+	}
+	if i.Backup == "" {
+		i.Backup = defaults.Backup
+	}
+	if i.BackupS3 == "" {
+		i.BackupS3 = defaults.BackupS3
+	}
+	return i
+}
+
+func envOrDefault(key string, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,293 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+	"github.com/opdev/ustore-operator/controllers/utils"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// dbConfigMapName returns the name of the config map mounted into the UStore pods,
+// either the user provided one or the one rendered from spec.engineConfig.
+func dbConfigMapName(ustoreResource *unumv1alpha1.UStore) string {
+	if ustoreResource.Spec.EngineConfig == nil {
+		return ustoreResource.Spec.DBConfigMapName
+	}
+	return ustoreResource.Name + "-config"
+}
+
+func (r *UStoreReconciler) reconcileConfigMap(ctx context.Context, ustoreResource *unumv1alpha1.UStore) error {
+	ustoreResource.Status.MemoryTuning = memoryTuningForUStore(ustoreResource)
+	if ustoreResource.Spec.EngineConfig == nil {
+		return nil
+	}
+	logger := log.FromContext(ctx)
+	desiredConfigMap, err := r.configMapForUStore(ustoreResource)
+	if err != nil {
+		logger.Error(err, "Failed to render UStore config")
+		return err
+	}
+
+	foundConfigMap := &corev1.ConfigMap{}
+	err = r.Get(ctx, types.NamespacedName{Name: desiredConfigMap.Name, Namespace: desiredConfigMap.Namespace}, foundConfigMap)
+	if err != nil && errors.IsNotFound(err) {
+		logger.Info("Creating a new ConfigMap", "ConfigMap.Namespace", desiredConfigMap.Namespace, "ConfigMap.Name", desiredConfigMap.Name)
+		if err := r.Create(ctx, desiredConfigMap); err != nil {
+			logger.Error(err, "Failed to create new ConfigMap", "ConfigMap.Namespace", desiredConfigMap.Namespace, "ConfigMap.Name", desiredConfigMap.Name)
+			return err
+		}
+		return nil
+	} else if err != nil {
+		logger.Error(err, "Failed to get ConfigMap")
+		return err
+	}
+
+	if !reflect.DeepEqual(foundConfigMap.Data, desiredConfigMap.Data) {
+		foundConfigMap.Data = desiredConfigMap.Data
+		if err := r.Update(ctx, foundConfigMap); err != nil {
+			logger.Error(err, "Failed to update UStore ConfigMap")
+			return err
+		}
+	}
+	return nil
+}
+
+// configMapForUStore returns the config map rendered from spec.engineConfig
+func (r *UStoreReconciler) configMapForUStore(ustoreResource *unumv1alpha1.UStore) (*corev1.ConfigMap, error) {
+	config, err := json.MarshalIndent(renderDBConfig(ustoreResource), "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: utils.SetObjectMeta(dbConfigMapName(ustoreResource), ustoreResource.Namespace, utils.LabelsForUStore(ustoreResource.Name)),
+		Data: map[string]string{
+			ustore_config_key: string(config),
+		},
+	}
+	// Set UStore instance as the owner and controller
+	if err := ctrl.SetControllerReference(ustoreResource, configMap, r.Scheme); err != nil {
+		return nil, err
+	}
+	return configMap, nil
+}
+
+// dataDirectory returns the directory the engine keeps its data in: the first volume
+// mount path, or the scratch data directory for engines without volumes.
+func dataDirectory(ustoreResource *unumv1alpha1.UStore) string {
+	if len(ustoreResource.Spec.Volumes) == 0 {
+		return ustore_data_dir + "/"
+	}
+	return path.Clean(ustoreResource.Spec.Volumes[0].MountPath) + "/"
+}
+
+// renderDBConfig returns the content of config.json for the UStore DB Type.
+func renderDBConfig(ustoreResource *unumv1alpha1.UStore) map[string]interface{} {
+	directory := dataDirectory(ustoreResource)
+	engineConfig := ustoreResource.Spec.EngineConfig
+	tuning := ustoreResource.Status.MemoryTuning
+	dataDirectories := []map[string]interface{}{}
+	var config map[string]interface{}
+
+	switch ustoreResource.Spec.DBType {
+	case "leveldb":
+		config = levelDBConfig(engineConfig.LevelDB, tuning)
+	case "rocksdb":
+		config = rocksDBConfig(engineConfig.RocksDB, tuning)
+	case "udisk":
+		config = uDiskConfig(engineConfig.UDisk)
+		if engineConfig.UDisk != nil {
+			for _, dataDirectory := range engineConfig.UDisk.DataDirectories {
+				entry := map[string]interface{}{"path": directory + dataDirectory.SubPath + "/"}
+				if dataDirectory.MaxSize != "" {
+					entry["max_size"] = dataDirectory.MaxSize
+				}
+				dataDirectories = append(dataDirectories, entry)
+			}
+		}
+	default:
+		config = map[string]interface{}{}
+	}
+
+	return map[string]interface{}{
+		"version":          "1.0",
+		"directory":        directory,
+		"data_directories": dataDirectories,
+		"engine": map[string]interface{}{
+			"config_url": "",
+			"config":     config,
+		},
+	}
+}
+
+// levelDBConfig returns the leveldb options: the defaults, overridden by the tuning derived
+// from the limits, if any, and then by the options set in the spec.
+func levelDBConfig(options *unumv1alpha1.LevelDBConfig, tuning *unumv1alpha1.MemoryTuningStatus) map[string]interface{} {
+	config := map[string]interface{}{
+		"write_buffer_size": 134217728,
+		"max_file_size":     134217728,
+		"max_open_files":    -1,
+		"cache_size":        200000,
+		"create_if_missing": true,
+		"error_if_exists":   false,
+		"paranoid_checks":   false,
+		"compression":       nil,
+	}
+	if tuning != nil {
+		config["write_buffer_size"] = tuning.WriteBufferSize
+		config["cache_size"] = tuning.BlockCacheSize
+		config["max_open_files"] = tuning.MaxOpenFiles
+	}
+	if options == nil {
+		return config
+	}
+	setIfNotNil(config, "write_buffer_size", options.WriteBufferSize)
+	setIfNotNil(config, "max_file_size", options.MaxFileSize)
+	setIfNotNil(config, "max_open_files", options.MaxOpenFiles)
+	setIfNotNil(config, "cache_size", options.CacheSize)
+	if options.Compression == "snappy" {
+		config["compression"] = "snappy"
+	}
+	return config
+}
+
+// rocksDBConfig returns the rocksdb options: the defaults, overridden by the tuning derived
+// from the limits, if any, and then by the options set in the spec.
+func rocksDBConfig(options *unumv1alpha1.RocksDBConfig, tuning *unumv1alpha1.MemoryTuningStatus) map[string]interface{} {
+	dbOptions := map[string]interface{}{
+		"create_if_missing":             true,
+		"writable_file_max_buffer_size": 134217728,
+		"max_open_files":                -1,
+		"max_file_opening_threads":      32,
+	}
+	cfOptions := map[string]interface{}{
+		"max_write_buffer_number":              4,
+		"write_buffer_size":                    134217728,
+		"target_file_size_base":                134217728,
+		"max_bytes_for_level_base":             2147483648,
+		"max_compaction_bytes":                 4294967296,
+		"level_compaction_dynamic_level_bytes": false,
+		"level0_stop_writes_trigger":           16,
+		"target_file_size_multiplier":          2,
+		"max_bytes_for_level_multiplier":       4,
+		"compression":                          "kNoCompression",
+		"compaction_style":                     "kCompactionStyleLevel",
+	}
+	config := map[string]interface{}{
+		"Version": map[string]interface{}{
+			"rocksdb_version":      "7.2.9",
+			"options_file_version": "1.1",
+		},
+		"DBOptions": dbOptions,
+		"CFOptions": cfOptions,
+	}
+	if tuning != nil {
+		dbOptions["max_open_files"] = tuning.MaxOpenFiles
+		dbOptions["max_background_jobs"] = tuning.BackgroundThreads
+		cfOptions["write_buffer_size"] = tuning.WriteBufferSize
+		cfOptions["max_write_buffer_number"] = tuning.MaxWriteBufferNumber
+		config["TableOptions/BlockBasedTable"] = map[string]interface{}{
+			"block_cache": tuning.BlockCacheSize,
+		}
+	}
+	if options != nil {
+		setIfNotNil(dbOptions, "max_open_files", options.MaxOpenFiles)
+		setIfNotNil(cfOptions, "write_buffer_size", options.WriteBufferSize)
+		setIfNotNil(cfOptions, "max_write_buffer_number", options.MaxWriteBufferNumber)
+		setIfNotNil(cfOptions, "target_file_size_base", options.TargetFileSizeBase)
+		setIfNotNil(cfOptions, "max_bytes_for_level_base", options.MaxBytesForLevelBase)
+		if options.Compression != "" {
+			cfOptions["compression"] = options.Compression
+		}
+	}
+	return config
+}
+
+func uDiskConfig(options *unumv1alpha1.UDiskConfig) map[string]interface{} {
+	config := map[string]interface{}{
+		"version":                   "1.0",
+		"memory_limit":              "3GB",
+		"threads":                   1,
+		"gpu_memory_limit":          "10GB",
+		"gpu_devices":               []int{-1},
+		"log_file_name":             "udb.log",
+		"io_mechanism":              "pulling",
+		"io_queue_depth":            4096,
+		"transaction_max_elements":  10,
+		"transaction_max_bytes":     "40KB",
+		"concurrency_limit":         1,
+		"cache_limit":               "100MB",
+		"write_buffer_max_elements": 1000,
+		"write_buffer_max_bytes":    "10MB",
+		"first_level_max_bytes":     "4GB",
+		"level_enlarge_factor":      4,
+		"value_size":                "0B",
+		"value_max_size":            "4KB",
+	}
+	if options == nil {
+		return config
+	}
+	setIfNotEmpty(config, "memory_limit", options.MemoryLimit)
+	setIfNotEmpty(config, "cache_limit", options.CacheLimit)
+	setIfNotEmpty(config, "write_buffer_max_bytes", options.WriteBufferMaxBytes)
+	setIfNotNil(config, "threads", options.Threads)
+	setIfNotNil(config, "io_queue_depth", options.IOQueueDepth)
+	return config
+}
+
+func setIfNotNil[T int32 | int64](config map[string]interface{}, key string, value *T) {
+	if value != nil {
+		config[key] = *value
+	}
+}
+
+func setIfNotEmpty(config map[string]interface{}, key string, value string) {
+	if value != "" {
+		config[key] = value
+	}
+}
+
+// configMapHash returns a hash of the DB config map content, or an empty string if the
+// config map does not exist yet.
+func (r *UStoreReconciler) configMapHash(ctx context.Context, ustoreResource *unumv1alpha1.UStore) (string, error) {
+	configMap := &corev1.ConfigMap{}
+	err := r.Get(ctx, types.NamespacedName{Name: dbConfigMapName(ustoreResource), Namespace: ustoreResource.Namespace}, configMap)
+	if err != nil && errors.IsNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to get ConfigMap")
+		return "", err
+	}
+
+	hash := sha256.New()
+	keys := []string{}
+	for key := range configMap.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(hash, "%s=%s\n", key, configMap.Data[key])
+	}
+	keys = []string{}
+	for key := range configMap.BinaryData {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(hash, "%s=", key)
+		hash.Write(configMap.BinaryData[key])
+		fmt.Fprintln(hash)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
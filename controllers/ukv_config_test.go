@@ -0,0 +1,143 @@
+package controllers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+)
+
+// configValue returns the value at the dot separated key path of a rendered config.
+func configValue(config map[string]interface{}, keyPath string) interface{} {
+	var value interface{} = config
+	for _, key := range strings.Split(keyPath, ".") {
+		section, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = section[key]
+	}
+	return value
+}
+
+func int64Ptr(value int64) *int64 {
+	return &value
+}
+
+func TestRenderDBConfig(t *testing.T) {
+	tuning := &unumv1alpha1.MemoryTuningStatus{
+		MemoryLimit:          "4Gi",
+		BlockCacheSize:       1717986918,
+		WriteBufferSize:      268435456,
+		MaxWriteBufferNumber: 4,
+		MaxOpenFiles:         4096,
+		BackgroundThreads:    2,
+	}
+	tests := []struct {
+		name     string
+		spec     unumv1alpha1.UStoreSpec
+		tuning   *unumv1alpha1.MemoryTuningStatus
+		expected map[string]interface{}
+	}{
+		{
+			name: "leveldb defaults on scratch storage",
+			spec: unumv1alpha1.UStoreSpec{DBType: "leveldb", EngineConfig: &unumv1alpha1.EngineConfig{}},
+			expected: map[string]interface{}{
+				"version":                         "1.0",
+				"directory":                       ustore_data_dir + "/",
+				"data_directories":                []map[string]interface{}{},
+				"engine.config.write_buffer_size": 134217728,
+				"engine.config.max_open_files":    -1,
+				"engine.config.compression":       nil,
+				"engine.config_url":               "",
+			},
+		},
+		{
+			name: "leveldb options override the tuning",
+			spec: unumv1alpha1.UStoreSpec{
+				DBType:  "leveldb",
+				Volumes: []unumv1alpha1.Persistence{{MountPath: "/mnt/ustore/", Size: "1Gi"}},
+				EngineConfig: &unumv1alpha1.EngineConfig{LevelDB: &unumv1alpha1.LevelDBConfig{
+					WriteBufferSize: int64Ptr(1048576),
+					Compression:     "snappy",
+				}},
+			},
+			tuning: tuning,
+			expected: map[string]interface{}{
+				"directory":                       "/mnt/ustore/",
+				"engine.config.write_buffer_size": int64(1048576),
+				"engine.config.cache_size":        tuning.BlockCacheSize,
+				"engine.config.max_open_files":    tuning.MaxOpenFiles,
+				"engine.config.compression":       "snappy",
+			},
+		},
+		{
+			name:   "rocksdb tuning",
+			spec:   unumv1alpha1.UStoreSpec{DBType: "rocksdb", EngineConfig: &unumv1alpha1.EngineConfig{}},
+			tuning: tuning,
+			expected: map[string]interface{}{
+				"engine.config.DBOptions.max_open_files":                 tuning.MaxOpenFiles,
+				"engine.config.DBOptions.max_background_jobs":            tuning.BackgroundThreads,
+				"engine.config.CFOptions.write_buffer_size":              tuning.WriteBufferSize,
+				"engine.config.CFOptions.max_write_buffer_number":        tuning.MaxWriteBufferNumber,
+				"engine.config.TableOptions/BlockBasedTable.block_cache": tuning.BlockCacheSize,
+				"engine.config.CFOptions.compression":                    "kNoCompression",
+			},
+		},
+		{
+			name: "rocksdb options override the tuning",
+			spec: unumv1alpha1.UStoreSpec{
+				DBType: "rocksdb",
+				EngineConfig: &unumv1alpha1.EngineConfig{RocksDB: &unumv1alpha1.RocksDBConfig{
+					MaxWriteBufferNumber: int32Ptr(8),
+					Compression:          "kLZ4Compression",
+				}},
+			},
+			tuning: tuning,
+			expected: map[string]interface{}{
+				"engine.config.CFOptions.write_buffer_size":       tuning.WriteBufferSize,
+				"engine.config.CFOptions.max_write_buffer_number": int32(8),
+				"engine.config.CFOptions.compression":             "kLZ4Compression",
+			},
+		},
+		{
+			name: "udisk data directories",
+			spec: unumv1alpha1.UStoreSpec{
+				DBType:  "udisk",
+				Volumes: []unumv1alpha1.Persistence{{MountPath: "/mnt/ustore", Size: "1Gi"}},
+				EngineConfig: &unumv1alpha1.EngineConfig{UDisk: &unumv1alpha1.UDiskConfig{
+					MemoryLimit: "1GB",
+					DataDirectories: []unumv1alpha1.DataDirectory{
+						{SubPath: "a", MaxSize: "5GB"},
+						{SubPath: "b"},
+					},
+				}},
+			},
+			expected: map[string]interface{}{
+				"directory": "/mnt/ustore/",
+				"data_directories": []map[string]interface{}{
+					{"path": "/mnt/ustore/a/", "max_size": "5GB"},
+					{"path": "/mnt/ustore/b/"},
+				},
+				"engine.config.memory_limit": "1GB",
+				"engine.config.cache_limit":  "100MB",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ustoreResource := &unumv1alpha1.UStore{
+				Spec:   test.spec,
+				Status: unumv1alpha1.UStoreStatus{MemoryTuning: test.tuning},
+			}
+			config := renderDBConfig(ustoreResource)
+			for keyPath, expected := range test.expected {
+				if value := configValue(config, keyPath); !reflect.DeepEqual(value, expected) {
+					t.Errorf("%s: expected %#v, got %#v", keyPath, expected, value)
+				}
+			}
+		})
+	}
+}
@@ -20,20 +20,35 @@ import (
 	"context"
 
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
 )
 
 // UStoreReconciler reconciles a UStore object
 type UStoreReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+	// MaxConcurrentReconciles is the number of UStores reconciled in parallel, 1 when unset.
+	MaxConcurrentReconciles int
+	// Images run by UStores without spec.image, the default ones when unset.
+	Images Images
+
+	// openShift is set when the cluster serves SecurityContextConstraints, which assign the pod users.
+	openShift bool
+	// exposeAPIs holds the kinds of route, see exposeKinds, the cluster serves.
+	exposeAPIs map[string]bool
 }
 
 //+kubebuilder:rbac:groups=unum.cloud,resources=ustores,verbs=get;list;watch;create;update;patch;delete
@@ -41,7 +56,14 @@ type UStoreReconciler struct {
 //+kubebuilder:rbac:groups=unum.cloud,resources=ustores/finalizers,verbs=update
 //+kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=route.openshift.io,resources=routes,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=route.openshift.io,resources=routes/custom-host,verbs=create
+//+kubebuilder:rbac:groups=gateway.networking.k8s.io,resources=grpcroutes;tlsroutes,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=storage.k8s.io,resources=storageclasses,verbs=get;list;watch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -70,26 +92,127 @@ func (r *UStoreReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 		return ctrl.Result{}, err
 	}
 
-	if err := r.reconcileVolumesForUStore(ctx, &ustoreResource); err != nil {
-		return ctrl.Result{}, err
+	if !ustoreResource.DeletionTimestamp.IsZero() {
+		return r.finalizeUStore(ctx, &ustoreResource)
 	}
-
-	if err := r.reconcileDeployment(ctx, &ustoreResource); err != nil {
+	if err := r.reconcileRetentionFinalizer(ctx, &ustoreResource); err != nil {
 		return ctrl.Result{}, err
 	}
-	if err := r.reconcileService(ctx, &ustoreResource); err != nil {
+
+	result, reconcileErr := r.reconcileResources(ctx, &ustoreResource)
+	if err := r.updateStatus(ctx, &ustoreResource, reconcileErr); err != nil {
 		return ctrl.Result{}, err
 	}
 
-	return ctrl.Result{}, nil
+	return result, reconcileErr
+}
+
+// reconcileResources creates or updates all resources owned by the UStore.
+func (r *UStoreReconciler) reconcileResources(ctx context.Context, ustoreResource *unumv1alpha1.UStore) (ctrl.Result, error) {
+	result := ctrl.Result{}
+	if err := r.releaseSnapshotPause(ctx, ustoreResource); err != nil {
+		return result, err
+	}
+	if err := r.releaseBackupPause(ctx, ustoreResource); err != nil {
+		return result, err
+	}
+	upgradeTimeout, err := r.reconcileUpgrade(ctx, ustoreResource)
+	if err != nil {
+		return result, err
+	}
+	// check the rollout again when the upgrade times out
+	result.RequeueAfter = upgradeTimeout
+	if err := r.reconcileConfigMap(ctx, ustoreResource); err != nil {
+		return result, err
+	}
+	configHash, err := r.configMapHash(ctx, ustoreResource)
+	if err != nil {
+		return result, err
+	}
+	if isStatefulSet(ustoreResource) {
+		// volumes are provisioned per replica from the StatefulSet claim templates
+		if err := r.reconcileHeadlessService(ctx, ustoreResource); err != nil {
+			return result, err
+		}
+		if err := r.reconcileStatefulSet(ctx, ustoreResource, configHash); err != nil {
+			return result, err
+		}
+		if err := r.releaseRemovedClaims(ctx, ustoreResource); err != nil {
+			return result, err
+		}
+	} else {
+		if err := r.reconcileVolumesForUStore(ctx, ustoreResource); err != nil {
+			return result, err
+		}
+		if err := r.reconcileDeployment(ctx, ustoreResource, configHash); err != nil {
+			return result, err
+		}
+	}
+	if err := r.reconcileExistingClaims(ctx, ustoreResource); err != nil {
+		return result, err
+	}
+	if err := r.reconcileService(ctx, ustoreResource); err != nil {
+		return result, err
+	}
+	if err := r.reconcileExpose(ctx, ustoreResource); err != nil {
+		return result, err
+	}
+	if err := r.reconcileDisruptionBudget(ctx, ustoreResource); err != nil {
+		return result, err
+	}
+	ustoreResource.Status.ConfigHash = configHash
+	return result, nil
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *UStoreReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &unumv1alpha1.UStore{}, ustore_configmap_index_field, func(obj client.Object) []string {
+		return []string{dbConfigMapName(obj.(*unumv1alpha1.UStore))}
+	}); err != nil {
+		return err
+	}
+
+	r.Images = r.Images.withDefaults()
+	r.openShift = servesSecurityContextConstraints(mgr)
+
+	builder := ctrl.NewControllerManagedBy(mgr).
 		For(&unumv1alpha1.UStore{}).
 		Owns(&appsv1.Deployment{}).
+		Owns(&appsv1.StatefulSet{}).
 		Owns(&corev1.Service{}).
 		Owns(&corev1.PersistentVolumeClaim{}).
-		Complete(r)
+		Owns(&policyv1.PodDisruptionBudget{}).
+		Owns(&unumv1alpha1.UStoreBackup{}).
+		// covers both rendered and user provided config maps
+		Watches(&corev1.ConfigMap{}, handler.EnqueueRequestsFromMapFunc(r.findUStoresForConfigMap)).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles})
+
+	// the route APIs are optional, only watch the ones the cluster serves
+	r.exposeAPIs = map[string]bool{}
+	for kind, gvk := range exposeKinds {
+		if _, err := mgr.GetRESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version); err == nil {
+			r.exposeAPIs[kind] = true
+			route := &unstructured.Unstructured{}
+			route.SetGroupVersionKind(gvk)
+			builder = builder.Owns(route)
+		}
+	}
+	return builder.Complete(r)
+}
+
+// findUStoresForConfigMap returns a reconcile request for every UStore using the given config map.
+func (r *UStoreReconciler) findUStoresForConfigMap(ctx context.Context, configMap client.Object) []reconcile.Request {
+	ustoreList := &unumv1alpha1.UStoreList{}
+	if err := r.List(ctx, ustoreList, client.InNamespace(configMap.GetNamespace()), client.MatchingFields{ustore_configmap_index_field: configMap.GetName()}); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list UStores for ConfigMap", "ConfigMap.Name", configMap.GetName())
+		return nil
+	}
+
+	requests := []reconcile.Request{}
+	for _, ustore := range ustoreList.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Name: ustore.Name, Namespace: ustore.Namespace},
+		})
+	}
+	return requests
 }
@@ -19,10 +19,10 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
-func (r *UStoreReconciler) reconcileDeployment(ctx context.Context, ustoreResource *unumv1alpha1.UStore) error {
+func (r *UStoreReconciler) reconcileDeployment(ctx context.Context, ustoreResource *unumv1alpha1.UStore, configHash string) error {
 	logger := log.FromContext(ctx)
 	found := &appsv1.Deployment{}
-	desiredDeployment := r.deploymentForUStore(ustoreResource)
+	desiredDeployment := r.deploymentForUStore(ustoreResource, configHash)
 	err := r.Get(ctx, types.NamespacedName{Name: ustoreResource.Name, Namespace: ustoreResource.Namespace}, found)
 	if err != nil && errors.IsNotFound(err) {
 		// A new deployment needs to be created
@@ -30,19 +30,13 @@ func (r *UStoreReconciler) reconcileDeployment(ctx context.Context, ustoreResour
 		err = r.Create(ctx, desiredDeployment)
 		if err != nil {
 			logger.Error(err, "Failed to create new Deployment", "Deployment.Namespace", desiredDeployment.Namespace, "Deployment.Name", desiredDeployment.Name)
-			ustoreResource.Status.DeploymentStatus = "Failed Creation"
-			_ = r.Status().Update(ctx, ustoreResource)
 			return err
 		}
-		// update status for deployment
 		ustoreResource.Status.DeploymentName = desiredDeployment.Name
-		ustoreResource.Status.DeploymentStatus = "Successful"
-		err := r.Status().Update(ctx, ustoreResource)
-		if err != nil {
-			logger.Error(err, "Failed to update UStore Deployment status")
-			return err
-		}
 		return nil
+	} else if err != nil {
+		logger.Error(err, "Failed to get Deployment")
+		return err
 	}
 
 	// patch only if there is a difference between desired and current.
@@ -51,44 +45,65 @@ func (r *UStoreReconciler) reconcileDeployment(ctx context.Context, ustoreResour
 		logger.Error(err, "Error in merge")
 		return err
 	}
+	// mergo does not override with zero values, scaling to zero needs an explicit assignment.
+	found.Spec.Replicas = desiredDeployment.Spec.Replicas
+	// nor does it remove fields, the pod template is owned by the operator and replaced as a whole
+	// so cleared tolerations, affinity or volumes are dropped.
+	found.Spec.Template = desiredDeployment.Spec.Template
 
 	if err := r.Patch(ctx, found, patchDiff); err != nil {
 		logger.Error(err, "Failed to update Deployment to desired state", "Deployment.Namespace", found.Namespace, "Deployment.Name", found.Name)
 		return err
 	}
 
-	// update status for deployment
 	ustoreResource.Status.DeploymentName = desiredDeployment.Name
-	ustoreResource.Status.DeploymentStatus = "Successful"
-	err = r.Status().Update(ctx, ustoreResource)
-	if err != nil {
-		logger.Error(err, "Failed to update UStore Deployment status")
-		return err
-	}
-
 	return nil
 }
 
 // deploymentForUStore returns a UStore Deployment object
-func (r *UStoreReconciler) deploymentForUStore(ustoreResource *unumv1alpha1.UStore) *appsv1.Deployment {
+func (r *UStoreReconciler) deploymentForUStore(ustoreResource *unumv1alpha1.UStore, configHash string) *appsv1.Deployment {
 	labels := utils.LabelsForUStore(ustoreResource.Name)
-	replicas := ustoreResource.Spec.NumOfInstances
-	resourceRequests := corev1.ResourceList{
-		corev1.ResourceCPU:    resource.MustParse("200m"),
-		corev1.ResourceMemory: resource.MustParse("100Mi"),
+	replicas := desiredReplicas(ustoreResource)
+
+	deploymentSpec := appsv1.DeploymentSpec{
+		Replicas: &replicas,
+		Selector: &metav1.LabelSelector{
+			MatchLabels: labels,
+		},
+		Template: r.podTemplateForUStore(ustoreResource, configHash),
 	}
-	resourceLimits := corev1.ResourceList{
-		corev1.ResourceCPU:    resource.MustParse(ustoreResource.Spec.ConcurrencyLimit),
-		corev1.ResourceMemory: resource.MustParse(ustoreResource.Spec.MemoryLimit),
+
+	deployment := &appsv1.Deployment{
+		ObjectMeta: utils.SetObjectMeta(ustoreResource.Name, ustoreResource.Namespace, map[string]string{}),
+		Spec:       deploymentSpec,
 	}
 
+	// Set UStore instance as the owner and controller
+	ctrl.SetControllerReference(ustoreResource, deployment, r.Scheme)
+	return deployment
+}
+
+// desiredReplicas returns the number of UStore pods, zero while a UStoreSnapshot or a UStoreBackup
+// has scaled it down.
+func desiredReplicas(ustoreResource *unumv1alpha1.UStore) int32 {
+	if ustoreResource.Annotations[ustore_snapshot_pause_annotation] != "" || ustoreResource.Annotations[ustore_backup_pause_annotation] != "" {
+		return 0
+	}
+	return ustoreResource.Spec.NumOfInstances
+}
+
+// podTemplateForUStore returns the pod template shared by the UStore Deployment and StatefulSet.
+// configHash is stamped on the pods so a config map change rolls them.
+func (r *UStoreReconciler) podTemplateForUStore(ustoreResource *unumv1alpha1.UStore, configHash string) corev1.PodTemplateSpec {
+	labels := utils.LabelsForUStore(ustoreResource.Name)
+
 	volumes := []corev1.Volume{
 		{
 			Name: ustore_config_name,
 			VolumeSource: corev1.VolumeSource{
 				ConfigMap: &corev1.ConfigMapVolumeSource{
 					LocalObjectReference: corev1.LocalObjectReference{
-						Name: ustoreResource.Spec.DBConfigMapName,
+						Name: dbConfigMapName(ustoreResource),
 					},
 				},
 			},
@@ -102,28 +117,41 @@ func (r *UStoreReconciler) deploymentForUStore(ustoreResource *unumv1alpha1.USto
 		},
 	}
 
-	volumes, volumeMounts = r.addVolumesIfNeeded(ustoreResource, volumes, volumeMounts)
+	volumeDevices := []corev1.VolumeDevice{}
+	if isStatefulSet(ustoreResource) {
+		volumeMounts, volumeDevices = addClaimTemplateMounts(ustoreResource, volumeMounts, volumeDevices)
+	} else {
+		volumes, volumeMounts, volumeDevices = r.addVolumesIfNeeded(ustoreResource, volumes, volumeMounts, volumeDevices)
+	}
+	volumes, volumeMounts = addScratchVolumes(ustoreResource, volumes, volumeMounts)
 
 	containers := []corev1.Container{
 		{
-			Image:   getUStoreImage(ustoreResource),
-			Name:    ustore_container_name,
-			Command: []string{fmt.Sprintf("./%s_server", ustoreResource.Spec.DBType)},
+			Image:           r.ustoreImage(ustoreResource),
+			ImagePullPolicy: ustoreResource.Spec.ImagePullPolicy,
+			Name:            ustore_container_name,
+			Command:         []string{fmt.Sprintf("./%s_server", ustoreResource.Spec.DBType)},
 			Args: []string{
 				"--config",
 				"$(DBCONFIG)",
 				"--port",
 				"$(DBPORT)",
 			},
-			VolumeMounts: volumeMounts,
-			Resources: corev1.ResourceRequirements{
-				Limits:   resourceLimits,
-				Requests: resourceRequests,
+			Ports: []corev1.ContainerPort{
+				{
+					Name:          ustore_service_port_name,
+					ContainerPort: int32(ustoreResource.Spec.DBServicePort),
+					Protocol:      corev1.ProtocolTCP,
+				},
 			},
+			VolumeMounts:    volumeMounts,
+			VolumeDevices:   volumeDevices,
+			SecurityContext: containerSecurityContextForUStore(ustoreResource),
+			Resources:       resourcesForUStore(ustoreResource),
 			Env: []corev1.EnvVar{
 				{
 					Name:  "DBCONFIG",
-					Value: fmt.Sprintf("%s/%s/config.json", ustore_workdir, ustoreResource.Spec.DBType),
+					Value: fmt.Sprintf("%s/%s/%s", ustore_workdir, ustoreResource.Spec.DBType, ustore_config_key),
 				},
 				{
 					Name:  "DBPORT",
@@ -133,78 +161,102 @@ func (r *UStoreReconciler) deploymentForUStore(ustoreResource *unumv1alpha1.USto
 		},
 	}
 
+	addProbesIfNeeded(ustoreResource, &containers[0])
+
 	podTemplate := corev1.PodTemplateSpec{
 		ObjectMeta: metav1.ObjectMeta{
 			Labels: labels,
+			Annotations: map[string]string{
+				ustore_config_hash_annotation: configHash,
+			},
 		},
 		Spec: corev1.PodSpec{
-			Containers: containers,
-			Volumes:    volumes,
+			Containers:        containers,
+			Volumes:           volumes,
+			NodeSelector:      ustoreResource.Spec.NodeSelector,
+			Tolerations:       ustoreResource.Spec.Tolerations,
+			PriorityClassName: ustoreResource.Spec.PriorityClassName,
+			SecurityContext:   podSecurityContextForUStore(ustoreResource, r.openShift),
 		},
 	}
 
-	deploymentSpec := appsv1.DeploymentSpec{
-		Replicas: &replicas,
-		Selector: &metav1.LabelSelector{
-			MatchLabels: labels,
-		},
-		Template: podTemplate,
-	}
-
-	deployment := &appsv1.Deployment{
-		ObjectMeta: utils.SetObjectMeta(ustoreResource.Name, ustoreResource.Namespace, map[string]string{}),
-		Spec:       deploymentSpec,
+	if affinity := r.addAffinityIfNeeded(ustoreResource); affinity != nil {
+		podTemplate.Spec.Affinity = affinity
 	}
 
-	if affinity := r.addAffinityIfNeeded(ustoreResource); affinity != nil {
-		deployment.Spec.Template.Spec.Affinity = affinity
+	if constraints := topologySpreadConstraintsForUStore(ustoreResource); len(constraints) > 0 {
+		podTemplate.Spec.TopologySpreadConstraints = constraints
 	}
 
 	if pullSecrets := r.addPullSecretRefsIfNeeded(ustoreResource); pullSecrets != nil {
-		deployment.Spec.Template.Spec.ImagePullSecrets = pullSecrets
+		podTemplate.Spec.ImagePullSecrets = pullSecrets
 	}
 
-	// Set UStore instance as the owner and controller
-	ctrl.SetControllerReference(ustoreResource, deployment, r.Scheme)
-	return deployment
+	return podTemplate
 }
 
-func (r *UStoreReconciler) addVolumesIfNeeded(ustoreResource *unumv1alpha1.UStore, volumes []corev1.Volume, volumeMounts []corev1.VolumeMount) ([]corev1.Volume, []corev1.VolumeMount) {
-	for _, volumeMount := range r.getVolumeList() {
-		if volumeMount.Owner != ustoreResource.Name {
-			continue
-		}
-		containerMount := corev1.VolumeMount{
-			Name:      volumeMount.Name,
-			MountPath: volumeMount.MountPath,
+// addVolumesIfNeeded mounts the claim of every volume in spec.volumes, as a device for Block volumes.
+func (r *UStoreReconciler) addVolumesIfNeeded(ustoreResource *unumv1alpha1.UStore, volumes []corev1.Volume, volumeMounts []corev1.VolumeMount, volumeDevices []corev1.VolumeDevice) ([]corev1.Volume, []corev1.VolumeMount, []corev1.VolumeDevice) {
+	for _, volume := range ustoreResource.Spec.Volumes {
+		claimName := claimNameForVolume(ustoreResource, volume)
+		if isBlockVolume(volume) {
+			volumeDevices = append(volumeDevices, corev1.VolumeDevice{
+				Name:       claimName,
+				DevicePath: volume.MountPath,
+			})
+		} else {
+			volumeMounts = append(volumeMounts, corev1.VolumeMount{
+				Name:      claimName,
+				MountPath: volume.MountPath,
+			})
 		}
-		volume := corev1.Volume{
-			Name: volumeMount.Name,
+		volumes = append(volumes, corev1.Volume{
+			Name: claimName,
 			VolumeSource: corev1.VolumeSource{
 				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
-					ClaimName: volumeMount.ClaimName,
+					ClaimName: claimName,
 				},
 			},
-		}
-
-		volumeMounts = append(volumeMounts, containerMount)
-		volumes = append(volumes, volume)
+		})
 	}
 
-	return volumes, volumeMounts
+	return volumes, volumeMounts, volumeDevices
 }
 
 func (r *UStoreReconciler) addAffinityIfNeeded(ustoreResource *unumv1alpha1.UStore) *corev1.Affinity {
+	nodeAffinity := nodeAffinityForUStore(ustoreResource)
+	podAntiAffinity := podAntiAffinityForUStore(ustoreResource)
+	if nodeAffinity == nil && podAntiAffinity == nil {
+		return nil
+	}
+	return &corev1.Affinity{
+		NodeAffinity:    nodeAffinity,
+		PodAntiAffinity: podAntiAffinity,
+	}
+}
+
+// nodeAffinityForUStore turns spec.nodeAffinityLabels into preferred terms, and the required
+// labels into a single required term all of them must match.
+func nodeAffinityForUStore(ustoreResource *unumv1alpha1.UStore) *corev1.NodeAffinity {
 	if len(ustoreResource.Spec.NodeAffinityLabels) <= 0 {
 		return nil
 	}
 	preferredSchedulingTerms := []corev1.PreferredSchedulingTerm{}
+	requiredExpressions := []corev1.NodeSelectorRequirement{}
 
 	for _, labelKeyValue := range ustoreResource.Spec.NodeAffinityLabels {
+		operator := labelKeyValue.Operator
+		if operator == "" {
+			operator = corev1.NodeSelectorOpIn
+		}
 		matchExpression := corev1.NodeSelectorRequirement{
 			Key:      labelKeyValue.Label,
-			Operator: corev1.NodeSelectorOpIn,
-			Values:   []string{labelKeyValue.Value},
+			Operator: operator,
+			Values:   unumv1alpha1.NodeAffinityValues(labelKeyValue),
+		}
+		if labelKeyValue.Required {
+			requiredExpressions = append(requiredExpressions, matchExpression)
+			continue
 		}
 		term := corev1.PreferredSchedulingTerm{
 			Weight: labelKeyValue.Weight,
@@ -215,22 +267,73 @@ func (r *UStoreReconciler) addAffinityIfNeeded(ustoreResource *unumv1alpha1.USto
 		preferredSchedulingTerms = append(preferredSchedulingTerms, term)
 	}
 
-	return &corev1.Affinity{
-		NodeAffinity: &corev1.NodeAffinity{
-			PreferredDuringSchedulingIgnoredDuringExecution: preferredSchedulingTerms,
-		},
+	nodeAffinity := &corev1.NodeAffinity{}
+	if len(preferredSchedulingTerms) > 0 {
+		nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution = preferredSchedulingTerms
+	}
+	if len(requiredExpressions) > 0 {
+		nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{{MatchExpressions: requiredExpressions}},
+		}
+	}
+	return nodeAffinity
+}
+
+// podAntiAffinityForUStore keeps the replicas of the UStore apart, in different topology domains.
+func podAntiAffinityForUStore(ustoreResource *unumv1alpha1.UStore) *corev1.PodAntiAffinity {
+	spec := ustoreResource.Spec.PodAntiAffinity
+	if spec == nil {
+		return nil
+	}
+	topologyKey := spec.TopologyKey
+	if topologyKey == "" {
+		topologyKey = corev1.LabelHostname
+	}
+	term := corev1.PodAffinityTerm{
+		LabelSelector: &metav1.LabelSelector{MatchLabels: utils.LabelsForUStore(ustoreResource.Name)},
+		TopologyKey:   topologyKey,
 	}
+	if spec.Type == unumv1alpha1.PodAntiAffinityRequired {
+		return &corev1.PodAntiAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{term},
+		}
+	}
+	return &corev1.PodAntiAffinity{
+		PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{{
+			Weight:          100,
+			PodAffinityTerm: term,
+		}},
+	}
+}
+
+// topologySpreadConstraintsForUStore returns spec.topologySpreadConstraints, selecting the pods
+// of the UStore where no label selector is given.
+func topologySpreadConstraintsForUStore(ustoreResource *unumv1alpha1.UStore) []corev1.TopologySpreadConstraint {
+	constraints := []corev1.TopologySpreadConstraint{}
+	for _, constraint := range ustoreResource.Spec.TopologySpreadConstraints {
+		constraint := *constraint.DeepCopy()
+		if constraint.LabelSelector == nil {
+			constraint.LabelSelector = &metav1.LabelSelector{MatchLabels: utils.LabelsForUStore(ustoreResource.Name)}
+		}
+		constraints = append(constraints, constraint)
+	}
+	return constraints
 }
 
+// addPullSecretRefsIfNeeded returns spec.imagePullSecrets, or the operator pull secret of the
+// udisk image for a udisk UStore without any.
 func (r *UStoreReconciler) addPullSecretRefsIfNeeded(ustoreResource *unumv1alpha1.UStore) []corev1.LocalObjectReference {
-	if ustoreResource.Spec.DBType != "udisk" {
+	if len(ustoreResource.Spec.ImagePullSecrets) > 0 {
+		return ustoreResource.Spec.ImagePullSecrets
+	}
+	if ustoreResource.Spec.DBType != "udisk" || ustoreResource.Spec.Image != "" || r.Images.UDiskPullSecret == "" {
 		return nil
 	}
 
 	pullSecrets := []corev1.LocalObjectReference{}
 
 	ee_pull_secret := corev1.LocalObjectReference{
-		Name: ustore_ee_pull_secret,
+		Name: r.Images.UDiskPullSecret,
 	}
 
 	pullSecrets = append(pullSecrets, ee_pull_secret)
@@ -238,9 +341,60 @@ func (r *UStoreReconciler) addPullSecretRefsIfNeeded(ustoreResource *unumv1alpha
 	return pullSecrets
 }
 
-func getUStoreImage(ustoreResource *unumv1alpha1.UStore) string {
-	if ustoreResource.Spec.DBType == "udisk" {
-		return ustore_ee_image
+// ustoreImage returns spec.image, or the operator image of the DB Type, tagged with the
+// running version when spec.version is set.
+func (r *UStoreReconciler) ustoreImage(ustoreResource *unumv1alpha1.UStore) string {
+	image := r.Images.UStore
+	if ustoreResource.Spec.Image != "" {
+		image = ustoreResource.Spec.Image
+	} else if ustoreResource.Spec.DBType == "udisk" {
+		image = r.Images.UDisk
+	}
+	if version := runningVersion(ustoreResource); version != "" {
+		return imageWithTag(image, version)
+	}
+	return image
+}
+
+// resourcesForUStore returns the resources of the UStore container: the memoryLimit and concurrencyLimit
+// overridden by spec.resources, with default CPU and memory requests capped by the limits.
+// With guaranteedQoS the requests equal the limits.
+func resourcesForUStore(ustoreResource *unumv1alpha1.UStore) corev1.ResourceRequirements {
+	limits := parseResourceList(map[corev1.ResourceName]string{
+		corev1.ResourceCPU:    ustoreResource.Spec.ConcurrencyLimit,
+		corev1.ResourceMemory: ustoreResource.Spec.MemoryLimit,
+	})
+	requests := corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse(ustore_cpu_request),
+		corev1.ResourceMemory: resource.MustParse(ustore_memory_request),
+	}
+	if spec := ustoreResource.Spec.Resources; spec != nil {
+		for name, quantity := range spec.Limits {
+			limits[name] = quantity
+		}
+		for name, quantity := range spec.Requests {
+			requests[name] = quantity
+		}
+	}
+
+	if ustoreResource.Spec.GuaranteedQoS {
+		return corev1.ResourceRequirements{Limits: limits, Requests: limits.DeepCopy()}
+	}
+	for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+		if request, limit := requests[name], limits[name]; !limit.IsZero() && request.Cmp(limit) > 0 {
+			requests[name] = limit
+		}
+	}
+	return corev1.ResourceRequirements{Limits: limits, Requests: requests}
+}
+
+// parseResourceList returns the quantities that parse, leaving out empty or invalid values.
+func parseResourceList(quantities map[corev1.ResourceName]string) corev1.ResourceList {
+	resourceList := corev1.ResourceList{}
+	for name, value := range quantities {
+		if quantity, err := resource.ParseQuantity(value); err == nil {
+			resourceList[name] = quantity
+		}
 	}
-	return ustore_ce_image
+	return resourceList
 }
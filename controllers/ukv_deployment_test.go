@@ -0,0 +1,90 @@
+package controllers
+
+import (
+	"testing"
+
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestResourcesForUStore(t *testing.T) {
+	resourceList := func(cpu, memory string) corev1.ResourceList {
+		resourceList := corev1.ResourceList{}
+		if cpu != "" {
+			resourceList[corev1.ResourceCPU] = resource.MustParse(cpu)
+		}
+		if memory != "" {
+			resourceList[corev1.ResourceMemory] = resource.MustParse(memory)
+		}
+		return resourceList
+	}
+	tests := []struct {
+		name     string
+		spec     unumv1alpha1.UStoreSpec
+		expected corev1.ResourceRequirements
+	}{
+		{
+			name: "default requests",
+			spec: unumv1alpha1.UStoreSpec{ConcurrencyLimit: "2", MemoryLimit: "1Gi"},
+			expected: corev1.ResourceRequirements{
+				Limits:   resourceList("2", "1Gi"),
+				Requests: resourceList(ustore_cpu_request, ustore_memory_request),
+			},
+		},
+		{
+			name: "requests are capped by the limits",
+			spec: unumv1alpha1.UStoreSpec{ConcurrencyLimit: "100m", MemoryLimit: "64Mi"},
+			expected: corev1.ResourceRequirements{
+				Limits:   resourceList("100m", "64Mi"),
+				Requests: resourceList("100m", "64Mi"),
+			},
+		},
+		{
+			name: "invalid limits are left out",
+			spec: unumv1alpha1.UStoreSpec{ConcurrencyLimit: "lots", MemoryLimit: ""},
+			expected: corev1.ResourceRequirements{
+				Limits:   resourceList("", ""),
+				Requests: resourceList(ustore_cpu_request, ustore_memory_request),
+			},
+		},
+		{
+			name: "resources override the shorthands",
+			spec: unumv1alpha1.UStoreSpec{
+				ConcurrencyLimit: "2",
+				MemoryLimit:      "1Gi",
+				Resources: &corev1.ResourceRequirements{
+					Limits:   resourceList("", "2Gi"),
+					Requests: resourceList("1", "512Mi"),
+				},
+			},
+			expected: corev1.ResourceRequirements{
+				Limits:   resourceList("2", "2Gi"),
+				Requests: resourceList("1", "512Mi"),
+			},
+		},
+		{
+			name: "guaranteed QoS",
+			spec: unumv1alpha1.UStoreSpec{
+				ConcurrencyLimit: "2",
+				MemoryLimit:      "1Gi",
+				GuaranteedQoS:    true,
+				Resources:        &corev1.ResourceRequirements{Requests: resourceList("1", "512Mi")},
+			},
+			expected: corev1.ResourceRequirements{
+				Limits:   resourceList("2", "1Gi"),
+				Requests: resourceList("2", "1Gi"),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resources := resourcesForUStore(&unumv1alpha1.UStore{Spec: test.spec})
+			if !equality.Semantic.DeepEqual(resources, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, resources)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"context"
+
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+	"github.com/opdev/ustore-operator/controllers/utils"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// reconcileDisruptionBudget keeps a PodDisruptionBudget over the UStore pods, so node drains
+// evict the replicas one at a time. A single instance UStore gets none unless spec.disruption
+// is set, as the budget would block drains altogether.
+func (r *UStoreReconciler) reconcileDisruptionBudget(ctx context.Context, ustoreResource *unumv1alpha1.UStore) error {
+	logger := log.FromContext(ctx)
+	found := &policyv1.PodDisruptionBudget{}
+	err := r.Get(ctx, types.NamespacedName{Name: ustoreResource.Name, Namespace: ustoreResource.Namespace}, found)
+	if err != nil && !errors.IsNotFound(err) {
+		logger.Error(err, "Failed to get PodDisruptionBudget")
+		return err
+	}
+	exists := err == nil
+
+	if ustoreResource.Spec.Disruption == nil && ustoreResource.Spec.NumOfInstances <= 1 {
+		if exists && metav1.IsControlledBy(found, ustoreResource) {
+			logger.Info("Deleting the PodDisruptionBudget of a single instance UStore", "PodDisruptionBudget.Name", found.Name)
+			if err := r.Delete(ctx, found); err != nil && !errors.IsNotFound(err) {
+				logger.Error(err, "Failed to delete PodDisruptionBudget", "PodDisruptionBudget.Name", found.Name)
+				return err
+			}
+		}
+		return nil
+	}
+
+	desired, err := r.disruptionBudgetForUStore(ustoreResource)
+	if err != nil {
+		logger.Error(err, "Failed to set owner reference on PodDisruptionBudget")
+		return err
+	}
+	if !exists {
+		logger.Info("Creating a new PodDisruptionBudget", "PodDisruptionBudget.Namespace", desired.Namespace, "PodDisruptionBudget.Name", desired.Name)
+		if err := r.Create(ctx, desired); err != nil {
+			logger.Error(err, "Failed to create new PodDisruptionBudget", "PodDisruptionBudget.Namespace", desired.Namespace, "PodDisruptionBudget.Name", desired.Name)
+			return err
+		}
+		return nil
+	}
+
+	if !equality.Semantic.DeepEqual(found.Spec, desired.Spec) {
+		found.Spec = desired.Spec
+		if err := r.Update(ctx, found); err != nil {
+			logger.Error(err, "Failed to update UStore PodDisruptionBudget")
+			return err
+		}
+	}
+	return nil
+}
+
+// disruptionBudgetForUStore returns the UStore PodDisruptionBudget, allowing one unavailable
+// replica unless spec.disruption says otherwise.
+func (r *UStoreReconciler) disruptionBudgetForUStore(ustoreResource *unumv1alpha1.UStore) (*policyv1.PodDisruptionBudget, error) {
+	pdb := &policyv1.PodDisruptionBudget{
+		ObjectMeta: utils.SetObjectMeta(ustoreResource.Name, ustoreResource.Namespace, utils.LabelsForUStore(ustoreResource.Name)),
+		Spec: policyv1.PodDisruptionBudgetSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: utils.LabelsForUStore(ustoreResource.Name),
+			},
+		},
+	}
+
+	disruption := ustoreResource.Spec.Disruption
+	switch {
+	case disruption != nil && disruption.MinAvailable != nil:
+		minAvailable := *disruption.MinAvailable
+		pdb.Spec.MinAvailable = &minAvailable
+	case disruption != nil && disruption.MaxUnavailable != nil:
+		maxUnavailable := *disruption.MaxUnavailable
+		pdb.Spec.MaxUnavailable = &maxUnavailable
+	default:
+		maxUnavailable := intstr.FromInt(1)
+		pdb.Spec.MaxUnavailable = &maxUnavailable
+	}
+
+	// Set UStore instance as the owner and controller
+	if err := ctrl.SetControllerReference(ustoreResource, pdb, r.Scheme); err != nil {
+		return nil, err
+	}
+	return pdb, nil
+}
@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+	"github.com/opdev/ustore-operator/controllers/utils"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestReconcileDisruptionBudget(t *testing.T) {
+	one := intstr.FromInt(1)
+	half := intstr.FromString("50%")
+	tests := []struct {
+		name           string
+		instances      int32
+		disruption     *unumv1alpha1.DisruptionSpec
+		existing       bool
+		controlled     bool
+		minAvailable   *intstr.IntOrString
+		maxUnavailable *intstr.IntOrString
+		deleted        bool
+	}{
+		{name: "single instance", instances: 1, deleted: true},
+		{name: "single instance deletes its budget", instances: 1, existing: true, controlled: true, deleted: true},
+		{name: "single instance leaves other budgets alone", instances: 1, existing: true},
+		{name: "one unavailable replica by default", instances: 3, maxUnavailable: &one},
+		{
+			name:         "minimum available replicas",
+			instances:    3,
+			disruption:   &unumv1alpha1.DisruptionSpec{MinAvailable: &half},
+			minAvailable: &half,
+		},
+		{
+			name:           "updated budget",
+			instances:      3,
+			disruption:     &unumv1alpha1.DisruptionSpec{MaxUnavailable: &half},
+			existing:       true,
+			controlled:     true,
+			maxUnavailable: &half,
+		},
+		{
+			name:         "single instance with a budget",
+			instances:    1,
+			disruption:   &unumv1alpha1.DisruptionSpec{MinAvailable: &one},
+			minAvailable: &one,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			ustoreResource := &unumv1alpha1.UStore{
+				ObjectMeta: metav1.ObjectMeta{Name: "ustore", Namespace: "default", UID: "uid"},
+				Spec:       unumv1alpha1.UStoreSpec{NumOfInstances: test.instances, Disruption: test.disruption},
+			}
+			scheme := testScheme(t)
+			builder := fake.NewClientBuilder().WithScheme(scheme)
+			if test.existing {
+				existing := &policyv1.PodDisruptionBudget{
+					ObjectMeta: metav1.ObjectMeta{Name: "ustore", Namespace: "default"},
+					Spec:       policyv1.PodDisruptionBudgetSpec{MaxUnavailable: &one},
+				}
+				if test.controlled {
+					controller := true
+					existing.OwnerReferences = []metav1.OwnerReference{{
+						APIVersion: unumv1alpha1.GroupVersion.String(),
+						Kind:       "UStore",
+						Name:       "ustore",
+						UID:        "uid",
+						Controller: &controller,
+					}}
+				}
+				builder = builder.WithObjects(existing)
+			}
+			r := &UStoreReconciler{Client: builder.Build(), Scheme: scheme}
+
+			if err := r.reconcileDisruptionBudget(ctx, ustoreResource); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			found := &policyv1.PodDisruptionBudget{}
+			err := r.Get(ctx, types.NamespacedName{Name: "ustore", Namespace: "default"}, found)
+			if test.deleted {
+				if !errors.IsNotFound(err) {
+					t.Errorf("expected no PodDisruptionBudget, got %v", err)
+				}
+				return
+			}
+			if test.existing && !test.controlled {
+				if err != nil {
+					t.Errorf("expected the PodDisruptionBudget to be left alone, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !intOrStringEqual(found.Spec.MinAvailable, test.minAvailable) || !intOrStringEqual(found.Spec.MaxUnavailable, test.maxUnavailable) {
+				t.Errorf("expected minAvailable %v and maxUnavailable %v, got %v and %v",
+					test.minAvailable, test.maxUnavailable, found.Spec.MinAvailable, found.Spec.MaxUnavailable)
+			}
+			if !metav1.IsControlledBy(found, ustoreResource) {
+				t.Errorf("expected the PodDisruptionBudget to be controlled by the UStore")
+			}
+			if found.Spec.Selector == nil || !reflect.DeepEqual(found.Spec.Selector.MatchLabels, utils.LabelsForUStore("ustore")) {
+				t.Errorf("expected a selector of the UStore pods, got %v", found.Spec.Selector)
+			}
+		})
+	}
+}
+
+func intOrStringEqual(a, b *intstr.IntOrString) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,267 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+	"github.com/opdev/ustore-operator/controllers/utils"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// exposeKinds holds the routes a UStore can be exposed with. Their APIs are optional,
+// so the objects are handled as unstructured.
+var exposeKinds = map[string]schema.GroupVersionKind{
+	unumv1alpha1.ExposeKindRoute:     {Group: "route.openshift.io", Version: "v1", Kind: "Route"},
+	unumv1alpha1.ExposeKindGRPCRoute: {Group: "gateway.networking.k8s.io", Version: "v1alpha2", Kind: "GRPCRoute"},
+	unumv1alpha1.ExposeKindTLSRoute:  {Group: "gateway.networking.k8s.io", Version: "v1alpha2", Kind: "TLSRoute"},
+}
+
+// exposeKind returns the kind of route requested in spec.expose, empty when not exposed.
+func exposeKind(ustoreResource *unumv1alpha1.UStore) string {
+	expose := ustoreResource.Spec.Expose
+	switch {
+	case expose == nil:
+		return ""
+	case expose.Gateway != nil && expose.Gateway.Kind != "":
+		return expose.Gateway.Kind
+	case expose.Gateway != nil:
+		return unumv1alpha1.ExposeKindGRPCRoute
+	}
+	return unumv1alpha1.ExposeKindRoute
+}
+
+// reconcileExpose creates or updates the route requested in spec.expose, and deletes the UStore
+// routes of other kinds, e.g. after switching from a Route to a Gateway.
+func (r *UStoreReconciler) reconcileExpose(ctx context.Context, ustoreResource *unumv1alpha1.UStore) error {
+	logger := log.FromContext(ctx)
+	kind := exposeKind(ustoreResource)
+	for otherKind := range r.exposeAPIs {
+		if otherKind == kind {
+			continue
+		}
+		if err := r.deleteExposeRoute(ctx, ustoreResource, exposeKinds[otherKind]); err != nil {
+			return err
+		}
+	}
+
+	if kind == "" {
+		ustoreResource.Status.Expose = nil
+		return nil
+	}
+	if !r.exposeAPIs[kind] {
+		ustoreResource.Status.Expose = &unumv1alpha1.ExposeStatus{
+			Kind:    kind,
+			Message: fmt.Sprintf("The %s API is not served by the cluster", exposeKinds[kind].GroupVersion()),
+		}
+		return nil
+	}
+
+	if exposeRequiresTLS(ustoreResource, kind) {
+		// the route could never reach the server
+		if err := r.deleteExposeRoute(ctx, ustoreResource, exposeKinds[kind]); err != nil {
+			return err
+		}
+		ustoreResource.Status.Expose = &unumv1alpha1.ExposeStatus{
+			Kind:    kind,
+			Message: fmt.Sprintf("A %s passing TLS through requires a server serving TLS", kind),
+		}
+		return nil
+	}
+
+	desired, err := r.exposeRouteForUStore(ustoreResource, kind)
+	if err != nil {
+		logger.Error(err, "Failed to set owner reference on route", "Kind", kind)
+		return err
+	}
+	found := &unstructured.Unstructured{}
+	found.SetGroupVersionKind(exposeKinds[kind])
+	err = r.Get(ctx, types.NamespacedName{Name: desired.GetName(), Namespace: desired.GetNamespace()}, found)
+	if err != nil && errors.IsNotFound(err) {
+		logger.Info("Creating a new route", "Kind", kind, "Name", desired.GetName())
+		if err := r.Create(ctx, desired); err != nil {
+			logger.Error(err, "Failed to create new route", "Kind", kind, "Name", desired.GetName())
+			return err
+		}
+		ustoreResource.Status.Expose = exposeStatus(ustoreResource, desired)
+		return nil
+	} else if err != nil {
+		logger.Error(err, "Failed to get route", "Kind", kind)
+		return err
+	}
+
+	// set only the fields the operator renders, the rest is defaulted by the cluster
+	current := found.DeepCopy()
+	for key, value := range desired.Object["spec"].(map[string]interface{}) {
+		if err := unstructured.SetNestedField(found.Object, value, "spec", key); err != nil {
+			return err
+		}
+	}
+	if !equality.Semantic.DeepEqual(current.Object["spec"], found.Object["spec"]) {
+		if err := r.Update(ctx, found); err != nil {
+			logger.Error(err, "Failed to update UStore route", "Kind", kind)
+			return err
+		}
+	}
+	ustoreResource.Status.Expose = exposeStatus(ustoreResource, found)
+	return nil
+}
+
+// exposeRequiresTLS reports whether the route of the given kind connects to the server over TLS.
+func exposeRequiresTLS(ustoreResource *unumv1alpha1.UStore, kind string) bool {
+	switch kind {
+	case unumv1alpha1.ExposeKindTLSRoute:
+		return true
+	case unumv1alpha1.ExposeKindRoute:
+		return routeTermination(ustoreResource) != unumv1alpha1.RouteTerminationEdge
+	}
+	return false
+}
+
+// routeTermination returns the TLS termination of the OpenShift Route, defaulting to edge.
+func routeTermination(ustoreResource *unumv1alpha1.UStore) string {
+	if expose := ustoreResource.Spec.Expose; expose != nil && expose.Route != nil && expose.Route.Termination != "" {
+		return expose.Route.Termination
+	}
+	return unumv1alpha1.RouteTerminationEdge
+}
+
+// deleteExposeRoute deletes the route of the given kind controlled by the UStore, if any.
+func (r *UStoreReconciler) deleteExposeRoute(ctx context.Context, ustoreResource *unumv1alpha1.UStore, gvk schema.GroupVersionKind) error {
+	route := &unstructured.Unstructured{}
+	route.SetGroupVersionKind(gvk)
+	err := r.Get(ctx, types.NamespacedName{Name: ustoreResource.Name, Namespace: ustoreResource.Namespace}, route)
+	if err != nil && errors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !metav1.IsControlledBy(route, ustoreResource) {
+		return nil
+	}
+	log.FromContext(ctx).Info("Deleting route no longer requested", "Kind", gvk.Kind, "Name", route.GetName())
+	if err := r.Delete(ctx, route); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// exposeRouteForUStore returns the route of the given kind, sending clients to the UStore Service.
+func (r *UStoreReconciler) exposeRouteForUStore(ustoreResource *unumv1alpha1.UStore, kind string) (*unstructured.Unstructured, error) {
+	expose := ustoreResource.Spec.Expose
+	var spec map[string]interface{}
+	if kind == unumv1alpha1.ExposeKindRoute {
+		tls := map[string]interface{}{
+			"termination":                   routeTermination(ustoreResource),
+			"insecureEdgeTerminationPolicy": "None",
+		}
+		if expose.Route != nil && expose.Route.DestinationCACertificate != "" {
+			tls["destinationCACertificate"] = expose.Route.DestinationCACertificate
+		}
+		spec = map[string]interface{}{
+			"to": map[string]interface{}{
+				"kind": "Service",
+				"name": ustoreResource.Name,
+			},
+			"port": map[string]interface{}{
+				"targetPort": ustore_service_port_name,
+			},
+			"tls": tls,
+		}
+		if expose.Host != "" {
+			spec["host"] = expose.Host
+		}
+	} else {
+		parentRefs := []interface{}{}
+		for _, parent := range expose.Gateway.ParentRefs {
+			parentRef := map[string]interface{}{"name": parent.Name}
+			if parent.Namespace != "" {
+				parentRef["namespace"] = parent.Namespace
+			}
+			if parent.SectionName != "" {
+				parentRef["sectionName"] = parent.SectionName
+			}
+			parentRefs = append(parentRefs, parentRef)
+		}
+		spec = map[string]interface{}{
+			"parentRefs": parentRefs,
+			"rules": []interface{}{
+				map[string]interface{}{
+					"backendRefs": []interface{}{
+						map[string]interface{}{
+							"name": ustoreResource.Name,
+							"port": int64(ustoreResource.Spec.DBServicePort),
+						},
+					},
+				},
+			},
+		}
+		if expose.Host != "" {
+			spec["hostnames"] = []interface{}{expose.Host}
+		}
+	}
+
+	route := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	route.SetGroupVersionKind(exposeKinds[kind])
+	objectMeta := utils.SetObjectMeta(ustoreResource.Name, ustoreResource.Namespace, utils.LabelsForUStore(ustoreResource.Name))
+	route.SetName(objectMeta.Name)
+	route.SetNamespace(objectMeta.Namespace)
+	route.SetLabels(objectMeta.Labels)
+	// Set UStore instance as the owner and controller
+	if err := ctrl.SetControllerReference(ustoreResource, route, r.Scheme); err != nil {
+		return nil, err
+	}
+	return route, nil
+}
+
+// exposeStatus reports the host of the route and whether the router admitted it, or any Gateway accepted it.
+func exposeStatus(ustoreResource *unumv1alpha1.UStore, route *unstructured.Unstructured) *unumv1alpha1.ExposeStatus {
+	status := &unumv1alpha1.ExposeStatus{
+		Kind:    route.GetKind(),
+		Name:    route.GetName(),
+		Host:    ustoreResource.Spec.Expose.Host,
+		Message: "Waiting for the route to be accepted",
+	}
+
+	conditionsPath := []string{"conditions"}
+	statusesPath := []string{"status", "parents"}
+	acceptedType := "Accepted"
+	if route.GetKind() == unumv1alpha1.ExposeKindRoute {
+		statusesPath = []string{"status", "ingress"}
+		acceptedType = "Admitted"
+	}
+	statuses, _, _ := unstructured.NestedSlice(route.Object, statusesPath...)
+	for _, entry := range statuses {
+		entry, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if host, _, _ := unstructured.NestedString(entry, "host"); host != "" && status.Host == "" {
+			// generated by the OpenShift router
+			status.Host = host
+		}
+		conditions, _, _ := unstructured.NestedSlice(entry, conditionsPath...)
+		for _, condition := range conditions {
+			condition, ok := condition.(map[string]interface{})
+			if !ok || condition["type"] != acceptedType {
+				continue
+			}
+			if condition["status"] == string(metav1.ConditionTrue) {
+				status.Accepted = true
+				status.Message = ""
+				return status
+			}
+			if message, ok := condition["message"].(string); ok && message != "" {
+				status.Message = message
+			}
+		}
+	}
+	return status
+}
@@ -0,0 +1,159 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestExposeRouteForUStore(t *testing.T) {
+	gateways := []unumv1alpha1.GatewayParentRef{
+		{Name: "public"},
+		{Name: "internal", Namespace: "gateways", SectionName: "grpc"},
+	}
+	gatewaySpec := func(hostnames ...interface{}) map[string]interface{} {
+		spec := map[string]interface{}{
+			"parentRefs": []interface{}{
+				map[string]interface{}{"name": "public"},
+				map[string]interface{}{"name": "internal", "namespace": "gateways", "sectionName": "grpc"},
+			},
+			"rules": []interface{}{
+				map[string]interface{}{
+					"backendRefs": []interface{}{
+						map[string]interface{}{"name": "ustore", "port": int64(8081)},
+					},
+				},
+			},
+		}
+		if len(hostnames) > 0 {
+			spec["hostnames"] = hostnames
+		}
+		return spec
+	}
+	tests := []struct {
+		name     string
+		expose   unumv1alpha1.ExposeSpec
+		kind     string
+		expected map[string]interface{}
+	}{
+		{
+			name:   "edge route by default",
+			expose: unumv1alpha1.ExposeSpec{},
+			kind:   unumv1alpha1.ExposeKindRoute,
+			expected: map[string]interface{}{
+				"to":   map[string]interface{}{"kind": "Service", "name": "ustore"},
+				"port": map[string]interface{}{"targetPort": ustore_service_port_name},
+				"tls": map[string]interface{}{
+					"termination":                   unumv1alpha1.RouteTerminationEdge,
+					"insecureEdgeTerminationPolicy": "None",
+				},
+			},
+		},
+		{
+			name: "reencrypt route",
+			expose: unumv1alpha1.ExposeSpec{Route: &unumv1alpha1.RouteExposeSpec{
+				Termination:              unumv1alpha1.RouteTerminationReencrypt,
+				DestinationCACertificate: "-----BEGIN CERTIFICATE-----",
+			}},
+			kind: unumv1alpha1.ExposeKindRoute,
+			expected: map[string]interface{}{
+				"to":   map[string]interface{}{"kind": "Service", "name": "ustore"},
+				"port": map[string]interface{}{"targetPort": ustore_service_port_name},
+				"tls": map[string]interface{}{
+					"termination":                   unumv1alpha1.RouteTerminationReencrypt,
+					"insecureEdgeTerminationPolicy": "None",
+					"destinationCACertificate":      "-----BEGIN CERTIFICATE-----",
+				},
+			},
+		},
+		{
+			name:     "GRPCRoute",
+			expose:   unumv1alpha1.ExposeSpec{Gateway: &unumv1alpha1.GatewayExposeSpec{ParentRefs: gateways}},
+			kind:     unumv1alpha1.ExposeKindGRPCRoute,
+			expected: gatewaySpec(),
+		},
+		{
+			name: "TLSRoute with a host",
+			expose: unumv1alpha1.ExposeSpec{
+				Host:    "ustore.example.com",
+				Gateway: &unumv1alpha1.GatewayExposeSpec{Kind: unumv1alpha1.ExposeKindTLSRoute, ParentRefs: gateways},
+			},
+			kind:     unumv1alpha1.ExposeKindTLSRoute,
+			expected: gatewaySpec("ustore.example.com"),
+		},
+	}
+
+	r := &UStoreReconciler{Scheme: testScheme(t)}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expose := test.expose
+			ustoreResource := &unumv1alpha1.UStore{
+				ObjectMeta: metav1.ObjectMeta{Name: "ustore", Namespace: "default", UID: "uid"},
+				Spec:       unumv1alpha1.UStoreSpec{DBServicePort: 8081, Expose: &expose},
+			}
+			if kind := exposeKind(ustoreResource); kind != test.kind {
+				t.Fatalf("expected kind %s, got %s", test.kind, kind)
+			}
+			route, err := r.exposeRouteForUStore(ustoreResource, test.kind)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if route.GroupVersionKind() != exposeKinds[test.kind] {
+				t.Errorf("expected %v, got %v", exposeKinds[test.kind], route.GroupVersionKind())
+			}
+			if route.GetName() != "ustore" || route.GetNamespace() != "default" {
+				t.Errorf("expected default/ustore, got %s/%s", route.GetNamespace(), route.GetName())
+			}
+			if !metav1.IsControlledBy(route, ustoreResource) {
+				t.Errorf("expected the route to be controlled by the UStore")
+			}
+			if !reflect.DeepEqual(route.Object["spec"], test.expected) {
+				t.Errorf("expected spec %v, got %v", test.expected, route.Object["spec"])
+			}
+		})
+	}
+}
+
+func TestExposeRequiresTLS(t *testing.T) {
+	tests := []struct {
+		name     string
+		expose   unumv1alpha1.ExposeSpec
+		expected bool
+	}{
+		{
+			name:   "default route",
+			expose: unumv1alpha1.ExposeSpec{},
+		},
+		{
+			name:     "passthrough route",
+			expose:   unumv1alpha1.ExposeSpec{Route: &unumv1alpha1.RouteExposeSpec{Termination: unumv1alpha1.RouteTerminationPassthrough}},
+			expected: true,
+		},
+		{
+			name:     "reencrypt route",
+			expose:   unumv1alpha1.ExposeSpec{Route: &unumv1alpha1.RouteExposeSpec{Termination: unumv1alpha1.RouteTerminationReencrypt}},
+			expected: true,
+		},
+		{
+			name:   "GRPCRoute",
+			expose: unumv1alpha1.ExposeSpec{Gateway: &unumv1alpha1.GatewayExposeSpec{}},
+		},
+		{
+			name:     "TLSRoute",
+			expose:   unumv1alpha1.ExposeSpec{Gateway: &unumv1alpha1.GatewayExposeSpec{Kind: unumv1alpha1.ExposeKindTLSRoute}},
+			expected: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expose := test.expose
+			ustoreResource := &unumv1alpha1.UStore{Spec: unumv1alpha1.UStoreSpec{Expose: &expose}}
+			if requiresTLS := exposeRequiresTLS(ustoreResource, exposeKind(ustoreResource)); requiresTLS != test.expected {
+				t.Errorf("expected %t, got %t", test.expected, requiresTLS)
+			}
+		})
+	}
+}
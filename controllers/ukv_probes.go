@@ -0,0 +1,81 @@
+package controllers
+
+import (
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// addProbesIfNeeded sets the startup, readiness and liveness probes of the UStore container.
+// The probes open a TCP connection to the Arrow Flight port, which the server only listens on
+// once the database is open.
+func addProbesIfNeeded(ustoreResource *unumv1alpha1.UStore, container *corev1.Container) {
+	probes := ustoreResource.Spec.Probes
+	if probes == nil {
+		probes = &unumv1alpha1.ProbesSpec{}
+	}
+
+	// persistent engines replay their WAL before listening, which may take long on large databases
+	startupFailureThreshold := int32(ustore_startup_failure_threshold)
+	if unumv1alpha1.PersistentDBType(ustoreResource.Spec.DBType) {
+		startupFailureThreshold = ustore_persistent_startup_failure_threshold
+	}
+
+	container.StartupProbe = probeForUStore(ustoreResource, probes.Startup, corev1.Probe{
+		PeriodSeconds:    10,
+		TimeoutSeconds:   1,
+		SuccessThreshold: 1,
+		FailureThreshold: startupFailureThreshold,
+	})
+	container.ReadinessProbe = probeForUStore(ustoreResource, probes.Readiness, corev1.Probe{
+		PeriodSeconds:    10,
+		TimeoutSeconds:   1,
+		SuccessThreshold: 1,
+		FailureThreshold: 3,
+	})
+	container.LivenessProbe = probeForUStore(ustoreResource, probes.Liveness, corev1.Probe{
+		PeriodSeconds:    20,
+		TimeoutSeconds:   5,
+		SuccessThreshold: 1,
+		FailureThreshold: 6,
+	})
+	if container.LivenessProbe != nil {
+		// the kubelet rejects liveness probes with another success threshold
+		container.LivenessProbe.SuccessThreshold = 1
+	}
+	if container.StartupProbe != nil {
+		container.StartupProbe.SuccessThreshold = 1
+	}
+}
+
+// probeForUStore returns a TCP probe of the DB port with the defaults overridden by the spec,
+// or nil when the probe is disabled.
+func probeForUStore(ustoreResource *unumv1alpha1.UStore, spec *unumv1alpha1.ProbeSpec, probe corev1.Probe) *corev1.Probe {
+	probe.ProbeHandler = corev1.ProbeHandler{
+		TCPSocket: &corev1.TCPSocketAction{
+			Port: intstr.FromString(ustore_service_port_name),
+		},
+	}
+	if spec == nil {
+		return &probe
+	}
+	if spec.Disabled {
+		return nil
+	}
+	if spec.InitialDelaySeconds != nil {
+		probe.InitialDelaySeconds = *spec.InitialDelaySeconds
+	}
+	if spec.PeriodSeconds != nil {
+		probe.PeriodSeconds = *spec.PeriodSeconds
+	}
+	if spec.TimeoutSeconds != nil {
+		probe.TimeoutSeconds = *spec.TimeoutSeconds
+	}
+	if spec.SuccessThreshold != nil {
+		probe.SuccessThreshold = *spec.SuccessThreshold
+	}
+	if spec.FailureThreshold != nil {
+		probe.FailureThreshold = *spec.FailureThreshold
+	}
+	return &probe
+}
@@ -0,0 +1,92 @@
+package controllers
+
+import (
+	"testing"
+
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestAddProbesIfNeeded(t *testing.T) {
+	tests := []struct {
+		name             string
+		dbType           string
+		probes           *unumv1alpha1.ProbesSpec
+		startupThreshold int32
+		readinessPeriod  int32
+		liveness         bool
+		livenessSuccess  int32
+	}{
+		{
+			name:             "in-memory defaults",
+			dbType:           "umem",
+			startupThreshold: ustore_startup_failure_threshold,
+			readinessPeriod:  10,
+			liveness:         true,
+			livenessSuccess:  1,
+		},
+		{
+			name:             "persistent engines wait longer to start",
+			dbType:           "rocksdb",
+			startupThreshold: ustore_persistent_startup_failure_threshold,
+			readinessPeriod:  10,
+			liveness:         true,
+			livenessSuccess:  1,
+		},
+		{
+			name:   "overridden thresholds",
+			dbType: "rocksdb",
+			probes: &unumv1alpha1.ProbesSpec{
+				Startup:   &unumv1alpha1.ProbeSpec{FailureThreshold: int32Ptr(30)},
+				Readiness: &unumv1alpha1.ProbeSpec{PeriodSeconds: int32Ptr(5)},
+				Liveness:  &unumv1alpha1.ProbeSpec{SuccessThreshold: int32Ptr(3)},
+			},
+			startupThreshold: 30,
+			readinessPeriod:  5,
+			liveness:         true,
+			livenessSuccess:  1,
+		},
+		{
+			name:             "disabled liveness probe",
+			dbType:           "umem",
+			probes:           &unumv1alpha1.ProbesSpec{Liveness: &unumv1alpha1.ProbeSpec{Disabled: true}},
+			startupThreshold: ustore_startup_failure_threshold,
+			readinessPeriod:  10,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ustoreResource := &unumv1alpha1.UStore{
+				Spec: unumv1alpha1.UStoreSpec{DBType: test.dbType, Probes: test.probes},
+			}
+			container := &corev1.Container{}
+			addProbesIfNeeded(ustoreResource, container)
+
+			if container.StartupProbe == nil || container.ReadinessProbe == nil {
+				t.Fatalf("expected startup and readiness probes, got %+v", container)
+			}
+			if container.StartupProbe.FailureThreshold != test.startupThreshold {
+				t.Errorf("expected a startup failure threshold of %d, got %d", test.startupThreshold, container.StartupProbe.FailureThreshold)
+			}
+			if container.ReadinessProbe.PeriodSeconds != test.readinessPeriod {
+				t.Errorf("expected a readiness period of %d, got %d", test.readinessPeriod, container.ReadinessProbe.PeriodSeconds)
+			}
+			if (container.LivenessProbe != nil) != test.liveness {
+				t.Fatalf("expected liveness probe %t, got %+v", test.liveness, container.LivenessProbe)
+			}
+			if test.liveness && container.LivenessProbe.SuccessThreshold != test.livenessSuccess {
+				t.Errorf("expected a liveness success threshold of %d, got %d", test.livenessSuccess, container.LivenessProbe.SuccessThreshold)
+			}
+			for _, probe := range []*corev1.Probe{container.StartupProbe, container.ReadinessProbe, container.LivenessProbe} {
+				if probe == nil {
+					continue
+				}
+				if probe.TCPSocket == nil || probe.TCPSocket.Port != intstr.FromString(ustore_service_port_name) {
+					t.Errorf("expected a TCP probe of the DB port, got %+v", probe.ProbeHandler)
+				}
+			}
+		})
+	}
+}
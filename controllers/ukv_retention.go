@@ -0,0 +1,277 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+	"github.com/opdev/ustore-operator/controllers/utils"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// retentionPollInterval is how often a deleting UStore checks its final snapshot.
+const retentionPollInterval = 5 * time.Second
+
+// persistenceRetention returns the retention policy of the UStore, Delete when unset.
+func persistenceRetention(ustoreResource *unumv1alpha1.UStore) string {
+	if ustoreResource.Spec.PersistenceRetention == "" {
+		return unumv1alpha1.PersistenceRetentionDelete
+	}
+	return ustoreResource.Spec.PersistenceRetention
+}
+
+// claimRetentionWhenDeleted returns what the StatefulSet controller does with the replica claims
+// once the StatefulSet is deleted. The final snapshot is taken before the StatefulSet goes away.
+func claimRetentionWhenDeleted(ustoreResource *unumv1alpha1.UStore) appsv1.PersistentVolumeClaimRetentionPolicyType {
+	if persistenceRetention(ustoreResource) == unumv1alpha1.PersistenceRetentionRetain {
+		return appsv1.RetainPersistentVolumeClaimRetentionPolicyType
+	}
+	return appsv1.DeletePersistentVolumeClaimRetentionPolicyType
+}
+
+// reconcileRetentionFinalizer adds the finalizer when the volumes outlive or are snapshotted
+// on deletion, and removes it when the policy goes back to Delete. With the Snapshot policy the
+// claims get the finalizer as well.
+func (r *UStoreReconciler) reconcileRetentionFinalizer(ctx context.Context, ustoreResource *unumv1alpha1.UStore) error {
+	needed := persistenceRetention(ustoreResource) != unumv1alpha1.PersistenceRetentionDelete && len(ustoreResource.Spec.Volumes) > 0
+	protectClaims := needed && persistenceRetention(ustoreResource) == unumv1alpha1.PersistenceRetentionSnapshot
+	if err := r.reconcileClaimFinalizers(ctx, ustoreResource, protectClaims); err != nil {
+		return err
+	}
+	if needed == controllerutil.ContainsFinalizer(ustoreResource, ustore_retention_finalizer) {
+		return nil
+	}
+
+	patchDiff := client.MergeFrom(ustoreResource.DeepCopy())
+	if needed {
+		controllerutil.AddFinalizer(ustoreResource, ustore_retention_finalizer)
+	} else {
+		controllerutil.RemoveFinalizer(ustoreResource, ustore_retention_finalizer)
+	}
+	if err := r.Patch(ctx, ustoreResource, patchDiff); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to update UStore finalizers")
+		return err
+	}
+	return nil
+}
+
+// finalizeUStore applies the retention policy to the volumes of a UStore being deleted and
+// then lets the deletion proceed.
+func (r *UStoreReconciler) finalizeUStore(ctx context.Context, ustoreResource *unumv1alpha1.UStore) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	if !controllerutil.ContainsFinalizer(ustoreResource, ustore_retention_finalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	switch persistenceRetention(ustoreResource) {
+	case unumv1alpha1.PersistenceRetentionRetain:
+		if err := r.orphanClaims(ctx, ustoreResource); err != nil {
+			return ctrl.Result{}, err
+		}
+	case unumv1alpha1.PersistenceRetentionSnapshot:
+		done, err := r.takeFinalSnapshot(ctx, ustoreResource)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if !done {
+			return ctrl.Result{RequeueAfter: retentionPollInterval}, nil
+		}
+	}
+	// the final snapshot no longer needs the claims
+	if err := r.reconcileClaimFinalizers(ctx, ustoreResource, false); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	patchDiff := client.MergeFrom(ustoreResource.DeepCopy())
+	controllerutil.RemoveFinalizer(ustoreResource, ustore_retention_finalizer)
+	if err := r.Patch(ctx, ustoreResource, patchDiff); err != nil {
+		logger.Error(err, "Failed to remove UStore finalizer")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// orphanClaims removes the UStore owner reference from its claims so the garbage collector keeps them.
+// StatefulSet claims are kept by their retention policy as well.
+func (r *UStoreReconciler) orphanClaims(ctx context.Context, ustoreResource *unumv1alpha1.UStore) error {
+	logger := log.FromContext(ctx)
+	pvcs := &corev1.PersistentVolumeClaimList{}
+	if err := r.List(ctx, pvcs, client.InNamespace(ustoreResource.Namespace), client.MatchingLabels(utils.LabelsForUStore(ustoreResource.Name))); err != nil {
+		logger.Error(err, "Failed to list PVCs")
+		return err
+	}
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+		owners := removeOwner(pvc.OwnerReferences, ustoreResource.UID)
+		if len(owners) == len(pvc.OwnerReferences) {
+			continue
+		}
+		patchDiff := client.MergeFrom(pvc.DeepCopy())
+		pvc.OwnerReferences = owners
+		logger.Info("Retaining PVC", "PVC.Name", pvc.Name)
+		if err := r.Patch(ctx, pvc, patchDiff); err != nil {
+			logger.Error(err, "Failed to retain PVC", "PVC.Name", pvc.Name)
+			return err
+		}
+	}
+	return nil
+}
+
+// reconcileClaimFinalizers adds the retention finalizer to the claims of the UStore, or removes it.
+// It keeps the claims of a UStore with the Snapshot policy until the final snapshot is ready to use,
+// even when a foreground deletion, or the StatefulSet, deletes them before the UStore finalizer runs.
+func (r *UStoreReconciler) reconcileClaimFinalizers(ctx context.Context, ustoreResource *unumv1alpha1.UStore, protect bool) error {
+	logger := log.FromContext(ctx)
+	pvcs := &corev1.PersistentVolumeClaimList{}
+	if err := r.List(ctx, pvcs, client.InNamespace(ustoreResource.Namespace), client.MatchingLabels(utils.LabelsForUStore(ustoreResource.Name))); err != nil {
+		logger.Error(err, "Failed to list PVCs")
+		return err
+	}
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+		if protect == controllerutil.ContainsFinalizer(pvc, ustore_retention_finalizer) || (protect && !pvc.DeletionTimestamp.IsZero()) {
+			continue
+		}
+		patchDiff := client.MergeFrom(pvc.DeepCopy())
+		if protect {
+			controllerutil.AddFinalizer(pvc, ustore_retention_finalizer)
+		} else {
+			controllerutil.RemoveFinalizer(pvc, ustore_retention_finalizer)
+		}
+		if err := r.Patch(ctx, pvc, patchDiff); err != nil {
+			logger.Error(err, "Failed to update PVC finalizers", "PVC.Name", pvc.Name)
+			return err
+		}
+	}
+	return nil
+}
+
+// removeOwner returns the owner references without the one of the given owner.
+func removeOwner(owners []metav1.OwnerReference, uid types.UID) []metav1.OwnerReference {
+	remaining := []metav1.OwnerReference{}
+	for _, owner := range owners {
+		if owner.UID != uid {
+			remaining = append(remaining, owner)
+		}
+	}
+	return remaining
+}
+
+// adoptRetainedClaim makes the UStore the controller of a claim retained by a previous UStore
+// of the same name. Claims controlled by another object are left alone.
+func (r *UStoreReconciler) adoptRetainedClaim(ctx context.Context, pvc *corev1.PersistentVolumeClaim, ustoreResource *unumv1alpha1.UStore) error {
+	if metav1.GetControllerOf(pvc) != nil || pvc.Labels["ownerInstance"] != ustoreResource.Name {
+		return nil
+	}
+	logger := log.FromContext(ctx)
+	patchDiff := client.MergeFrom(pvc.DeepCopy())
+	if err := ctrl.SetControllerReference(ustoreResource, pvc, r.Scheme); err != nil {
+		logger.Error(err, "Failed to set owner reference on PVC", "PVC.Name", pvc.Name)
+		return err
+	}
+	logger.Info("Adopting retained PVC", "PVC.Name", pvc.Name)
+	if err := r.Patch(ctx, pvc, patchDiff); err != nil {
+		logger.Error(err, "Failed to adopt PVC", "PVC.Name", pvc.Name)
+		return err
+	}
+	return nil
+}
+
+// takeFinalSnapshot stops the UStore pods, so the snapshot is consistent, and snapshots its
+// claims with a UStoreSnapshot that outlives the UStore. It reports whether every volume snapshot
+// is ready to use, and so no longer needs its claim.
+// A failed snapshot blocks the deletion until the policy is changed to Delete or Retain.
+func (r *UStoreReconciler) takeFinalSnapshot(ctx context.Context, ustoreResource *unumv1alpha1.UStore) (bool, error) {
+	logger := log.FromContext(ctx)
+	name := fmt.Sprintf("%s-final-%d", ustoreResource.Name, ustoreResource.DeletionTimestamp.Unix())
+	snapshot := &unumv1alpha1.UStoreSnapshot{}
+	err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: ustoreResource.Namespace}, snapshot)
+	if err == nil {
+		switch snapshot.Status.Phase {
+		case unumv1alpha1.PhaseCompleted:
+			return finalSnapshotReady(snapshot), nil
+		case unumv1alpha1.PhaseFailed:
+			logger.Info("Final snapshot failed, change spec.persistenceRetention to delete the UStore", "UStoreSnapshot.Name", name, "Message", snapshot.Status.Message)
+		}
+		return false, nil
+	} else if !errors.IsNotFound(err) {
+		logger.Error(err, "Failed to get UStoreSnapshot", "UStoreSnapshot.Name", name)
+		return false, err
+	}
+
+	stopped, err := r.stopWorkload(ctx, ustoreResource)
+	if err != nil || !stopped {
+		return false, err
+	}
+
+	scaleToZero := false
+	snapshot = &unumv1alpha1.UStoreSnapshot{
+		ObjectMeta: utils.SetObjectMeta(name, ustoreResource.Namespace, utils.LabelsForUStore(ustoreResource.Name)),
+		Spec: unumv1alpha1.UStoreSnapshotSpec{
+			UStoreName: ustoreResource.Name,
+			// the pods are already stopped
+			ScaleToZero: &scaleToZero,
+		},
+	}
+	logger.Info("Creating the final UStoreSnapshot", "UStoreSnapshot.Name", name)
+	if err := r.Create(ctx, snapshot); err != nil {
+		logger.Error(err, "Failed to create UStoreSnapshot", "UStoreSnapshot.Name", name)
+		return false, err
+	}
+	return false, nil
+}
+
+// finalSnapshotReady reports whether the snapshot of every claim is ready to use.
+func finalSnapshotReady(snapshot *unumv1alpha1.UStoreSnapshot) bool {
+	for _, volume := range snapshot.Status.Volumes {
+		if !volume.ReadyToUse {
+			return false
+		}
+	}
+	return true
+}
+
+// stopWorkload scales the UStore workload to zero and reports whether its pods are gone.
+func (r *UStoreReconciler) stopWorkload(ctx context.Context, ustoreResource *unumv1alpha1.UStore) (bool, error) {
+	logger := log.FromContext(ctx)
+	key := types.NamespacedName{Name: ustoreResource.Name, Namespace: ustoreResource.Namespace}
+	var workload client.Object = &appsv1.Deployment{}
+	if isStatefulSet(ustoreResource) {
+		workload = &appsv1.StatefulSet{}
+	}
+	err := r.Get(ctx, key, workload)
+	if err != nil && !errors.IsNotFound(err) {
+		logger.Error(err, "Failed to get UStore workload")
+		return false, err
+	}
+	if err == nil {
+		patchDiff := client.MergeFrom(workload.DeepCopyObject().(client.Object))
+		zero := int32(0)
+		switch w := workload.(type) {
+		case *appsv1.Deployment:
+			w.Spec.Replicas = &zero
+		case *appsv1.StatefulSet:
+			w.Spec.Replicas = &zero
+		}
+		if err := r.Patch(ctx, workload, patchDiff); err != nil {
+			logger.Error(err, "Failed to scale UStore workload to zero")
+			return false, err
+		}
+	}
+
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(ustoreResource.Namespace), client.MatchingLabels(utils.LabelsForUStore(ustoreResource.Name))); err != nil {
+		logger.Error(err, "Failed to list UStore pods")
+		return false, err
+	}
+	return len(pods.Items) == 0, nil
+}
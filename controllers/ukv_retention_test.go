@@ -0,0 +1,243 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+	"github.com/opdev/ustore-operator/controllers/utils"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// testScheme returns a scheme with the built-in and UStore types, used to set owner references.
+func testScheme(t *testing.T) *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := unumv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return scheme
+}
+
+// deletingUStore returns a UStore with the retention finalizer being deleted.
+func deletingUStore(retention string) *unumv1alpha1.UStore {
+	now := metav1.Now()
+	return &unumv1alpha1.UStore{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "ustore",
+			Namespace:         "default",
+			UID:               "uid",
+			Finalizers:        []string{ustore_retention_finalizer},
+			DeletionTimestamp: &now,
+		},
+		Spec: unumv1alpha1.UStoreSpec{
+			PersistenceRetention: retention,
+			Volumes:              []unumv1alpha1.Persistence{{MountPath: "/mnt/ustore", Size: "1Gi"}},
+		},
+	}
+}
+
+func TestReconcileRetentionFinalizer(t *testing.T) {
+	volumes := []unumv1alpha1.Persistence{{MountPath: "/mnt/ustore", Size: "1Gi"}}
+	tests := []struct {
+		name       string
+		retention  string
+		volumes    []unumv1alpha1.Persistence
+		finalizers []string
+		expected   bool
+	}{
+		{name: "delete by default", volumes: volumes},
+		{name: "retain", retention: unumv1alpha1.PersistenceRetentionRetain, volumes: volumes, expected: true},
+		{name: "snapshot", retention: unumv1alpha1.PersistenceRetentionSnapshot, volumes: volumes, expected: true},
+		{name: "retain without volumes", retention: unumv1alpha1.PersistenceRetentionRetain},
+		{
+			name:       "back to delete",
+			retention:  unumv1alpha1.PersistenceRetentionDelete,
+			volumes:    volumes,
+			finalizers: []string{ustore_retention_finalizer},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			ustoreResource := &unumv1alpha1.UStore{
+				ObjectMeta: metav1.ObjectMeta{Name: "ustore", Namespace: "default", Finalizers: test.finalizers},
+				Spec:       unumv1alpha1.UStoreSpec{PersistenceRetention: test.retention, Volumes: test.volumes},
+			}
+			scheme := testScheme(t)
+			r := &UStoreReconciler{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(ustoreResource.DeepCopy()).Build(), Scheme: scheme}
+
+			if err := r.reconcileRetentionFinalizer(ctx, ustoreResource); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			found := &unumv1alpha1.UStore{}
+			if err := r.Get(ctx, client.ObjectKeyFromObject(ustoreResource), found); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if finalizer := controllerutil.ContainsFinalizer(found, ustore_retention_finalizer); finalizer != test.expected {
+				t.Errorf("expected finalizer %t, got %t", test.expected, finalizer)
+			}
+		})
+	}
+}
+
+func TestFinalizeUStoreRetain(t *testing.T) {
+	ctx := context.Background()
+	ustoreResource := deletingUStore(unumv1alpha1.PersistenceRetentionRetain)
+	other := metav1.OwnerReference{APIVersion: "v1", Kind: "ConfigMap", Name: "other", UID: "other"}
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "ustore-mnt-ustore-volume",
+			Namespace: "default",
+			Labels:    utils.LabelsForUStore("ustore"),
+			OwnerReferences: []metav1.OwnerReference{
+				{APIVersion: unumv1alpha1.GroupVersion.String(), Kind: "UStore", Name: "ustore", UID: "uid"},
+				other,
+			},
+		},
+	}
+	scheme := testScheme(t)
+	r := &UStoreReconciler{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(ustoreResource.DeepCopy(), pvc).Build(), Scheme: scheme}
+
+	if _, err := r.finalizeUStore(ctx, ustoreResource); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	found := &corev1.PersistentVolumeClaim{}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(pvc), found); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(found.OwnerReferences) != 1 || found.OwnerReferences[0].UID != other.UID {
+		t.Errorf("expected only the other owner to be left, got %v", found.OwnerReferences)
+	}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(ustoreResource), &unumv1alpha1.UStore{}); !errors.IsNotFound(err) {
+		t.Errorf("expected the UStore to be deleted once the finalizer is removed, got %v", err)
+	}
+}
+
+func TestFinalizeUStoreSnapshot(t *testing.T) {
+	ctx := context.Background()
+	ustoreResource := deletingUStore(unumv1alpha1.PersistenceRetentionSnapshot)
+	replicas := int32(1)
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "ustore", Namespace: "default"},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "ustore-0", Namespace: "default", Labels: utils.LabelsForUStore("ustore")},
+	}
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "ustore-mnt-ustore-volume",
+			Namespace:  "default",
+			Labels:     utils.LabelsForUStore("ustore"),
+			Finalizers: []string{ustore_retention_finalizer},
+		},
+	}
+	scheme := testScheme(t)
+	r := &UStoreReconciler{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(ustoreResource.DeepCopy(), deployment, pod, pvc).Build(), Scheme: scheme}
+	snapshotKey := types.NamespacedName{
+		Name:      fmt.Sprintf("ustore-final-%d", ustoreResource.DeletionTimestamp.Unix()),
+		Namespace: "default",
+	}
+
+	// the pods are stopped first
+	result, err := r.finalizeUStore(ctx, ustoreResource)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.RequeueAfter != retentionPollInterval {
+		t.Errorf("expected a requeue after %s, got %s", retentionPollInterval, result.RequeueAfter)
+	}
+	foundDeployment := &appsv1.Deployment{}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(deployment), foundDeployment); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *foundDeployment.Spec.Replicas != 0 {
+		t.Errorf("expected the Deployment to be scaled to zero, got %d replicas", *foundDeployment.Spec.Replicas)
+	}
+	if err := r.Get(ctx, snapshotKey, &unumv1alpha1.UStoreSnapshot{}); !errors.IsNotFound(err) {
+		t.Errorf("expected no snapshot while the pods run, got %v", err)
+	}
+
+	// then snapshotted
+	if err := r.Delete(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.finalizeUStore(ctx, ustoreResource); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	snapshot := &unumv1alpha1.UStoreSnapshot{}
+	if err := r.Get(ctx, snapshotKey, snapshot); err != nil {
+		t.Fatalf("expected the final snapshot, got %v", err)
+	}
+	if snapshot.Spec.UStoreName != "ustore" || len(snapshot.OwnerReferences) != 0 {
+		t.Errorf("expected a snapshot of the UStore outliving it, got %+v", snapshot)
+	}
+
+	// and the deletion proceeds once the snapshot completed
+	snapshot.Status.Phase = unumv1alpha1.PhaseCompleted
+	if err := r.Update(ctx, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.finalizeUStore(ctx, ustoreResource); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(ustoreResource), &unumv1alpha1.UStore{}); !errors.IsNotFound(err) {
+		t.Errorf("expected the UStore to be deleted once the finalizer is removed, got %v", err)
+	}
+	foundClaim := &corev1.PersistentVolumeClaim{}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(pvc), foundClaim); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if controllerutil.ContainsFinalizer(foundClaim, ustore_retention_finalizer) {
+		t.Errorf("expected the claim to be released after the final snapshot, got %v", foundClaim.Finalizers)
+	}
+}
+
+func TestReconcileClaimFinalizers(t *testing.T) {
+	ctx := context.Background()
+	ustoreResource := deletingUStore(unumv1alpha1.PersistenceRetentionSnapshot)
+	ustoreResource.DeletionTimestamp = nil
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "ustore-mnt-ustore-volume", Namespace: "default", Labels: utils.LabelsForUStore("ustore")},
+	}
+	scheme := testScheme(t)
+	r := &UStoreReconciler{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(ustoreResource.DeepCopy(), pvc).Build(), Scheme: scheme}
+
+	// the Snapshot policy protects the claims
+	if err := r.reconcileRetentionFinalizer(ctx, ustoreResource); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	found := &corev1.PersistentVolumeClaim{}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(pvc), found); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !controllerutil.ContainsFinalizer(found, ustore_retention_finalizer) {
+		t.Errorf("expected the claim to get the retention finalizer, got %v", found.Finalizers)
+	}
+
+	// and releases them when the policy changes
+	ustoreResource.Spec.PersistenceRetention = unumv1alpha1.PersistenceRetentionRetain
+	if err := r.reconcileRetentionFinalizer(ctx, ustoreResource); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(pvc), found); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if controllerutil.ContainsFinalizer(found, ustore_retention_finalizer) {
+		t.Errorf("expected the retention finalizer to be removed, got %v", found.Finalizers)
+	}
+}
@@ -0,0 +1,82 @@
+package controllers
+
+import (
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// servesSecurityContextConstraints reports whether the cluster serves OpenShift SecurityContextConstraints.
+func servesSecurityContextConstraints(mgr ctrl.Manager) bool {
+	sccKind := schema.GroupKind{Group: "security.openshift.io", Kind: "SecurityContextConstraints"}
+	_, err := mgr.GetRESTMapper().RESTMapping(sccKind, "v1")
+	return err == nil
+}
+
+// podSecurityContextForUStore returns spec.podSecurityContext, or one meeting the restricted Pod Security Standard.
+// On OpenShift the user and fsGroup are left to the SCC, which assigns them from the namespace range.
+func podSecurityContextForUStore(ustoreResource *unumv1alpha1.UStore, openShift bool) *corev1.PodSecurityContext {
+	if ustoreResource.Spec.PodSecurityContext != nil {
+		return ustoreResource.Spec.PodSecurityContext
+	}
+	runAsNonRoot := true
+	securityContext := &corev1.PodSecurityContext{
+		RunAsNonRoot: &runAsNonRoot,
+		SeccompProfile: &corev1.SeccompProfile{
+			Type: corev1.SeccompProfileTypeRuntimeDefault,
+		},
+	}
+	if !openShift {
+		user := int64(ustore_run_as_user)
+		securityContext.RunAsUser = &user
+		securityContext.RunAsGroup = &user
+		// the volumes are made writable by the group, only chowned when their root is not
+		securityContext.FSGroup = &user
+		fsGroupChangePolicy := corev1.FSGroupChangeOnRootMismatch
+		securityContext.FSGroupChangePolicy = &fsGroupChangePolicy
+	}
+	return securityContext
+}
+
+// containerSecurityContextForUStore returns spec.containerSecurityContext, or one without privilege
+// escalation, capabilities or a writable root file system.
+func containerSecurityContextForUStore(ustoreResource *unumv1alpha1.UStore) *corev1.SecurityContext {
+	if ustoreResource.Spec.ContainerSecurityContext != nil {
+		return ustoreResource.Spec.ContainerSecurityContext
+	}
+	return restrictedContainerSecurityContext()
+}
+
+// restrictedContainerSecurityContext returns a security context without privilege escalation,
+// capabilities or a writable root file system.
+func restrictedContainerSecurityContext() *corev1.SecurityContext {
+	allowPrivilegeEscalation := false
+	readOnlyRootFilesystem := true
+	return &corev1.SecurityContext{
+		AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+		ReadOnlyRootFilesystem:   &readOnlyRootFilesystem,
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+		},
+	}
+}
+
+// addScratchVolumes mounts writable emptyDirs for temporary files and, for engines without
+// volumes, the data directory, as the root file system is read only. The data directory is
+// below the workdir, so the server binary in the image workdir stays visible.
+func addScratchVolumes(ustoreResource *unumv1alpha1.UStore, volumes []corev1.Volume, volumeMounts []corev1.VolumeMount) ([]corev1.Volume, []corev1.VolumeMount) {
+	volumes = append(volumes, corev1.Volume{
+		Name:         ustore_tmp_volume_name,
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+	})
+	volumeMounts = append(volumeMounts, corev1.VolumeMount{Name: ustore_tmp_volume_name, MountPath: "/tmp"})
+	if len(ustoreResource.Spec.Volumes) == 0 {
+		volumes = append(volumes, corev1.Volume{
+			Name:         ustore_workdir_volume_name,
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		})
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{Name: ustore_workdir_volume_name, MountPath: ustore_data_dir})
+	}
+	return volumes, volumeMounts
+}
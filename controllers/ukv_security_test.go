@@ -0,0 +1,103 @@
+package controllers
+
+import (
+	"testing"
+
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+)
+
+func TestPodSecurityContextForUStore(t *testing.T) {
+	custom := &corev1.PodSecurityContext{RunAsUser: int64Ptr(0)}
+	tests := []struct {
+		name      string
+		openShift bool
+		spec      *corev1.PodSecurityContext
+		user      *int64
+	}{
+		{name: "default", user: int64Ptr(ustore_run_as_user)},
+		{name: "openshift assigns the user", openShift: true},
+		{name: "spec replaces the default", spec: custom, user: int64Ptr(0)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ustoreResource := &unumv1alpha1.UStore{Spec: unumv1alpha1.UStoreSpec{PodSecurityContext: test.spec}}
+			securityContext := podSecurityContextForUStore(ustoreResource, test.openShift)
+
+			if test.spec != nil {
+				if securityContext != test.spec {
+					t.Errorf("expected the spec security context, got %+v", securityContext)
+				}
+				return
+			}
+			if securityContext.RunAsNonRoot == nil || !*securityContext.RunAsNonRoot {
+				t.Errorf("expected runAsNonRoot, got %v", securityContext.RunAsNonRoot)
+			}
+			if securityContext.SeccompProfile == nil || securityContext.SeccompProfile.Type != corev1.SeccompProfileTypeRuntimeDefault {
+				t.Errorf("expected the RuntimeDefault seccomp profile, got %v", securityContext.SeccompProfile)
+			}
+			if !equality.Semantic.DeepEqual(securityContext.RunAsUser, test.user) || !equality.Semantic.DeepEqual(securityContext.FSGroup, test.user) {
+				t.Errorf("expected user and fsGroup %v, got %v and %v", test.user, securityContext.RunAsUser, securityContext.FSGroup)
+			}
+		})
+	}
+}
+
+func TestContainerSecurityContextForUStore(t *testing.T) {
+	securityContext := containerSecurityContextForUStore(&unumv1alpha1.UStore{})
+	if securityContext.AllowPrivilegeEscalation == nil || *securityContext.AllowPrivilegeEscalation {
+		t.Errorf("expected no privilege escalation, got %v", securityContext.AllowPrivilegeEscalation)
+	}
+	if securityContext.ReadOnlyRootFilesystem == nil || !*securityContext.ReadOnlyRootFilesystem {
+		t.Errorf("expected a read-only root file system, got %v", securityContext.ReadOnlyRootFilesystem)
+	}
+	if securityContext.Capabilities == nil || !equality.Semantic.DeepEqual(securityContext.Capabilities.Drop, []corev1.Capability{"ALL"}) {
+		t.Errorf("expected all capabilities dropped, got %v", securityContext.Capabilities)
+	}
+
+	custom := &corev1.SecurityContext{Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"IPC_LOCK"}}}
+	if securityContext := containerSecurityContextForUStore(&unumv1alpha1.UStore{Spec: unumv1alpha1.UStoreSpec{ContainerSecurityContext: custom}}); securityContext != custom {
+		t.Errorf("expected the spec security context, got %+v", securityContext)
+	}
+}
+
+func TestAddScratchVolumes(t *testing.T) {
+	tests := []struct {
+		name     string
+		volumes  []unumv1alpha1.Persistence
+		expected []corev1.VolumeMount
+	}{
+		{
+			name: "in-memory engine",
+			expected: []corev1.VolumeMount{
+				{Name: ustore_tmp_volume_name, MountPath: "/tmp"},
+				{Name: ustore_workdir_volume_name, MountPath: ustore_data_dir},
+			},
+		},
+		{
+			name:     "persistent volumes",
+			volumes:  []unumv1alpha1.Persistence{{MountPath: "/mnt/ustore", Size: "1Gi"}},
+			expected: []corev1.VolumeMount{{Name: ustore_tmp_volume_name, MountPath: "/tmp"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ustoreResource := &unumv1alpha1.UStore{Spec: unumv1alpha1.UStoreSpec{Volumes: test.volumes}}
+			volumes, volumeMounts := addScratchVolumes(ustoreResource, nil, nil)
+			if !equality.Semantic.DeepEqual(volumeMounts, test.expected) {
+				t.Errorf("expected mounts %v, got %v", test.expected, volumeMounts)
+			}
+			if len(volumes) != len(test.expected) {
+				t.Fatalf("expected %d volumes, got %d", len(test.expected), len(volumes))
+			}
+			for _, volume := range volumes {
+				if volume.EmptyDir == nil {
+					t.Errorf("%s: expected an emptyDir, got %+v", volume.Name, volume.VolumeSource)
+				}
+			}
+		})
+	}
+}
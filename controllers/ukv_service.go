@@ -3,10 +3,13 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 
 	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
 	"github.com/opdev/ustore-operator/controllers/utils"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
@@ -19,48 +22,96 @@ import (
 func (r *UStoreReconciler) reconcileService(ctx context.Context, ustoreResource *unumv1alpha1.UStore) error {
 	logger := log.FromContext(ctx)
 	foundSvc := &corev1.Service{}
+	desiredService := r.serviceForUStore(ustoreResource)
 	err := r.Get(ctx, types.NamespacedName{Name: ustoreResource.Name, Namespace: ustoreResource.Namespace}, foundSvc)
 	if err != nil && errors.IsNotFound(err) {
 		// A new service needs to be created
-		desiredService := r.serviceForUStore(ustoreResource)
 		logger.Info("Creating a new Service", "Service.Namespace", desiredService.Namespace, "Service.Name", desiredService.Name)
 		err = r.Create(ctx, desiredService)
 		if err != nil {
 			logger.Error(err, "Failed to create new Service", "Service.Namespace", desiredService.Namespace, "Service.Name", desiredService.Name)
-			ustoreResource.Status.ServiceStatus = "Failed Creation"
-			_ = r.Status().Update(ctx, ustoreResource)
-			return err
-		}
-		// update status for service
-		ustoreResource.Status.ServiceUrl = fmt.Sprintf("%s.%s.svc.cluster.local:%s", desiredService.Name, desiredService.Namespace, strconv.Itoa(ustoreResource.Spec.DBServicePort))
-		ustoreResource.Status.ServiceStatus = "Successful"
-		err := r.Status().Update(ctx, ustoreResource)
-		if err != nil {
-			logger.Error(err, "Failed to update UStore Service status")
 			return err
 		}
+		setServiceStatus(ustoreResource, desiredService)
 		return nil // done creating a new service
+	} else if err != nil {
+		logger.Error(err, "Failed to get Service")
+		return err
 	}
 
-	if foundSvc.Spec.Ports[0].Port != int32(ustoreResource.Spec.DBServicePort) {
-		foundSvc.Spec.Ports[0].Port = int32(ustoreResource.Spec.DBServicePort)
-		foundSvc.Spec.Ports[0].TargetPort = intstr.FromInt(ustoreResource.Spec.DBServicePort)
+	current := foundSvc.DeepCopy()
+	mergeServiceSpec(foundSvc, desiredService)
+	if !equality.Semantic.DeepEqual(current.Spec, foundSvc.Spec) || !equality.Semantic.DeepEqual(current.Annotations, foundSvc.Annotations) {
 		err := r.Update(ctx, foundSvc)
 		if err != nil {
 			logger.Error(err, "Failed to update UStore Service")
-			ustoreResource.Status.ServiceStatus = "Failed"
-			_ = r.Status().Update(ctx, ustoreResource)
 			return err
 		}
-		// update the status to show the correct url
-		ustoreResource.Status.ServiceUrl = fmt.Sprintf("%s.%s.svc.cluster.local:%s", foundSvc.Name, foundSvc.Namespace, strconv.Itoa(ustoreResource.Spec.DBServicePort))
-		ustoreResource.Status.ServiceStatus = "Successful"
-		_ = r.Status().Update(ctx, ustoreResource)
 	}
+	// update the status to show the correct url
+	setServiceStatus(ustoreResource, foundSvc)
 
 	return nil
 }
 
+// mergeServiceSpec sets the fields of the desired Service on the found one, keeping the node port
+// allocated by the cluster when none is requested. Annotations set by others are kept, the ones
+// dropped from spec.service.annotations are removed.
+func mergeServiceSpec(found *corev1.Service, desired *corev1.Service) {
+	if managed := found.Annotations[ustore_managed_annotations_annotation]; managed != "" {
+		for _, key := range strings.Split(managed, ",") {
+			if _, kept := desired.Annotations[key]; !kept {
+				delete(found.Annotations, key)
+			}
+		}
+		delete(found.Annotations, ustore_managed_annotations_annotation)
+	}
+	for key, value := range desired.Annotations {
+		if found.Annotations == nil {
+			found.Annotations = map[string]string{}
+		}
+		found.Annotations[key] = value
+	}
+
+	port := desired.Spec.Ports[0]
+	if port.NodePort == 0 && desired.Spec.Type != corev1.ServiceTypeClusterIP && len(found.Spec.Ports) > 0 {
+		port.NodePort = found.Spec.Ports[0].NodePort
+	}
+	found.Spec.Ports = []corev1.ServicePort{port}
+	found.Spec.Type = desired.Spec.Type
+	found.Spec.Selector = desired.Spec.Selector
+	found.Spec.SessionAffinity = desired.Spec.SessionAffinity
+	found.Spec.ExternalTrafficPolicy = desired.Spec.ExternalTrafficPolicy
+	found.Spec.LoadBalancerSourceRanges = desired.Spec.LoadBalancerSourceRanges
+	if desired.Spec.Type != corev1.ServiceTypeLoadBalancer || desired.Spec.ExternalTrafficPolicy != corev1.ServiceExternalTrafficPolicyLocal {
+		// only allocated for local traffic through a load balancer
+		found.Spec.HealthCheckNodePort = 0
+	}
+}
+
+// setServiceStatus reports the address of the Service: the load balancer ingress once assigned,
+// the cluster DNS name otherwise.
+func setServiceStatus(ustoreResource *unumv1alpha1.UStore, service *corev1.Service) {
+	host := fmt.Sprintf("%s.%s.svc.cluster.local", service.Name, service.Namespace)
+	if service.Spec.Type == corev1.ServiceTypeLoadBalancer {
+		for _, ingress := range service.Status.LoadBalancer.Ingress {
+			if ingress.Hostname != "" {
+				host = ingress.Hostname
+				break
+			}
+			if ingress.IP != "" {
+				host = ingress.IP
+				break
+			}
+		}
+	}
+	ustoreResource.Status.ServiceUrl = fmt.Sprintf("%s:%s", host, strconv.Itoa(ustoreResource.Spec.DBServicePort))
+	ustoreResource.Status.NodePort = 0
+	if service.Spec.Type != corev1.ServiceTypeClusterIP && len(service.Spec.Ports) > 0 {
+		ustoreResource.Status.NodePort = service.Spec.Ports[0].NodePort
+	}
+}
+
 // serviceForUStore returns a UStore Service object
 func (r *UStoreReconciler) serviceForUStore(ustoreResource *unumv1alpha1.UStore) *corev1.Service {
 	service := &corev1.Service{
@@ -72,11 +123,88 @@ func (r *UStoreReconciler) serviceForUStore(ustoreResource *unumv1alpha1.UStore)
 				Port:       int32(ustoreResource.Spec.DBServicePort),
 				TargetPort: intstr.FromInt(ustoreResource.Spec.DBServicePort),
 			}},
-			Selector: utils.LabelsForUStore(ustoreResource.Name),
-			Type:     corev1.ServiceTypeClusterIP,
+			Selector:        utils.LabelsForUStore(ustoreResource.Name),
+			Type:            corev1.ServiceTypeClusterIP,
+			SessionAffinity: corev1.ServiceAffinityNone,
 		},
 	}
+	// the plaintext gRPC server only speaks HTTP/2, which routers proxying it must not downgrade to HTTP/1.1
+	appProtocol := ustore_service_app_protocol
+	service.Spec.Ports[0].AppProtocol = &appProtocol
+	if spec := ustoreResource.Spec.Service; spec != nil && len(spec.Annotations) > 0 {
+		service.Annotations = map[string]string{}
+		keys := []string{}
+		for key, value := range spec.Annotations {
+			service.Annotations[key] = value
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		// records the annotations to remove once dropped from the spec
+		service.Annotations[ustore_managed_annotations_annotation] = strings.Join(keys, ",")
+	}
+	if spec := ustoreResource.Spec.Service; spec != nil {
+		if spec.Type != "" {
+			service.Spec.Type = spec.Type
+		}
+		if spec.SessionAffinity != "" {
+			service.Spec.SessionAffinity = spec.SessionAffinity
+		}
+		if service.Spec.Type != corev1.ServiceTypeClusterIP {
+			service.Spec.Ports[0].NodePort = spec.NodePort
+			service.Spec.ExternalTrafficPolicy = spec.ExternalTrafficPolicy
+			if service.Spec.ExternalTrafficPolicy == "" {
+				service.Spec.ExternalTrafficPolicy = corev1.ServiceExternalTrafficPolicyCluster
+			}
+		}
+		if service.Spec.Type == corev1.ServiceTypeLoadBalancer {
+			service.Spec.LoadBalancerSourceRanges = spec.LoadBalancerSourceRanges
+		}
+	}
 	// Set UStore instance as the owner and controller
 	ctrl.SetControllerReference(ustoreResource, service, r.Scheme)
 	return service
 }
+
+func (r *UStoreReconciler) reconcileHeadlessService(ctx context.Context, ustoreResource *unumv1alpha1.UStore) error {
+	logger := log.FromContext(ctx)
+	foundSvc := &corev1.Service{}
+	err := r.Get(ctx, types.NamespacedName{Name: headlessServiceName(ustoreResource), Namespace: ustoreResource.Namespace}, foundSvc)
+	if err != nil && errors.IsNotFound(err) {
+		desiredService := r.headlessServiceForUStore(ustoreResource)
+		logger.Info("Creating a new headless Service", "Service.Namespace", desiredService.Namespace, "Service.Name", desiredService.Name)
+		if err := r.Create(ctx, desiredService); err != nil {
+			logger.Error(err, "Failed to create new headless Service", "Service.Namespace", desiredService.Namespace, "Service.Name", desiredService.Name)
+			return err
+		}
+		return nil
+	} else if err != nil {
+		logger.Error(err, "Failed to get headless Service")
+		return err
+	}
+
+	if foundSvc.Spec.Ports[0].Port != int32(ustoreResource.Spec.DBServicePort) {
+		foundSvc.Spec.Ports[0].Port = int32(ustoreResource.Spec.DBServicePort)
+		foundSvc.Spec.Ports[0].TargetPort = intstr.FromInt(ustoreResource.Spec.DBServicePort)
+		if err := r.Update(ctx, foundSvc); err != nil {
+			logger.Error(err, "Failed to update UStore headless Service")
+			return err
+		}
+	}
+	return nil
+}
+
+// headlessServiceForUStore returns the headless Service that gives StatefulSet replicas a stable DNS name
+func (r *UStoreReconciler) headlessServiceForUStore(ustoreResource *unumv1alpha1.UStore) *corev1.Service {
+	ustoreResource = ustoreResource.DeepCopy()
+	// spec.service only applies to the client facing Service
+	ustoreResource.Spec.Service = nil
+	service := r.serviceForUStore(ustoreResource)
+	service.Name = headlessServiceName(ustoreResource)
+	service.Spec.ClusterIP = corev1.ClusterIPNone
+	service.Spec.PublishNotReadyAddresses = true
+	return service
+}
+
+func headlessServiceName(ustoreResource *unumv1alpha1.UStore) string {
+	return ustoreResource.Name + "-headless"
+}
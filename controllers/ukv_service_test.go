@@ -0,0 +1,149 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMergeServiceSpec(t *testing.T) {
+	tests := []struct {
+		name                string
+		found               corev1.Service
+		service             *unumv1alpha1.ServiceSpec
+		expectedAnnotations map[string]string
+		expectedNodePort    int32
+		expectedHealthCheck int32
+	}{
+		{
+			name: "annotations added next to foreign ones",
+			found: corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"other": "kept"}},
+			},
+			service: &unumv1alpha1.ServiceSpec{Annotations: map[string]string{"b": "2", "a": "1"}},
+			expectedAnnotations: map[string]string{
+				"other": "kept", "a": "1", "b": "2",
+				ustore_managed_annotations_annotation: "a,b",
+			},
+		},
+		{
+			name: "annotations dropped from the spec are removed",
+			found: corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+					"other": "kept", "a": "1", "b": "2",
+					ustore_managed_annotations_annotation: "a,b",
+				}},
+			},
+			service: &unumv1alpha1.ServiceSpec{Annotations: map[string]string{"a": "changed"}},
+			expectedAnnotations: map[string]string{
+				"other": "kept", "a": "changed",
+				ustore_managed_annotations_annotation: "a",
+			},
+		},
+		{
+			name: "every managed annotation removed",
+			found: corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+					"other": "kept", "a": "1",
+					ustore_managed_annotations_annotation: "a",
+				}},
+			},
+			expectedAnnotations: map[string]string{"other": "kept"},
+		},
+		{
+			name: "allocated node port kept",
+			found: corev1.Service{
+				Spec: corev1.ServiceSpec{
+					Type:  corev1.ServiceTypeNodePort,
+					Ports: []corev1.ServicePort{{NodePort: 30001}},
+				},
+			},
+			service:          &unumv1alpha1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+			expectedNodePort: 30001,
+		},
+		{
+			name: "requested node port",
+			found: corev1.Service{
+				Spec: corev1.ServiceSpec{
+					Type:  corev1.ServiceTypeNodePort,
+					Ports: []corev1.ServicePort{{NodePort: 30001}},
+				},
+			},
+			service:          &unumv1alpha1.ServiceSpec{Type: corev1.ServiceTypeNodePort, NodePort: 30002},
+			expectedNodePort: 30002,
+		},
+		{
+			name: "node port released by ClusterIP",
+			found: corev1.Service{
+				Spec: corev1.ServiceSpec{
+					Type:                corev1.ServiceTypeLoadBalancer,
+					Ports:               []corev1.ServicePort{{NodePort: 30001}},
+					HealthCheckNodePort: 30003,
+				},
+			},
+			service: &unumv1alpha1.ServiceSpec{Type: corev1.ServiceTypeClusterIP},
+		},
+		{
+			name: "health check node port kept for local traffic",
+			found: corev1.Service{
+				Spec: corev1.ServiceSpec{
+					Type:                corev1.ServiceTypeLoadBalancer,
+					Ports:               []corev1.ServicePort{{NodePort: 30001}},
+					HealthCheckNodePort: 30003,
+				},
+			},
+			service: &unumv1alpha1.ServiceSpec{
+				Type:                  corev1.ServiceTypeLoadBalancer,
+				ExternalTrafficPolicy: corev1.ServiceExternalTrafficPolicyLocal,
+			},
+			expectedNodePort:    30001,
+			expectedHealthCheck: 30003,
+		},
+	}
+
+	r := &UStoreReconciler{Scheme: testScheme(t)}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ustoreResource := &unumv1alpha1.UStore{
+				ObjectMeta: metav1.ObjectMeta{Name: "ustore", Namespace: "default"},
+				Spec:       unumv1alpha1.UStoreSpec{DBServicePort: 8081, Service: test.service},
+			}
+			desired := r.serviceForUStore(ustoreResource)
+			found := test.found.DeepCopy()
+			mergeServiceSpec(found, desired)
+
+			if len(found.Annotations) > 0 || len(test.expectedAnnotations) > 0 {
+				if !reflect.DeepEqual(found.Annotations, test.expectedAnnotations) {
+					t.Errorf("expected annotations %v, got %v", test.expectedAnnotations, found.Annotations)
+				}
+			}
+			if found.Spec.Type != desired.Spec.Type {
+				t.Errorf("expected type %s, got %s", desired.Spec.Type, found.Spec.Type)
+			}
+			if len(found.Spec.Ports) != 1 || found.Spec.Ports[0].Port != 8081 {
+				t.Fatalf("expected port 8081, got %v", found.Spec.Ports)
+			}
+			if nodePort := found.Spec.Ports[0].NodePort; nodePort != test.expectedNodePort {
+				t.Errorf("expected node port %d, got %d", test.expectedNodePort, nodePort)
+			}
+			if found.Spec.HealthCheckNodePort != test.expectedHealthCheck {
+				t.Errorf("expected health check node port %d, got %d", test.expectedHealthCheck, found.Spec.HealthCheckNodePort)
+			}
+		})
+	}
+}
+
+func TestServiceAppProtocol(t *testing.T) {
+	r := &UStoreReconciler{Scheme: testScheme(t)}
+	ustoreResource := &unumv1alpha1.UStore{
+		ObjectMeta: metav1.ObjectMeta{Name: "ustore", Namespace: "default"},
+		Spec:       unumv1alpha1.UStoreSpec{DBServicePort: 8081},
+	}
+	port := r.serviceForUStore(ustoreResource).Spec.Ports[0]
+	if !reflect.DeepEqual(port.AppProtocol, stringPtr(ustore_service_app_protocol)) {
+		t.Errorf("expected appProtocol %s, got %v", ustore_service_app_protocol, port.AppProtocol)
+	}
+}
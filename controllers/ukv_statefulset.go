@@ -0,0 +1,199 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/imdario/mergo"
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+	"github.com/opdev/ustore-operator/controllers/utils"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func isStatefulSet(ustoreResource *unumv1alpha1.UStore) bool {
+	return ustoreResource.Spec.WorkloadKind == unumv1alpha1.WorkloadKindStatefulSet
+}
+
+func (r *UStoreReconciler) reconcileStatefulSet(ctx context.Context, ustoreResource *unumv1alpha1.UStore, configHash string) error {
+	logger := log.FromContext(ctx)
+	found := &appsv1.StatefulSet{}
+	desiredStatefulSet, err := r.statefulSetForUStore(ustoreResource, configHash)
+	if err != nil {
+		logger.Error(err, "Failed to define StatefulSet")
+		return err
+	}
+	err = r.Get(ctx, types.NamespacedName{Name: ustoreResource.Name, Namespace: ustoreResource.Namespace}, found)
+	if err != nil && errors.IsNotFound(err) {
+		// A new statefulset needs to be created
+		logger.Info("Creating a new StatefulSet", "StatefulSet.Namespace", desiredStatefulSet.Namespace, "StatefulSet.Name", desiredStatefulSet.Name)
+		err = r.Create(ctx, desiredStatefulSet)
+		if err != nil {
+			logger.Error(err, "Failed to create new StatefulSet", "StatefulSet.Namespace", desiredStatefulSet.Namespace, "StatefulSet.Name", desiredStatefulSet.Name)
+			return err
+		}
+		ustoreResource.Status.StatefulSetName = desiredStatefulSet.Name
+		return nil
+	} else if err != nil {
+		logger.Error(err, "Failed to get StatefulSet")
+		return err
+	}
+
+	if !found.DeletionTimestamp.IsZero() {
+		// re-created once the orphaning delete below completes
+		return nil
+	}
+	if claimTemplatesChanged(found.Spec.VolumeClaimTemplates, desiredStatefulSet.Spec.VolumeClaimTemplates) {
+		// volumeClaimTemplates are immutable. Without the new templates, the pods would mount claims no
+		// template provides and scaled up replicas would get claims of the old size, so the StatefulSet is
+		// deleted leaving its pods and claims, and the new one adopts them.
+		logger.Info("Re-creating StatefulSet to update its volumeClaimTemplates", "StatefulSet.Namespace", found.Namespace, "StatefulSet.Name", found.Name)
+		if err := r.Delete(ctx, found, client.PropagationPolicy(metav1.DeletePropagationOrphan)); err != nil && !errors.IsNotFound(err) {
+			logger.Error(err, "Failed to delete StatefulSet", "StatefulSet.Namespace", found.Namespace, "StatefulSet.Name", found.Name)
+			return err
+		}
+		return nil
+	}
+	// volumeClaimTemplates are immutable, keep the ones the StatefulSet was created with.
+	desiredStatefulSet.Spec.VolumeClaimTemplates = found.Spec.VolumeClaimTemplates
+
+	// patch only if there is a difference between desired and current.
+	patchDiff := client.MergeFrom(found.DeepCopyObject().(client.Object))
+	if err := mergo.Merge(found, desiredStatefulSet, mergo.WithOverride); err != nil {
+		logger.Error(err, "Error in merge")
+		return err
+	}
+	// mergo does not override with zero values, scaling to zero needs an explicit assignment.
+	found.Spec.Replicas = desiredStatefulSet.Spec.Replicas
+	// nor does it remove fields, the pod template is owned by the operator and replaced as a whole
+	// so cleared tolerations, affinity or volumes are dropped.
+	found.Spec.Template = desiredStatefulSet.Spec.Template
+
+	if err := r.Patch(ctx, found, patchDiff); err != nil {
+		logger.Error(err, "Failed to update StatefulSet to desired state", "StatefulSet.Namespace", found.Namespace, "StatefulSet.Name", found.Name)
+		return err
+	}
+
+	ustoreResource.Status.StatefulSetName = desiredStatefulSet.Name
+	return nil
+}
+
+// statefulSetForUStore returns a UStore StatefulSet object with a claim template per requested volume
+func (r *UStoreReconciler) statefulSetForUStore(ustoreResource *unumv1alpha1.UStore, configHash string) (*appsv1.StatefulSet, error) {
+	labels := utils.LabelsForUStore(ustoreResource.Name)
+	replicas := desiredReplicas(ustoreResource)
+	claimTemplates, err := claimTemplatesForUStore(ustoreResource)
+	if err != nil {
+		return nil, err
+	}
+
+	statefulSetSpec := appsv1.StatefulSetSpec{
+		Replicas: &replicas,
+		Selector: &metav1.LabelSelector{
+			MatchLabels: labels,
+		},
+		ServiceName:          headlessServiceName(ustoreResource),
+		PodManagementPolicy:  appsv1.ParallelPodManagement,
+		Template:             r.podTemplateForUStore(ustoreResource, configHash),
+		VolumeClaimTemplates: claimTemplates,
+		PersistentVolumeClaimRetentionPolicy: &appsv1.StatefulSetPersistentVolumeClaimRetentionPolicy{
+			WhenDeleted: claimRetentionWhenDeleted(ustoreResource),
+			WhenScaled:  appsv1.RetainPersistentVolumeClaimRetentionPolicyType,
+		},
+	}
+
+	statefulSet := &appsv1.StatefulSet{
+		ObjectMeta: utils.SetObjectMeta(ustoreResource.Name, ustoreResource.Namespace, map[string]string{}),
+		Spec:       statefulSetSpec,
+	}
+
+	// Set UStore instance as the owner and controller
+	ctrl.SetControllerReference(ustoreResource, statefulSet, r.Scheme)
+	return statefulSet, nil
+}
+
+func claimTemplatesForUStore(ustoreResource *unumv1alpha1.UStore) ([]corev1.PersistentVolumeClaim, error) {
+	templates := []corev1.PersistentVolumeClaim{}
+	for _, volume := range ustoreResource.Spec.Volumes {
+		objectMeta := claimMetaForVolume(ustoreResource, claimTemplateNameForVolume(volume), volume)
+		// the StatefulSet controller creates the claims in its own namespace
+		objectMeta.Namespace = ""
+		claimSpec, err := claimSpecForVolume(volume)
+		if err != nil {
+			return nil, err
+		}
+		template := corev1.PersistentVolumeClaim{
+			ObjectMeta: objectMeta,
+			Spec:       claimSpec,
+		}
+		templates = append(templates, template)
+	}
+	return templates, nil
+}
+
+// claimTemplatesChanged reports whether volumes were added to or removed from the desired claim
+// templates, or a desired template requests more storage than the existing one of the same name.
+func claimTemplatesChanged(templates []corev1.PersistentVolumeClaim, desiredTemplates []corev1.PersistentVolumeClaim) bool {
+	if len(templates) != len(desiredTemplates) {
+		return true
+	}
+	sizes := map[string]resource.Quantity{}
+	for _, template := range templates {
+		sizes[template.Name] = template.Spec.Resources.Requests[corev1.ResourceStorage]
+	}
+	for _, template := range desiredTemplates {
+		size, found := sizes[template.Name]
+		if !found {
+			return true
+		}
+		desiredSize := template.Spec.Resources.Requests[corev1.ResourceStorage]
+		if desiredSize.Cmp(size) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func addClaimTemplateMounts(ustoreResource *unumv1alpha1.UStore, volumeMounts []corev1.VolumeMount, volumeDevices []corev1.VolumeDevice) ([]corev1.VolumeMount, []corev1.VolumeDevice) {
+	for _, volume := range ustoreResource.Spec.Volumes {
+		if isBlockVolume(volume) {
+			volumeDevices = append(volumeDevices, corev1.VolumeDevice{
+				Name:       claimTemplateNameForVolume(volume),
+				DevicePath: volume.MountPath,
+			})
+			continue
+		}
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      claimTemplateNameForVolume(volume),
+			MountPath: volume.MountPath,
+		})
+	}
+	return volumeMounts, volumeDevices
+}
+
+// claimTemplateNameForVolume returns the volumeClaimTemplate name for the given UStore volume.
+func claimTemplateNameForVolume(volume unumv1alpha1.Persistence) string {
+	return "data-" + volumeDirName(volume)
+}
+
+// volumeDirName returns the mount path of a volume as a single path element, e.g. mnt-disk1.
+func volumeDirName(volume unumv1alpha1.Persistence) string {
+	return strings.Trim(strings.ReplaceAll(volume.MountPath, "/", "-"), "-")
+}
+
+// statefulSetClaimNames returns the names of the PVCs the StatefulSet controller creates for a volume.
+func statefulSetClaimNames(ustoreResource *unumv1alpha1.UStore, volume unumv1alpha1.Persistence) []string {
+	names := []string{}
+	for i := int32(0); i < ustoreResource.Spec.NumOfInstances; i++ {
+		names = append(names, fmt.Sprintf("%s-%s-%d", claimTemplateNameForVolume(volume), ustoreResource.Name, i))
+	}
+	return names
+}
@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestClaimTemplatesChanged(t *testing.T) {
+	template := func(name string, size string) corev1.PersistentVolumeClaim {
+		return corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(size)},
+				},
+			},
+		}
+	}
+	tests := []struct {
+		name      string
+		templates []corev1.PersistentVolumeClaim
+		desired   []corev1.PersistentVolumeClaim
+		expected  bool
+	}{
+		{
+			name:      "unchanged",
+			templates: []corev1.PersistentVolumeClaim{template("data-a", "1Gi"), template("data-b", "1Gi")},
+			desired:   []corev1.PersistentVolumeClaim{template("data-b", "1Gi"), template("data-a", "1Gi")},
+		},
+		{
+			name:      "grown",
+			templates: []corev1.PersistentVolumeClaim{template("data-a", "1Gi")},
+			desired:   []corev1.PersistentVolumeClaim{template("data-a", "2Gi")},
+			expected:  true,
+		},
+		{
+			name:      "added",
+			templates: []corev1.PersistentVolumeClaim{template("data-a", "1Gi")},
+			desired:   []corev1.PersistentVolumeClaim{template("data-a", "1Gi"), template("data-b", "1Gi")},
+			expected:  true,
+		},
+		{
+			name:      "removed",
+			templates: []corev1.PersistentVolumeClaim{template("data-a", "1Gi"), template("data-b", "1Gi")},
+			desired:   []corev1.PersistentVolumeClaim{template("data-a", "1Gi")},
+			expected:  true,
+		},
+		{
+			name:      "replaced",
+			templates: []corev1.PersistentVolumeClaim{template("data-a", "1Gi")},
+			desired:   []corev1.PersistentVolumeClaim{template("data-b", "1Gi")},
+			expected:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if changed := claimTemplatesChanged(test.templates, test.desired); changed != test.expected {
+				t.Errorf("expected changed %t, got %t", test.expected, changed)
+			}
+		})
+	}
+}
+
+func TestReconcileStatefulSetAddedVolume(t *testing.T) {
+	ctx := context.Background()
+	ustoreResource := &unumv1alpha1.UStore{
+		ObjectMeta: metav1.ObjectMeta{Name: "ustore", Namespace: "default", UID: "uid"},
+		Spec: unumv1alpha1.UStoreSpec{
+			DBType:         "rocksdb",
+			DBServicePort:  8081,
+			NumOfInstances: 2,
+			WorkloadKind:   unumv1alpha1.WorkloadKindStatefulSet,
+			Volumes:        []unumv1alpha1.Persistence{{MountPath: "/mnt/ustore", Size: "1Gi", AccessMode: "ReadWriteOnce"}},
+		},
+	}
+	scheme := testScheme(t)
+	r := &UStoreReconciler{Client: fake.NewClientBuilder().WithScheme(scheme).Build(), Scheme: scheme, Images: Images{}.withDefaults()}
+	key := types.NamespacedName{Name: "ustore", Namespace: "default"}
+
+	if err := r.reconcileStatefulSet(ctx, ustoreResource, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the added volume re-creates the StatefulSet instead of mounting a claim no template provides
+	ustoreResource.Spec.Volumes = append(ustoreResource.Spec.Volumes, unumv1alpha1.Persistence{MountPath: "/mnt/wal", Size: "1Gi", AccessMode: "ReadWriteOnce"})
+	if err := r.reconcileStatefulSet(ctx, ustoreResource, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := r.Get(ctx, key, &appsv1.StatefulSet{}); !errors.IsNotFound(err) {
+		t.Fatalf("expected the StatefulSet to be deleted, got %v", err)
+	}
+
+	if err := r.reconcileStatefulSet(ctx, ustoreResource, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	found := &appsv1.StatefulSet{}
+	if err := r.Get(ctx, key, found); err != nil {
+		t.Fatalf("expected the StatefulSet to be re-created, got %v", err)
+	}
+	templates := map[string]bool{}
+	for _, template := range found.Spec.VolumeClaimTemplates {
+		templates[template.Name] = true
+	}
+	if len(templates) != 2 {
+		t.Errorf("expected a claim template per volume, got %v", templates)
+	}
+	for _, volumeMount := range found.Spec.Template.Spec.Containers[0].VolumeMounts {
+		if volumeMount.Name == ustore_config_name || volumeMount.Name == ustore_tmp_volume_name {
+			continue
+		}
+		if !templates[volumeMount.Name] {
+			t.Errorf("expected mount %s to have a claim template", volumeMount.Name)
+		}
+	}
+}
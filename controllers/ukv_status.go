@@ -0,0 +1,303 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// updateStatus computes the UStore conditions from the observed state of the
+// owned resources and writes them to the status subresource.
+// reconcileErr is the error, if any, returned by the preceding reconcile steps.
+func (r *UStoreReconciler) updateStatus(ctx context.Context, ustoreResource *unumv1alpha1.UStore, reconcileErr error) error {
+	logger := log.FromContext(ctx)
+	generation := ustoreResource.Generation
+	conditions := &ustoreResource.Status.Conditions
+
+	configCondition, err := r.configCondition(ctx, ustoreResource)
+	if err != nil {
+		return err
+	}
+	configCondition.ObservedGeneration = generation
+	meta.SetStatusCondition(conditions, configCondition)
+
+	storageCondition, err := r.storageCondition(ctx, ustoreResource)
+	if err != nil {
+		return err
+	}
+	storageCondition.ObservedGeneration = generation
+	meta.SetStatusCondition(conditions, storageCondition)
+
+	resizeCondition := storageResizeCondition(ustoreResource)
+	resizeCondition.ObservedGeneration = generation
+	meta.SetStatusCondition(conditions, resizeCondition)
+
+	availableCondition, progressingCondition, workloadFailure, err := r.workloadConditions(ctx, ustoreResource)
+	if err != nil {
+		return err
+	}
+
+	service := &corev1.Service{}
+	err = r.Get(ctx, types.NamespacedName{Name: ustoreResource.Name, Namespace: ustoreResource.Namespace}, service)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	serviceFound := err == nil
+
+	if availableCondition.Status == metav1.ConditionTrue && !serviceFound {
+		availableCondition = metav1.Condition{Type: unumv1alpha1.ConditionAvailable, Status: metav1.ConditionFalse, Reason: "ServiceNotFound", Message: "Service has not been created yet"}
+	}
+	availableCondition.ObservedGeneration = generation
+	progressingCondition.ObservedGeneration = generation
+	meta.SetStatusCondition(conditions, availableCondition)
+	meta.SetStatusCondition(conditions, progressingCondition)
+
+	degradedCondition := metav1.Condition{Type: unumv1alpha1.ConditionDegraded, Status: metav1.ConditionFalse, Reason: "AsExpected", Message: "UStore reconciled successfully"}
+	switch {
+	case reconcileErr != nil:
+		degradedCondition = metav1.Condition{Type: unumv1alpha1.ConditionDegraded, Status: metav1.ConditionTrue, Reason: "ReconcileFailed", Message: reconcileErr.Error()}
+	case configCondition.Status == metav1.ConditionFalse:
+		degradedCondition = metav1.Condition{Type: unumv1alpha1.ConditionDegraded, Status: metav1.ConditionTrue, Reason: configCondition.Reason, Message: configCondition.Message}
+	case resizeCondition.Reason == unumv1alpha1.ResizeStatusShrinkNotSupported || resizeCondition.Reason == unumv1alpha1.ResizeStatusExpansionNotAllowed:
+		degradedCondition = metav1.Condition{Type: unumv1alpha1.ConditionDegraded, Status: metav1.ConditionTrue, Reason: resizeCondition.Reason, Message: resizeCondition.Message}
+	case progressingCondition.Reason == "ProgressDeadlineExceeded":
+		degradedCondition = metav1.Condition{Type: unumv1alpha1.ConditionDegraded, Status: metav1.ConditionTrue, Reason: progressingCondition.Reason, Message: progressingCondition.Message}
+	case ustoreResource.Status.UpgradePhase == unumv1alpha1.UpgradePhaseFailed || ustoreResource.Status.UpgradePhase == unumv1alpha1.UpgradePhaseRolledBack:
+		degradedCondition = metav1.Condition{Type: unumv1alpha1.ConditionDegraded, Status: metav1.ConditionTrue, Reason: "Upgrade" + ustoreResource.Status.UpgradePhase, Message: ustoreResource.Status.UpgradeMessage}
+	case workloadFailure != "":
+		degradedCondition = metav1.Condition{Type: unumv1alpha1.ConditionDegraded, Status: metav1.ConditionTrue, Reason: "ReplicaFailure", Message: workloadFailure}
+	}
+	degradedCondition.ObservedGeneration = generation
+	meta.SetStatusCondition(conditions, degradedCondition)
+
+	ustoreResource.Status.ObservedGeneration = generation
+	if err := r.Status().Update(ctx, ustoreResource); err != nil {
+		logger.Error(err, "Failed to update UStore status")
+		return err
+	}
+	return nil
+}
+
+// configCondition checks that the DB config map exists and holds a valid config.json.
+func (r *UStoreReconciler) configCondition(ctx context.Context, ustoreResource *unumv1alpha1.UStore) (metav1.Condition, error) {
+	condition := metav1.Condition{Type: unumv1alpha1.ConditionConfigValid}
+	configMap := &corev1.ConfigMap{}
+	err := r.Get(ctx, types.NamespacedName{Name: dbConfigMapName(ustoreResource), Namespace: ustoreResource.Namespace}, configMap)
+	if err != nil && errors.IsNotFound(err) {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "ConfigMapNotFound"
+		condition.Message = fmt.Sprintf("ConfigMap %s not found", dbConfigMapName(ustoreResource))
+		return condition, nil
+	} else if err != nil {
+		return condition, err
+	}
+
+	if err := unumv1alpha1.ValidateDBConfig(configMap); err != nil {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "InvalidConfig"
+		condition.Message = err.Error()
+		return condition, nil
+	}
+
+	condition.Status = metav1.ConditionTrue
+	condition.Reason = "ConfigValid"
+	condition.Message = fmt.Sprintf("ConfigMap %s holds a valid %s", configMap.Name, ustore_config_key)
+	return condition, nil
+}
+
+// storageResizeCondition summarizes the resize status of the claims recorded by reconcileExistingClaims.
+// A refused resize takes precedence over one in progress.
+func storageResizeCondition(ustoreResource *unumv1alpha1.UStore) metav1.Condition {
+	condition := metav1.Condition{Type: unumv1alpha1.ConditionStorageResized, Status: metav1.ConditionTrue, Reason: "ClaimsResized", Message: "All PVCs have the requested size"}
+	claims := map[string][]string{}
+	for _, volume := range ustoreResource.Status.Volumes {
+		if volume.ResizeStatus != "" {
+			claims[volume.ResizeStatus] = append(claims[volume.ResizeStatus], volume.ClaimName)
+		}
+	}
+
+	messages := map[string]string{
+		unumv1alpha1.ResizeStatusShrinkNotSupported:      "PVCs cannot shrink, restore the previous size of: %s",
+		unumv1alpha1.ResizeStatusExpansionNotAllowed:     "StorageClass does not allow expanding PVCs: %s",
+		unumv1alpha1.ResizeStatusFileSystemResizePending: "Waiting for a pod to resize the file system of PVCs: %s",
+		unumv1alpha1.ResizeStatusInProgress:              "Waiting for the expansion of PVCs: %s",
+	}
+	for _, resizeStatus := range []string{
+		unumv1alpha1.ResizeStatusShrinkNotSupported,
+		unumv1alpha1.ResizeStatusExpansionNotAllowed,
+		unumv1alpha1.ResizeStatusFileSystemResizePending,
+		unumv1alpha1.ResizeStatusInProgress,
+	} {
+		if names := claims[resizeStatus]; len(names) > 0 {
+			condition.Status = metav1.ConditionFalse
+			condition.Reason = resizeStatus
+			condition.Message = fmt.Sprintf(messages[resizeStatus], strings.Join(names, ", "))
+			return condition
+		}
+	}
+	return condition
+}
+
+// storageCondition checks that every PVC requested in spec.volumes is bound.
+func (r *UStoreReconciler) storageCondition(ctx context.Context, ustoreResource *unumv1alpha1.UStore) (metav1.Condition, error) {
+	condition := metav1.Condition{Type: unumv1alpha1.ConditionStorageReady}
+	if len(ustoreResource.Spec.Volumes) == 0 {
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "NoVolumes"
+		condition.Message = "No persistent volumes requested"
+		return condition, nil
+	}
+	if err := validateVolumeSizes(ustoreResource); err != nil {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "InvalidVolumeSize"
+		condition.Message = err.Error()
+		return condition, nil
+	}
+
+	pending := []string{}
+	for _, name := range claimNamesForUStore(ustoreResource) {
+		pvc := &corev1.PersistentVolumeClaim{}
+		err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: ustoreResource.Namespace}, pvc)
+		if err != nil && !errors.IsNotFound(err) {
+			return condition, err
+		}
+		if err != nil || pvc.Status.Phase != corev1.ClaimBound {
+			pending = append(pending, name)
+		}
+	}
+
+	if len(pending) > 0 {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "ClaimsPending"
+		condition.Message = fmt.Sprintf("Waiting for PVCs to be bound: %s", strings.Join(pending, ", "))
+		return condition, nil
+	}
+
+	condition.Status = metav1.ConditionTrue
+	condition.Reason = "ClaimsBound"
+	condition.Message = "All PVCs are bound"
+	return condition, nil
+}
+
+// workloadConditions returns the Available and Progressing conditions and any replica
+// failure message for the UStore Deployment or StatefulSet.
+func (r *UStoreReconciler) workloadConditions(ctx context.Context, ustoreResource *unumv1alpha1.UStore) (metav1.Condition, metav1.Condition, string, error) {
+	kind := unumv1alpha1.WorkloadKindDeployment
+	var workload client.Object = &appsv1.Deployment{}
+	if isStatefulSet(ustoreResource) {
+		kind = unumv1alpha1.WorkloadKindStatefulSet
+		workload = &appsv1.StatefulSet{}
+	}
+
+	err := r.Get(ctx, types.NamespacedName{Name: ustoreResource.Name, Namespace: ustoreResource.Namespace}, workload)
+	if err != nil && errors.IsNotFound(err) {
+		available := metav1.Condition{Type: unumv1alpha1.ConditionAvailable, Status: metav1.ConditionFalse, Reason: kind + "NotFound", Message: kind + " has not been created yet"}
+		progressing := metav1.Condition{Type: unumv1alpha1.ConditionProgressing, Status: metav1.ConditionTrue, Reason: "Creating", Message: kind + " is being created"}
+		return available, progressing, "", nil
+	} else if err != nil {
+		return metav1.Condition{}, metav1.Condition{}, "", err
+	}
+
+	switch workload := workload.(type) {
+	case *appsv1.StatefulSet:
+		available, progressing := statefulSetConditions(workload)
+		return available, progressing, "", nil
+	case *appsv1.Deployment:
+		available, progressing := deploymentConditions(workload)
+		return available, progressing, deploymentReplicaFailure(workload), nil
+	}
+	return metav1.Condition{}, metav1.Condition{}, "", nil
+}
+
+// deploymentConditions derives the Available and Progressing conditions from a UStore Deployment.
+func deploymentConditions(deployment *appsv1.Deployment) (metav1.Condition, metav1.Condition) {
+	desired := int32(1)
+	if deployment.Spec.Replicas != nil {
+		desired = *deployment.Spec.Replicas
+	}
+	status := deployment.Status
+
+	available := metav1.Condition{Type: unumv1alpha1.ConditionAvailable}
+	if status.AvailableReplicas >= desired && desired > 0 {
+		available.Status = metav1.ConditionTrue
+		available.Reason = "ReplicasAvailable"
+		available.Message = fmt.Sprintf("%d/%d replicas available", status.AvailableReplicas, desired)
+	} else {
+		available.Status = metav1.ConditionFalse
+		available.Reason = "ReplicasUnavailable"
+		available.Message = fmt.Sprintf("%d/%d replicas available", status.AvailableReplicas, desired)
+	}
+
+	progressing := metav1.Condition{Type: unumv1alpha1.ConditionProgressing}
+	for _, c := range status.Conditions {
+		if c.Type == appsv1.DeploymentProgressing && c.Status == corev1.ConditionFalse {
+			progressing.Status = metav1.ConditionFalse
+			progressing.Reason = c.Reason
+			progressing.Message = c.Message
+			return available, progressing
+		}
+	}
+	if status.ObservedGeneration < deployment.Generation || status.UpdatedReplicas < desired ||
+		status.Replicas > status.UpdatedReplicas || status.AvailableReplicas < desired {
+		progressing.Status = metav1.ConditionTrue
+		progressing.Reason = "RollingOut"
+		progressing.Message = fmt.Sprintf("%d/%d replicas updated", status.UpdatedReplicas, desired)
+	} else {
+		progressing.Status = metav1.ConditionFalse
+		progressing.Reason = "RolloutComplete"
+		progressing.Message = "Deployment is up to date"
+	}
+	return available, progressing
+}
+
+// deploymentReplicaFailure returns the message of the Deployment ReplicaFailure condition, if set.
+func deploymentReplicaFailure(deployment *appsv1.Deployment) string {
+	for _, c := range deployment.Status.Conditions {
+		if c.Type == appsv1.DeploymentReplicaFailure && c.Status == corev1.ConditionTrue {
+			return c.Message
+		}
+	}
+	return ""
+}
+
+// statefulSetConditions derives the Available and Progressing conditions from a UStore StatefulSet.
+func statefulSetConditions(statefulSet *appsv1.StatefulSet) (metav1.Condition, metav1.Condition) {
+	desired := int32(1)
+	if statefulSet.Spec.Replicas != nil {
+		desired = *statefulSet.Spec.Replicas
+	}
+	status := statefulSet.Status
+
+	available := metav1.Condition{Type: unumv1alpha1.ConditionAvailable}
+	if status.AvailableReplicas >= desired && desired > 0 {
+		available.Status = metav1.ConditionTrue
+		available.Reason = "ReplicasAvailable"
+	} else {
+		available.Status = metav1.ConditionFalse
+		available.Reason = "ReplicasUnavailable"
+	}
+	available.Message = fmt.Sprintf("%d/%d replicas available", status.AvailableReplicas, desired)
+
+	progressing := metav1.Condition{Type: unumv1alpha1.ConditionProgressing}
+	if status.ObservedGeneration < statefulSet.Generation || status.UpdatedReplicas < desired ||
+		status.CurrentRevision != status.UpdateRevision || status.AvailableReplicas < desired {
+		progressing.Status = metav1.ConditionTrue
+		progressing.Reason = "RollingOut"
+		progressing.Message = fmt.Sprintf("%d/%d replicas updated", status.UpdatedReplicas, desired)
+	} else {
+		progressing.Status = metav1.ConditionFalse
+		progressing.Reason = "RolloutComplete"
+		progressing.Message = "StatefulSet is up to date"
+	}
+	return available, progressing
+}
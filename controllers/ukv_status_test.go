@@ -0,0 +1,173 @@
+package controllers
+
+import (
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func int32Ptr(value int32) *int32 {
+	return &value
+}
+
+func TestDeploymentConditions(t *testing.T) {
+	tests := []struct {
+		name        string
+		replicas    *int32
+		generation  int64
+		status      appsv1.DeploymentStatus
+		available   metav1.ConditionStatus
+		progressing metav1.ConditionStatus
+		reason      string
+	}{
+		{
+			name:        "rolled out",
+			replicas:    int32Ptr(2),
+			generation:  1,
+			status:      appsv1.DeploymentStatus{ObservedGeneration: 1, Replicas: 2, UpdatedReplicas: 2, AvailableReplicas: 2},
+			available:   metav1.ConditionTrue,
+			progressing: metav1.ConditionFalse,
+			reason:      "RolloutComplete",
+		},
+		{
+			name:        "one replica by default",
+			generation:  1,
+			status:      appsv1.DeploymentStatus{ObservedGeneration: 1, Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1},
+			available:   metav1.ConditionTrue,
+			progressing: metav1.ConditionFalse,
+			reason:      "RolloutComplete",
+		},
+		{
+			name:        "spec not observed",
+			replicas:    int32Ptr(2),
+			generation:  2,
+			status:      appsv1.DeploymentStatus{ObservedGeneration: 1, Replicas: 2, UpdatedReplicas: 2, AvailableReplicas: 2},
+			available:   metav1.ConditionTrue,
+			progressing: metav1.ConditionTrue,
+			reason:      "RollingOut",
+		},
+		{
+			name:        "old replicas left",
+			replicas:    int32Ptr(2),
+			generation:  1,
+			status:      appsv1.DeploymentStatus{ObservedGeneration: 1, Replicas: 3, UpdatedReplicas: 2, AvailableReplicas: 2},
+			available:   metav1.ConditionTrue,
+			progressing: metav1.ConditionTrue,
+			reason:      "RollingOut",
+		},
+		{
+			name:        "unavailable",
+			replicas:    int32Ptr(2),
+			generation:  1,
+			status:      appsv1.DeploymentStatus{ObservedGeneration: 1, Replicas: 2, UpdatedReplicas: 2, AvailableReplicas: 1},
+			available:   metav1.ConditionFalse,
+			progressing: metav1.ConditionTrue,
+			reason:      "RollingOut",
+		},
+		{
+			name:       "progress deadline exceeded",
+			replicas:   int32Ptr(2),
+			generation: 1,
+			status: appsv1.DeploymentStatus{
+				ObservedGeneration: 1, Replicas: 2, UpdatedReplicas: 2, AvailableReplicas: 1,
+				Conditions: []appsv1.DeploymentCondition{{
+					Type:   appsv1.DeploymentProgressing,
+					Status: corev1.ConditionFalse,
+					Reason: "ProgressDeadlineExceeded",
+				}},
+			},
+			available:   metav1.ConditionFalse,
+			progressing: metav1.ConditionFalse,
+			reason:      "ProgressDeadlineExceeded",
+		},
+		{
+			name:        "scaled to zero",
+			replicas:    int32Ptr(0),
+			generation:  1,
+			status:      appsv1.DeploymentStatus{ObservedGeneration: 1},
+			available:   metav1.ConditionFalse,
+			progressing: metav1.ConditionFalse,
+			reason:      "RolloutComplete",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deployment := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Generation: test.generation},
+				Spec:       appsv1.DeploymentSpec{Replicas: test.replicas},
+				Status:     test.status,
+			}
+			available, progressing := deploymentConditions(deployment)
+			if available.Status != test.available {
+				t.Errorf("expected Available %s, got %s: %s", test.available, available.Status, available.Message)
+			}
+			if progressing.Status != test.progressing || progressing.Reason != test.reason {
+				t.Errorf("expected Progressing %s %s, got %s %s", test.progressing, test.reason, progressing.Status, progressing.Reason)
+			}
+		})
+	}
+}
+
+func TestStatefulSetConditions(t *testing.T) {
+	tests := []struct {
+		name        string
+		replicas    *int32
+		generation  int64
+		status      appsv1.StatefulSetStatus
+		available   metav1.ConditionStatus
+		progressing metav1.ConditionStatus
+	}{
+		{
+			name:       "rolled out",
+			replicas:   int32Ptr(3),
+			generation: 1,
+			status: appsv1.StatefulSetStatus{
+				ObservedGeneration: 1, UpdatedReplicas: 3, AvailableReplicas: 3,
+				CurrentRevision: "ustore-1", UpdateRevision: "ustore-1",
+			},
+			available:   metav1.ConditionTrue,
+			progressing: metav1.ConditionFalse,
+		},
+		{
+			name:       "revision rolling out",
+			replicas:   int32Ptr(3),
+			generation: 2,
+			status: appsv1.StatefulSetStatus{
+				ObservedGeneration: 2, UpdatedReplicas: 3, AvailableReplicas: 3,
+				CurrentRevision: "ustore-1", UpdateRevision: "ustore-2",
+			},
+			available:   metav1.ConditionTrue,
+			progressing: metav1.ConditionTrue,
+		},
+		{
+			name:       "replicas starting",
+			generation: 1,
+			status: appsv1.StatefulSetStatus{
+				ObservedGeneration: 1, UpdatedReplicas: 1,
+				CurrentRevision: "ustore-1", UpdateRevision: "ustore-1",
+			},
+			available:   metav1.ConditionFalse,
+			progressing: metav1.ConditionTrue,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			statefulSet := &appsv1.StatefulSet{
+				ObjectMeta: metav1.ObjectMeta{Generation: test.generation},
+				Spec:       appsv1.StatefulSetSpec{Replicas: test.replicas},
+				Status:     test.status,
+			}
+			available, progressing := statefulSetConditions(statefulSet)
+			if available.Status != test.available {
+				t.Errorf("expected Available %s, got %s: %s", test.available, available.Status, available.Message)
+			}
+			if progressing.Status != test.progressing {
+				t.Errorf("expected Progressing %s, got %s: %s", test.progressing, progressing.Status, progressing.Message)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package controllers
+
+import (
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+)
+
+// memoryTuningForUStore derives the leveldb and rocksdb cache, write buffer and open files limits
+// from the container limits when autoTuneMemory is set. 40% of the memory goes to the block cache,
+// 25% to the write buffers, and the rest is left to indexes, open files and the server itself.
+// It returns nil when nothing is tuned.
+func memoryTuningForUStore(ustoreResource *unumv1alpha1.UStore) *unumv1alpha1.MemoryTuningStatus {
+	spec := ustoreResource.Spec
+	if !spec.AutoTuneMemory || spec.EngineConfig == nil {
+		return nil
+	}
+	limits := resourcesForUStore(ustoreResource).Limits
+	memory := limits.Memory()
+	if memory.IsZero() {
+		return nil
+	}
+
+	writeBufferNumber := int64(2)
+	switch spec.DBType {
+	case "leveldb":
+	case "rocksdb":
+		writeBufferNumber = ustore_rocksdb_write_buffer_number
+		if spec.EngineConfig.RocksDB != nil && spec.EngineConfig.RocksDB.MaxWriteBufferNumber != nil && *spec.EngineConfig.RocksDB.MaxWriteBufferNumber > 0 {
+			writeBufferNumber = int64(*spec.EngineConfig.RocksDB.MaxWriteBufferNumber)
+		}
+	default:
+		return nil
+	}
+
+	bytes := memory.Value()
+	writeBufferSize := bytes / 4 / writeBufferNumber
+	if writeBufferSize > ustore_max_write_buffer_size {
+		writeBufferSize = ustore_max_write_buffer_size
+	}
+	maxOpenFiles := bytes / ustore_memory_per_open_file
+	if maxOpenFiles < ustore_min_open_files {
+		maxOpenFiles = ustore_min_open_files
+	} else if maxOpenFiles > ustore_max_open_files {
+		maxOpenFiles = ustore_max_open_files
+	}
+	backgroundThreads := (limits.Cpu().MilliValue() + 999) / 1000
+	if backgroundThreads < 2 {
+		backgroundThreads = 2
+	}
+
+	return &unumv1alpha1.MemoryTuningStatus{
+		MemoryLimit:          memory.String(),
+		BlockCacheSize:       bytes * 40 / 100,
+		WriteBufferSize:      writeBufferSize,
+		MaxWriteBufferNumber: int32(writeBufferNumber),
+		MaxOpenFiles:         int32(maxOpenFiles),
+		BackgroundThreads:    int32(backgroundThreads),
+	}
+}
@@ -0,0 +1,181 @@
+package controllers
+
+import (
+	"testing"
+
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/equality"
+)
+
+func TestMemoryTuningForUStore(t *testing.T) {
+	rocksdb := func(maxWriteBufferNumber *int32) *unumv1alpha1.EngineConfig {
+		return &unumv1alpha1.EngineConfig{RocksDB: &unumv1alpha1.RocksDBConfig{MaxWriteBufferNumber: maxWriteBufferNumber}}
+	}
+	tests := []struct {
+		name         string
+		dbType       string
+		memory       string
+		cpu          string
+		autoTune     bool
+		engineConfig *unumv1alpha1.EngineConfig
+		expected     *unumv1alpha1.MemoryTuningStatus
+	}{
+		{
+			name:         "disabled",
+			dbType:       "rocksdb",
+			memory:       "4Gi",
+			cpu:          "2",
+			engineConfig: &unumv1alpha1.EngineConfig{},
+		},
+		{
+			name:     "user config map",
+			dbType:   "rocksdb",
+			memory:   "4Gi",
+			cpu:      "2",
+			autoTune: true,
+		},
+		{
+			name:         "udisk is not tuned",
+			dbType:       "udisk",
+			memory:       "4Gi",
+			cpu:          "2",
+			autoTune:     true,
+			engineConfig: &unumv1alpha1.EngineConfig{},
+		},
+		{
+			name:         "leveldb",
+			dbType:       "leveldb",
+			memory:       "1Gi",
+			cpu:          "1",
+			autoTune:     true,
+			engineConfig: &unumv1alpha1.EngineConfig{},
+			expected: &unumv1alpha1.MemoryTuningStatus{
+				MemoryLimit:          "1Gi",
+				BlockCacheSize:       (1 << 30) * 40 / 100,
+				WriteBufferSize:      128 << 20,
+				MaxWriteBufferNumber: 2,
+				MaxOpenFiles:         1024,
+				BackgroundThreads:    2,
+			},
+		},
+		{
+			name:         "rocksdb",
+			dbType:       "rocksdb",
+			memory:       "4Gi",
+			cpu:          "3",
+			autoTune:     true,
+			engineConfig: rocksdb(nil),
+			expected: &unumv1alpha1.MemoryTuningStatus{
+				MemoryLimit:          "4Gi",
+				BlockCacheSize:       (4 << 30) * 40 / 100,
+				WriteBufferSize:      256 << 20,
+				MaxWriteBufferNumber: 4,
+				MaxOpenFiles:         4096,
+				BackgroundThreads:    3,
+			},
+		},
+		{
+			name:         "write buffers are capped",
+			dbType:       "rocksdb",
+			memory:       "16Gi",
+			cpu:          "2",
+			autoTune:     true,
+			engineConfig: rocksdb(nil),
+			expected: &unumv1alpha1.MemoryTuningStatus{
+				MemoryLimit:          "16Gi",
+				BlockCacheSize:       (16 << 30) * 40 / 100,
+				WriteBufferSize:      ustore_max_write_buffer_size,
+				MaxWriteBufferNumber: 4,
+				MaxOpenFiles:         16384,
+				BackgroundThreads:    2,
+			},
+		},
+		{
+			name:         "open files have a floor",
+			dbType:       "leveldb",
+			memory:       "128Mi",
+			cpu:          "500m",
+			autoTune:     true,
+			engineConfig: &unumv1alpha1.EngineConfig{},
+			expected: &unumv1alpha1.MemoryTuningStatus{
+				MemoryLimit:          "128Mi",
+				BlockCacheSize:       (128 << 20) * 40 / 100,
+				WriteBufferSize:      16 << 20,
+				MaxWriteBufferNumber: 2,
+				MaxOpenFiles:         ustore_min_open_files,
+				BackgroundThreads:    2,
+			},
+		},
+		{
+			name:         "explicit write buffer number",
+			dbType:       "rocksdb",
+			memory:       "4Gi",
+			cpu:          "2",
+			autoTune:     true,
+			engineConfig: rocksdb(int32Ptr(8)),
+			expected: &unumv1alpha1.MemoryTuningStatus{
+				MemoryLimit:          "4Gi",
+				BlockCacheSize:       (4 << 30) * 40 / 100,
+				WriteBufferSize:      128 << 20,
+				MaxWriteBufferNumber: 8,
+				MaxOpenFiles:         4096,
+				BackgroundThreads:    2,
+			},
+		},
+		{
+			name:         "zero write buffer number",
+			dbType:       "rocksdb",
+			memory:       "4Gi",
+			cpu:          "2",
+			autoTune:     true,
+			engineConfig: rocksdb(int32Ptr(0)),
+			expected: &unumv1alpha1.MemoryTuningStatus{
+				MemoryLimit:          "4Gi",
+				BlockCacheSize:       (4 << 30) * 40 / 100,
+				WriteBufferSize:      256 << 20,
+				MaxWriteBufferNumber: 4,
+				MaxOpenFiles:         4096,
+				BackgroundThreads:    2,
+			},
+		},
+		{
+			name:         "negative write buffer number",
+			dbType:       "rocksdb",
+			memory:       "4Gi",
+			cpu:          "2",
+			autoTune:     true,
+			engineConfig: rocksdb(int32Ptr(-3)),
+			expected: &unumv1alpha1.MemoryTuningStatus{
+				MemoryLimit:          "4Gi",
+				BlockCacheSize:       (4 << 30) * 40 / 100,
+				WriteBufferSize:      256 << 20,
+				MaxWriteBufferNumber: 4,
+				MaxOpenFiles:         4096,
+				BackgroundThreads:    2,
+			},
+		},
+		{
+			name:         "no memory limit",
+			dbType:       "rocksdb",
+			cpu:          "2",
+			autoTune:     true,
+			engineConfig: rocksdb(nil),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ustoreResource := &unumv1alpha1.UStore{Spec: unumv1alpha1.UStoreSpec{
+				DBType:           test.dbType,
+				MemoryLimit:      test.memory,
+				ConcurrencyLimit: test.cpu,
+				AutoTuneMemory:   test.autoTune,
+				EngineConfig:     test.engineConfig,
+			}}
+			tuning := memoryTuningForUStore(ustoreResource)
+			if !equality.Semantic.DeepEqual(tuning, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, tuning)
+			}
+		})
+	}
+}
@@ -0,0 +1,274 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+	"github.com/opdev/ustore-operator/controllers/utils"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/version"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// reconcileUpgrade moves the UStore towards spec.version: it checks the upgrade path, takes the
+// pre-upgrade backup, and once the pods run the target version either completes the upgrade or,
+// when they are not ready within the timeout, rolls back to the current version.
+// The workload runs the version returned by runningVersion. The returned duration is the time
+// until the upgrade times out, zero when nothing waits on it.
+func (r *UStoreReconciler) reconcileUpgrade(ctx context.Context, ustoreResource *unumv1alpha1.UStore) (time.Duration, error) {
+	status := &ustoreResource.Status
+	targetVersion := ustoreResource.Spec.Version
+	if targetVersion == "" {
+		status.CurrentVersion = ""
+		status.TargetVersion = ""
+		setUpgradePhase(ustoreResource, "", "")
+		return 0, nil
+	}
+	if status.CurrentVersion == "" {
+		deployedVersion, err := r.deployedVersion(ctx, ustoreResource)
+		if err != nil {
+			return 0, err
+		}
+		if deployedVersion == "" {
+			// first version of the UStore, or an unknown one, nothing to upgrade from
+			status.CurrentVersion = targetVersion
+			status.TargetVersion = targetVersion
+			return 0, nil
+		}
+		// a version set on a running UStore is checked and backed up before like any upgrade
+		status.CurrentVersion = deployedVersion
+		status.TargetVersion = ""
+	}
+
+	if targetVersion != status.TargetVersion {
+		status.TargetVersion = targetVersion
+		switch {
+		case targetVersion == status.CurrentVersion:
+			setUpgradePhase(ustoreResource, "", "")
+		case unumv1alpha1.ValidateUpgrade(status.CurrentVersion, targetVersion) != nil:
+			setUpgradePhase(ustoreResource, unumv1alpha1.UpgradePhaseFailed, unumv1alpha1.ValidateUpgrade(status.CurrentVersion, targetVersion).Error())
+		case ustoreResource.Spec.Upgrade != nil && ustoreResource.Spec.Upgrade.Backup != nil:
+			setUpgradePhase(ustoreResource, unumv1alpha1.UpgradePhaseBackingUp, fmt.Sprintf("Backing up before upgrading from %s to %s", status.CurrentVersion, targetVersion))
+		default:
+			setUpgradePhase(ustoreResource, unumv1alpha1.UpgradePhaseUpgrading, fmt.Sprintf("Upgrading from %s to %s", status.CurrentVersion, targetVersion))
+		}
+	}
+
+	switch status.UpgradePhase {
+	case unumv1alpha1.UpgradePhaseBackingUp:
+		return 0, r.reconcileUpgradeBackup(ctx, ustoreResource)
+	case unumv1alpha1.UpgradePhaseUpgrading:
+		return r.checkUpgradeRollout(ctx, ustoreResource)
+	}
+	return 0, nil
+}
+
+// reconcileUpgradeBackup creates the pre-upgrade UStoreBackup and starts the upgrade once it completed.
+func (r *UStoreReconciler) reconcileUpgradeBackup(ctx context.Context, ustoreResource *unumv1alpha1.UStore) error {
+	logger := log.FromContext(ctx)
+	status := &ustoreResource.Status
+
+	backup := &unumv1alpha1.UStoreBackup{}
+	name := upgradeBackupName(ustoreResource)
+	err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: ustoreResource.Namespace}, backup)
+	if err != nil && errors.IsNotFound(err) {
+		backup = &unumv1alpha1.UStoreBackup{
+			ObjectMeta: utils.SetObjectMeta(name, ustoreResource.Namespace, map[string]string{}),
+			Spec: unumv1alpha1.UStoreBackupSpec{
+				UStoreName:  ustoreResource.Name,
+				Destination: *ustoreResource.Spec.Upgrade.Backup.DeepCopy(),
+			},
+		}
+		if err := ctrl.SetControllerReference(ustoreResource, backup, r.Scheme); err != nil {
+			logger.Error(err, "Failed to set owner reference on pre-upgrade UStoreBackup")
+			return err
+		}
+		logger.Info("Creating a pre-upgrade UStoreBackup", "UStoreBackup.Name", name)
+		if err := r.Create(ctx, backup); err != nil {
+			logger.Error(err, "Failed to create pre-upgrade UStoreBackup", "UStoreBackup.Name", name)
+			return err
+		}
+		status.UpgradeBackupName = name
+		return nil
+	} else if err != nil {
+		logger.Error(err, "Failed to get pre-upgrade UStoreBackup")
+		return err
+	}
+
+	status.UpgradeBackupName = name
+	switch backup.Status.Phase {
+	case unumv1alpha1.PhaseCompleted:
+		setUpgradePhase(ustoreResource, unumv1alpha1.UpgradePhaseUpgrading, fmt.Sprintf("Upgrading from %s to %s", status.CurrentVersion, status.TargetVersion))
+	case unumv1alpha1.PhaseFailed:
+		setUpgradePhase(ustoreResource, unumv1alpha1.UpgradePhaseFailed, fmt.Sprintf("Pre-upgrade backup %s failed: %s", name, backup.Status.Message))
+	}
+	return nil
+}
+
+// checkUpgradeRollout completes the upgrade once the workload runs the target version on all its
+// replicas, and rolls back to the current version when that takes longer than the upgrade timeout.
+func (r *UStoreReconciler) checkUpgradeRollout(ctx context.Context, ustoreResource *unumv1alpha1.UStore) (time.Duration, error) {
+	status := &ustoreResource.Status
+	rolledOut, err := r.workloadRunsImage(ctx, ustoreResource, r.ustoreImage(ustoreResource))
+	if err != nil {
+		return 0, err
+	}
+	if rolledOut {
+		setUpgradePhase(ustoreResource, unumv1alpha1.UpgradePhaseSucceeded, fmt.Sprintf("Upgraded from %s to %s", status.CurrentVersion, status.TargetVersion))
+		status.CurrentVersion = status.TargetVersion
+		return 0, nil
+	}
+
+	timeout := upgradeTimeout(ustoreResource)
+	if status.UpgradeStartTime == nil {
+		now := metav1.Now()
+		status.UpgradeStartTime = &now
+	}
+	elapsed := time.Since(status.UpgradeStartTime.Time)
+	if elapsed >= timeout {
+		log.FromContext(ctx).Info("Rolling back upgrade", "CurrentVersion", status.CurrentVersion, "TargetVersion", status.TargetVersion)
+		setUpgradePhase(ustoreResource, unumv1alpha1.UpgradePhaseRolledBack,
+			fmt.Sprintf("Pods running %s were not ready within %s, rolled back to %s", status.TargetVersion, timeout, status.CurrentVersion))
+		return 0, nil
+	}
+	return timeout - elapsed, nil
+}
+
+// workloadRunsImage reports whether all desired replicas of the UStore workload are updated,
+// available and run the given image.
+func (r *UStoreReconciler) workloadRunsImage(ctx context.Context, ustoreResource *unumv1alpha1.UStore, image string) (bool, error) {
+	var workload client.Object = &appsv1.Deployment{}
+	if isStatefulSet(ustoreResource) {
+		workload = &appsv1.StatefulSet{}
+	}
+	err := r.Get(ctx, types.NamespacedName{Name: ustoreResource.Name, Namespace: ustoreResource.Namespace}, workload)
+	if err != nil && errors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	switch workload := workload.(type) {
+	case *appsv1.StatefulSet:
+		available, progressing := statefulSetConditions(workload)
+		return containerImage(workload.Spec.Template.Spec.Containers) == image &&
+			available.Status == metav1.ConditionTrue && progressing.Reason == "RolloutComplete", nil
+	case *appsv1.Deployment:
+		available, progressing := deploymentConditions(workload)
+		return containerImage(workload.Spec.Template.Spec.Containers) == image &&
+			available.Status == metav1.ConditionTrue && progressing.Reason == "RolloutComplete", nil
+	}
+	return false, nil
+}
+
+// deployedVersion returns the version the existing UStore workload runs: the tag of its image when
+// it is a version, otherwise the tag of the default image. It is empty when there is no workload yet.
+func (r *UStoreReconciler) deployedVersion(ctx context.Context, ustoreResource *unumv1alpha1.UStore) (string, error) {
+	var workload client.Object = &appsv1.Deployment{}
+	if isStatefulSet(ustoreResource) {
+		workload = &appsv1.StatefulSet{}
+	}
+	err := r.Get(ctx, types.NamespacedName{Name: ustoreResource.Name, Namespace: ustoreResource.Namespace}, workload)
+	if err != nil && errors.IsNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	image := ""
+	switch workload := workload.(type) {
+	case *appsv1.StatefulSet:
+		image = containerImage(workload.Spec.Template.Spec.Containers)
+	case *appsv1.Deployment:
+		image = containerImage(workload.Spec.Template.Spec.Containers)
+	}
+	if tag := imageTag(image); tag != "" {
+		if _, err := version.ParseGeneric(tag); err == nil {
+			return tag, nil
+		}
+	}
+	defaultImage := r.Images.UStore
+	if ustoreResource.Spec.DBType == "udisk" {
+		defaultImage = r.Images.UDisk
+	}
+	return imageTag(defaultImage), nil
+}
+
+// runningVersion returns the version the UStore pods should run: the target version while it is
+// being upgraded to, the current version otherwise.
+func runningVersion(ustoreResource *unumv1alpha1.UStore) string {
+	status := ustoreResource.Status
+	if status.UpgradePhase == unumv1alpha1.UpgradePhaseUpgrading {
+		return status.TargetVersion
+	}
+	if status.CurrentVersion != "" {
+		return status.CurrentVersion
+	}
+	return ustoreResource.Spec.Version
+}
+
+// setUpgradePhase records an upgrade phase, starting the timeout when the rollout begins.
+func setUpgradePhase(ustoreResource *unumv1alpha1.UStore, phase string, message string) {
+	status := &ustoreResource.Status
+	if phase == unumv1alpha1.UpgradePhaseUpgrading && status.UpgradePhase != phase {
+		now := metav1.Now()
+		status.UpgradeStartTime = &now
+	}
+	if phase == unumv1alpha1.UpgradePhaseBackingUp || phase == "" {
+		status.UpgradeStartTime = nil
+		status.UpgradeBackupName = ""
+	}
+	status.UpgradePhase = phase
+	status.UpgradeMessage = message
+}
+
+func upgradeTimeout(ustoreResource *unumv1alpha1.UStore) time.Duration {
+	if ustoreResource.Spec.Upgrade != nil && ustoreResource.Spec.Upgrade.Timeout != nil {
+		return ustoreResource.Spec.Upgrade.Timeout.Duration
+	}
+	return ustore_upgrade_timeout
+}
+
+func upgradeBackupName(ustoreResource *unumv1alpha1.UStore) string {
+	return fmt.Sprintf("%s-pre-%s", ustoreResource.Name, strings.ReplaceAll(strings.TrimPrefix(ustoreResource.Status.TargetVersion, "v"), ".", "-"))
+}
+
+// imageWithTag replaces the tag or digest of an image reference.
+func imageWithTag(image string, tag string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image + ":" + tag
+}
+
+// imageTag returns the tag of an image reference, empty when it has none or is pinned by digest.
+func imageTag(image string) string {
+	if strings.Contains(image, "@") {
+		return ""
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[i+1:]
+	}
+	return ""
+}
+
+func containerImage(containers []corev1.Container) string {
+	for _, container := range containers {
+		if container.Name == ustore_container_name {
+			return container.Image
+		}
+	}
+	return ""
+}
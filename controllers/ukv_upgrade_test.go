@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestReconcileUpgradeFirstVersion(t *testing.T) {
+	deployment := func(image string) *appsv1.Deployment {
+		return &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "ustore", Namespace: "default"},
+			Spec: appsv1.DeploymentSpec{
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: ustore_container_name, Image: image}}},
+				},
+			},
+		}
+	}
+	backup := &unumv1alpha1.UpgradeSpec{Backup: &unumv1alpha1.BackupDestination{PVC: &unumv1alpha1.PVCDestination{ClaimName: "backups"}}}
+	tests := []struct {
+		name           string
+		version        string
+		upgrade        *unumv1alpha1.UpgradeSpec
+		workload       client.Object
+		currentVersion string
+		phase          string
+	}{
+		{name: "new UStore", version: "0.13.0", currentVersion: "0.13.0"},
+		{name: "same version as the pods", version: "0.12.1", workload: deployment("quay.io/unum/ustore:0.12.1"), currentVersion: "0.12.1"},
+		{
+			name:           "upgrade from the image tag",
+			version:        "0.13.0",
+			workload:       deployment("quay.io/unum/ustore:0.12.1"),
+			currentVersion: "0.12.1",
+			phase:          unumv1alpha1.UpgradePhaseUpgrading,
+		},
+		{
+			name:           "upgrade from the default image",
+			version:        "0.13.0",
+			workload:       deployment("quay.io/unum/ustore:latest"),
+			currentVersion: imageTag(ustore_ce_image),
+			phase:          unumv1alpha1.UpgradePhaseUpgrading,
+		},
+		{
+			name:           "backed up first",
+			version:        "0.13.0",
+			upgrade:        backup,
+			workload:       deployment("quay.io/unum/ustore:0.12.1"),
+			currentVersion: "0.12.1",
+			phase:          unumv1alpha1.UpgradePhaseBackingUp,
+		},
+		{
+			name:           "unsupported upgrade",
+			version:        "0.15.0",
+			workload:       deployment("quay.io/unum/ustore:0.12.1"),
+			currentVersion: "0.12.1",
+			phase:          unumv1alpha1.UpgradePhaseFailed,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ustoreResource := &unumv1alpha1.UStore{
+				ObjectMeta: metav1.ObjectMeta{Name: "ustore", Namespace: "default", UID: "uid"},
+				Spec:       unumv1alpha1.UStoreSpec{NumOfInstances: 1, Version: test.version, Upgrade: test.upgrade},
+			}
+			builder := fake.NewClientBuilder().WithScheme(testScheme(t)).WithObjects(ustoreResource)
+			if test.workload != nil {
+				builder = builder.WithObjects(test.workload)
+			}
+			c := builder.Build()
+			r := &UStoreReconciler{Client: c, Scheme: c.Scheme(), Images: Images{}.withDefaults()}
+
+			if _, err := r.reconcileUpgrade(context.Background(), ustoreResource); err != nil {
+				t.Fatal(err)
+			}
+			status := ustoreResource.Status
+			if status.CurrentVersion != test.currentVersion || status.TargetVersion != test.version {
+				t.Errorf("expected versions %s to %s, got %s to %s", test.currentVersion, test.version, status.CurrentVersion, status.TargetVersion)
+			}
+			if status.UpgradePhase != test.phase {
+				t.Errorf("expected upgrade phase %q, got %q: %s", test.phase, status.UpgradePhase, status.UpgradeMessage)
+			}
+		})
+	}
+}
@@ -0,0 +1,386 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+	"github.com/opdev/ustore-operator/controllers/utils"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// backupPollInterval is how often a backup checks whether the UStore pods stopped.
+const backupPollInterval = 5 * time.Second
+
+// UStoreBackupReconciler reconciles a UStoreBackup object
+type UStoreBackupReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// Images run by the Jobs, the default ones when unset.
+	Images Images
+
+	// openShift is set when the cluster serves SecurityContextConstraints, which assign the pod users.
+	openShift bool
+}
+
+//+kubebuilder:rbac:groups=unum.cloud,resources=ustorebackups,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=unum.cloud,resources=ustorebackups/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=unum.cloud,resources=ustorebackups/finalizers,verbs=update
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+
+// Reconcile scales the UStore to zero, runs a Job archiving its volumes, scales it back up and
+// records the outcome in the UStoreBackup status. Completed and failed backups are never retried.
+// A deleted backup deletes its archive first.
+func (r *UStoreBackupReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	var backup unumv1alpha1.UStoreBackup
+	if err := r.Get(ctx, req.NamespacedName, &backup); err != nil {
+		if errors.IsNotFound(err) {
+			logger.Info("UStoreBackup resource not found. Ignoring since object must be deleted")
+			return ctrl.Result{}, nil
+		}
+		logger.Error(err, "Failed to get UStoreBackup resource")
+		return ctrl.Result{}, err
+	}
+
+	if !backup.DeletionTimestamp.IsZero() {
+		return r.finalizeBackup(ctx, &backup)
+	}
+	if !controllerutil.ContainsFinalizer(&backup, ustore_backup_archive_finalizer) {
+		patchDiff := client.MergeFrom(backup.DeepCopy())
+		controllerutil.AddFinalizer(&backup, ustore_backup_archive_finalizer)
+		if err := r.Patch(ctx, &backup, patchDiff); err != nil {
+			logger.Error(err, "Failed to add UStoreBackup finalizer")
+			return ctrl.Result{}, err
+		}
+	}
+
+	if backup.Status.Phase == unumv1alpha1.PhaseCompleted || backup.Status.Phase == unumv1alpha1.PhaseFailed {
+		return ctrl.Result{}, nil
+	}
+
+	job := &batchv1.Job{}
+	err := r.Get(ctx, types.NamespacedName{Name: backupJobName(&backup), Namespace: backup.Namespace}, job)
+	if err != nil && errors.IsNotFound(err) {
+		return r.startBackupJob(ctx, &backup)
+	} else if err != nil {
+		logger.Error(err, "Failed to get backup Job")
+		return ctrl.Result{}, err
+	}
+
+	finished, failure := jobFinished(job)
+	if !finished {
+		// Job status changes requeue the backup.
+		return ctrl.Result{}, nil
+	}
+
+	if failure != "" {
+		backup.Status.Phase = unumv1alpha1.PhaseFailed
+		backup.Status.Message = failure
+	} else {
+		result, err := readArchiveResult(ctx, r.Client, job)
+		if err != nil {
+			logger.Error(err, "Failed to read archive result")
+			return ctrl.Result{}, err
+		}
+		backup.Status.Phase = unumv1alpha1.PhaseCompleted
+		backup.Status.Message = ""
+		backup.Status.Size = result.Size
+		backup.Status.Checksum = result.Checksum
+	}
+	setCompletion(job, &backup.Status.CompletionTime, &backup.Status.Duration, backup.Status.StartTime)
+
+	if err := r.resumeUStore(ctx, &backup); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.Status().Update(ctx, &backup); err != nil {
+		logger.Error(err, "Failed to update UStoreBackup status")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// startBackupJob records the source UStore spec, stops the UStore pods so the archive is
+// consistent, and creates the backup Job once they are gone.
+func (r *UStoreBackupReconciler) startBackupJob(ctx context.Context, backup *unumv1alpha1.UStoreBackup) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	ustoreResource := &unumv1alpha1.UStore{}
+	err := r.Get(ctx, types.NamespacedName{Name: backup.Spec.UStoreName, Namespace: backup.Namespace}, ustoreResource)
+	if err != nil && errors.IsNotFound(err) {
+		return ctrl.Result{}, r.setBackupPhase(ctx, backup, unumv1alpha1.PhaseFailed, fmt.Sprintf("UStore %s not found", backup.Spec.UStoreName))
+	} else if err != nil {
+		logger.Error(err, "Failed to get UStore")
+		return ctrl.Result{}, err
+	}
+
+	if len(ustoreResource.Spec.Volumes) == 0 {
+		return ctrl.Result{}, r.setBackupPhase(ctx, backup, unumv1alpha1.PhaseFailed, fmt.Sprintf("UStore %s has no volumes to back up", ustoreResource.Name))
+	}
+	if blockVolumes(ustoreResource) {
+		return ctrl.Result{}, r.setBackupPhase(ctx, backup, unumv1alpha1.PhaseFailed, "Block volumes cannot be archived, use a UStoreSnapshot instead")
+	}
+
+	// recorded before anything is created, so a Job never exists without them
+	if backup.Status.StartTime == nil {
+		now := metav1.Now()
+		backup.Status.StartTime = &now
+		backup.Status.Location = backupLocation(backup)
+		backup.Status.SourceSpec = ustoreResource.Spec.DeepCopy()
+		if err := r.setBackupPhase(ctx, backup, unumv1alpha1.PhasePending, "Waiting for UStore pods to stop"); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	paused, err := r.pauseUStore(ctx, backup, ustoreResource)
+	if err != nil {
+		return ctrl.Result{}, r.failBackup(ctx, backup, fmt.Sprintf("Failed to stop UStore %s: %v", ustoreResource.Name, err))
+	}
+	if !paused {
+		if time.Since(backup.Status.StartTime.Time) >= ustore_backup_quiesce_timeout {
+			return ctrl.Result{}, r.failBackup(ctx, backup, fmt.Sprintf("UStore %s pods did not stop within %s", ustoreResource.Name, ustore_backup_quiesce_timeout))
+		}
+		if err := r.setBackupPhase(ctx, backup, unumv1alpha1.PhasePending, "Waiting for UStore pods to stop"); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{RequeueAfter: backupPollInterval}, nil
+	}
+
+	job := backupJobForUStore(backup, ustoreResource, r.Images, r.openShift)
+	if err := ctrl.SetControllerReference(backup, job, r.Scheme); err != nil {
+		logger.Error(err, "Failed to set owner reference on backup Job")
+		return ctrl.Result{}, err
+	}
+	logger.Info("Creating a new backup Job", "Job.Namespace", job.Namespace, "Job.Name", job.Name)
+	if err := r.Create(ctx, job); err != nil {
+		logger.Error(err, "Failed to create backup Job", "Job.Namespace", job.Namespace, "Job.Name", job.Name)
+		return ctrl.Result{}, err
+	}
+
+	backup.Status.JobName = job.Name
+	return ctrl.Result{}, r.setBackupPhase(ctx, backup, unumv1alpha1.PhaseRunning, "")
+}
+
+// finalizeBackup deletes the archive of a UStoreBackup being deleted and then lets the deletion proceed.
+// Until the archive is deleted the backup stays, retrying the cleanup Job when it fails.
+func (r *UStoreBackupReconciler) finalizeBackup(ctx context.Context, backup *unumv1alpha1.UStoreBackup) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	if !controllerutil.ContainsFinalizer(backup, ustore_backup_archive_finalizer) {
+		return ctrl.Result{}, nil
+	}
+	if err := r.resumeUStore(ctx, backup); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// nothing was written before the location is recorded
+	if backup.Status.Location != "" && backup.Status.SourceSpec != nil {
+		deleted, err := r.deleteArchive(ctx, backup)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if !deleted {
+			return ctrl.Result{RequeueAfter: backupPollInterval}, nil
+		}
+	}
+
+	patchDiff := client.MergeFrom(backup.DeepCopy())
+	controllerutil.RemoveFinalizer(backup, ustore_backup_archive_finalizer)
+	if err := r.Patch(ctx, backup, patchDiff); err != nil {
+		logger.Error(err, "Failed to remove UStoreBackup finalizer")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// deleteArchive runs the Job deleting the archive of the backup and reports whether it succeeded.
+// A backup Job still writing the archive is stopped first. The cleanup Job has no owner, as the
+// garbage collector may delete the dependents of a backup being deleted, and is removed once finished.
+func (r *UStoreBackupReconciler) deleteArchive(ctx context.Context, backup *unumv1alpha1.UStoreBackup) (bool, error) {
+	logger := log.FromContext(ctx)
+
+	backupJob := &batchv1.Job{}
+	err := r.Get(ctx, types.NamespacedName{Name: backupJobName(backup), Namespace: backup.Namespace}, backupJob)
+	if err == nil {
+		if finished, _ := jobFinished(backupJob); !finished {
+			if backupJob.DeletionTimestamp.IsZero() {
+				logger.Info("Stopping the backup Job before deleting its archive", "Job.Name", backupJob.Name)
+				if err := r.Delete(ctx, backupJob, client.PropagationPolicy(metav1.DeletePropagationForeground)); err != nil && !errors.IsNotFound(err) {
+					logger.Error(err, "Failed to delete backup Job", "Job.Name", backupJob.Name)
+					return false, err
+				}
+			}
+			return false, nil
+		}
+	} else if !errors.IsNotFound(err) {
+		logger.Error(err, "Failed to get backup Job")
+		return false, err
+	}
+
+	job := &batchv1.Job{}
+	err = r.Get(ctx, types.NamespacedName{Name: archiveCleanupJobName(backup), Namespace: backup.Namespace}, job)
+	if err != nil && errors.IsNotFound(err) {
+		job = archiveCleanupJobForBackup(backup, r.Images, r.openShift)
+		logger.Info("Creating a Job deleting the archive", "Job.Name", job.Name, "Location", backup.Status.Location)
+		if err := r.Create(ctx, job); err != nil {
+			if errors.HasStatusCause(err, corev1.NamespaceTerminatingCause) {
+				logger.Info("Namespace is terminating, leaving the archive", "Location", backup.Status.Location)
+				return true, nil
+			}
+			logger.Error(err, "Failed to create archive cleanup Job", "Job.Name", job.Name)
+			return false, err
+		}
+		return false, nil
+	} else if err != nil {
+		logger.Error(err, "Failed to get archive cleanup Job")
+		return false, err
+	}
+
+	finished, failure := jobFinished(job)
+	if !finished {
+		return false, nil
+	}
+	if failure != "" {
+		logger.Info("Failed to delete the archive, retrying", "Location", backup.Status.Location, "Message", failure)
+	}
+	if err := r.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil && !errors.IsNotFound(err) {
+		logger.Error(err, "Failed to delete archive cleanup Job", "Job.Name", job.Name)
+		return false, err
+	}
+	return failure == "", nil
+}
+
+// pauseUStore scales the UStore to zero through an annotation and reports whether its pods are gone.
+// Only one backup may pause a UStore at a time, the others wait for it.
+func (r *UStoreBackupReconciler) pauseUStore(ctx context.Context, backup *unumv1alpha1.UStoreBackup, ustoreResource *unumv1alpha1.UStore) (bool, error) {
+	logger := log.FromContext(ctx)
+	switch ustoreResource.Annotations[ustore_backup_pause_annotation] {
+	case backup.Name:
+	case "":
+		patchDiff := client.MergeFrom(ustoreResource.DeepCopy())
+		if ustoreResource.Annotations == nil {
+			ustoreResource.Annotations = map[string]string{}
+		}
+		ustoreResource.Annotations[ustore_backup_pause_annotation] = backup.Name
+		logger.Info("Scaling UStore to zero for backup", "UStore.Name", ustoreResource.Name)
+		if err := r.Patch(ctx, ustoreResource, patchDiff); err != nil {
+			logger.Error(err, "Failed to pause UStore", "UStore.Name", ustoreResource.Name)
+			return false, err
+		}
+	default:
+		return false, nil
+	}
+
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(ustoreResource.Namespace), client.MatchingLabels(utils.LabelsForUStore(ustoreResource.Name))); err != nil {
+		logger.Error(err, "Failed to list UStore pods")
+		return false, err
+	}
+	return len(pods.Items) == 0, nil
+}
+
+// resumeUStore removes the pause annotation set by this backup, when the UStore still exists.
+func (r *UStoreBackupReconciler) resumeUStore(ctx context.Context, backup *unumv1alpha1.UStoreBackup) error {
+	logger := log.FromContext(ctx)
+	ustoreResource := &unumv1alpha1.UStore{}
+	err := r.Get(ctx, types.NamespacedName{Name: backup.Spec.UStoreName, Namespace: backup.Namespace}, ustoreResource)
+	if err != nil && errors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		logger.Error(err, "Failed to get UStore")
+		return err
+	}
+	if ustoreResource.Annotations[ustore_backup_pause_annotation] != backup.Name {
+		return nil
+	}
+	patchDiff := client.MergeFrom(ustoreResource.DeepCopy())
+	delete(ustoreResource.Annotations, ustore_backup_pause_annotation)
+	logger.Info("Scaling UStore back up after backup", "UStore.Name", ustoreResource.Name)
+	if err := r.Patch(ctx, ustoreResource, patchDiff); err != nil {
+		logger.Error(err, "Failed to resume UStore", "UStore.Name", ustoreResource.Name)
+		return err
+	}
+	return nil
+}
+
+func (r *UStoreBackupReconciler) failBackup(ctx context.Context, backup *unumv1alpha1.UStoreBackup, message string) error {
+	if err := r.resumeUStore(ctx, backup); err != nil {
+		return err
+	}
+	return r.setBackupPhase(ctx, backup, unumv1alpha1.PhaseFailed, message)
+}
+
+func (r *UStoreBackupReconciler) setBackupPhase(ctx context.Context, backup *unumv1alpha1.UStoreBackup, phase string, message string) error {
+	if backup.Status.Phase == phase && backup.Status.Message == message {
+		return nil
+	}
+	backup.Status.Phase = phase
+	backup.Status.Message = message
+	if err := r.Status().Update(ctx, backup); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to update UStoreBackup status")
+		return err
+	}
+	return nil
+}
+
+// releaseBackupPause scales the UStore back up when the UStoreBackup that paused it is gone
+// or finished without resuming it.
+func (r *UStoreReconciler) releaseBackupPause(ctx context.Context, ustoreResource *unumv1alpha1.UStore) error {
+	name := ustoreResource.Annotations[ustore_backup_pause_annotation]
+	if name == "" {
+		return nil
+	}
+	logger := log.FromContext(ctx)
+	backup := &unumv1alpha1.UStoreBackup{}
+	err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: ustoreResource.Namespace}, backup)
+	if err != nil && !errors.IsNotFound(err) {
+		logger.Error(err, "Failed to get UStoreBackup", "UStoreBackup.Name", name)
+		return err
+	}
+	if err == nil && backup.DeletionTimestamp.IsZero() &&
+		backup.Status.Phase != unumv1alpha1.PhaseCompleted && backup.Status.Phase != unumv1alpha1.PhaseFailed {
+		return nil
+	}
+
+	patchDiff := client.MergeFrom(ustoreResource.DeepCopy())
+	delete(ustoreResource.Annotations, ustore_backup_pause_annotation)
+	logger.Info("Releasing stale backup pause", "UStoreBackup.Name", name)
+	if err := r.Patch(ctx, ustoreResource, patchDiff); err != nil {
+		logger.Error(err, "Failed to release backup pause")
+		return err
+	}
+	return nil
+}
+
+// setCompletion records the completion time of a finished Job and the elapsed time since start.
+func setCompletion(job *batchv1.Job, completionTime **metav1.Time, duration *string, startTime *metav1.Time) {
+	completed := metav1.Now()
+	if job.Status.CompletionTime != nil {
+		completed = *job.Status.CompletionTime
+	}
+	*completionTime = &completed
+	if startTime != nil {
+		*duration = completed.Sub(startTime.Time).Round(time.Second).String()
+	}
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *UStoreBackupReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.Images = r.Images.withDefaults()
+	r.openShift = servesSecurityContextConstraints(mgr)
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&unumv1alpha1.UStoreBackup{}).
+		Owns(&batchv1.Job{}).
+		Complete(r)
+}
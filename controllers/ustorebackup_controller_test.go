@@ -0,0 +1,146 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+	"github.com/opdev/ustore-operator/controllers/utils"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestBackupStopsUStoreBeforeTheJob(t *testing.T) {
+	tests := []struct {
+		name      string
+		podsLeft  bool
+		startedAt *metav1.Time
+		phase     string
+		job       bool
+		paused    bool
+	}{
+		{name: "pods running", podsLeft: true, phase: unumv1alpha1.PhasePending, paused: true},
+		{name: "pods stopped", phase: unumv1alpha1.PhaseRunning, job: true, paused: true},
+		{
+			name:      "pods not stopping in time",
+			podsLeft:  true,
+			startedAt: &metav1.Time{Time: time.Now().Add(-2 * ustore_backup_quiesce_timeout)},
+			phase:     unumv1alpha1.PhaseFailed,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ustoreResource := &unumv1alpha1.UStore{
+				ObjectMeta: metav1.ObjectMeta{Name: "ustore", Namespace: "default"},
+				Spec: unumv1alpha1.UStoreSpec{
+					NumOfInstances: 1,
+					Volumes:        []unumv1alpha1.Persistence{{MountPath: "/mnt/ustore", Size: "1Gi"}},
+				},
+			}
+			backup := &unumv1alpha1.UStoreBackup{
+				ObjectMeta: metav1.ObjectMeta{Name: "backup", Namespace: "default"},
+				Spec: unumv1alpha1.UStoreBackupSpec{
+					UStoreName:  "ustore",
+					Destination: unumv1alpha1.BackupDestination{PVC: &unumv1alpha1.PVCDestination{ClaimName: "backups"}},
+				},
+				Status: unumv1alpha1.UStoreBackupStatus{StartTime: test.startedAt},
+			}
+			objects := []client.Object{ustoreResource, backup}
+			if test.podsLeft {
+				objects = append(objects, &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{Name: "ustore-0", Namespace: "default", Labels: utils.LabelsForUStore("ustore")},
+				})
+			}
+			c := fake.NewClientBuilder().WithScheme(testScheme(t)).WithObjects(objects...).WithStatusSubresource(backup).Build()
+			r := &UStoreBackupReconciler{Client: c, Scheme: c.Scheme(), Images: Images{}.withDefaults()}
+
+			key := types.NamespacedName{Name: "backup", Namespace: "default"}
+			if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := c.Get(context.Background(), key, backup); err != nil {
+				t.Fatal(err)
+			}
+			if backup.Status.Phase != test.phase {
+				t.Errorf("expected phase %s, got %s: %s", test.phase, backup.Status.Phase, backup.Status.Message)
+			}
+			if test.startedAt == nil && (backup.Status.StartTime == nil || backup.Status.Location == "" || backup.Status.SourceSpec == nil) {
+				t.Errorf("expected the start time, location and source spec to be recorded, got %+v", backup.Status)
+			}
+
+			err := c.Get(context.Background(), types.NamespacedName{Name: backupJobName(backup), Namespace: "default"}, &batchv1.Job{})
+			if test.job != (err == nil) {
+				t.Errorf("expected a Job %v, got %v", test.job, err)
+			} else if err != nil && !errors.IsNotFound(err) {
+				t.Fatal(err)
+			}
+
+			if err := c.Get(context.Background(), types.NamespacedName{Name: "ustore", Namespace: "default"}, ustoreResource); err != nil {
+				t.Fatal(err)
+			}
+			if paused := ustoreResource.Annotations[ustore_backup_pause_annotation] == backup.Name; paused != test.paused {
+				t.Errorf("expected paused %v, got annotations %v", test.paused, ustoreResource.Annotations)
+			}
+		})
+	}
+}
+
+func TestBackupFinalizerDeletesArchive(t *testing.T) {
+	ctx := context.Background()
+	now := metav1.Now()
+	backup := &unumv1alpha1.UStoreBackup{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "backup",
+			Namespace:         "default",
+			Finalizers:        []string{ustore_backup_archive_finalizer},
+			DeletionTimestamp: &now,
+		},
+		Spec: unumv1alpha1.UStoreBackupSpec{
+			UStoreName:  "ustore",
+			Destination: unumv1alpha1.BackupDestination{PVC: &unumv1alpha1.PVCDestination{ClaimName: "backups"}},
+		},
+		Status: unumv1alpha1.UStoreBackupStatus{
+			Phase:      unumv1alpha1.PhaseCompleted,
+			Location:   "pvc://backups/ustore/backup.tar.gz",
+			SourceSpec: &unumv1alpha1.UStoreSpec{Volumes: []unumv1alpha1.Persistence{{MountPath: "/mnt/ustore", Size: "1Gi"}}},
+		},
+	}
+	c := fake.NewClientBuilder().WithScheme(testScheme(t)).WithObjects(backup).WithStatusSubresource(backup).Build()
+	r := &UStoreBackupReconciler{Client: c, Scheme: c.Scheme(), Images: Images{}.withDefaults()}
+	key := types.NamespacedName{Name: "backup", Namespace: "default"}
+
+	// the backup stays until the cleanup Job completed
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	job := &batchv1.Job{}
+	if err := c.Get(ctx, types.NamespacedName{Name: archiveCleanupJobName(backup), Namespace: "default"}, job); err != nil {
+		t.Fatalf("expected a cleanup Job: %v", err)
+	}
+	if err := c.Get(ctx, key, &unumv1alpha1.UStoreBackup{}); err != nil {
+		t.Fatalf("expected the backup to wait for the cleanup Job: %v", err)
+	}
+
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+	if err := c.Status().Update(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, key, &unumv1alpha1.UStoreBackup{}); !errors.IsNotFound(err) {
+		t.Errorf("expected the backup to be deleted, got %v", err)
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(job), &batchv1.Job{}); !errors.IsNotFound(err) {
+		t.Errorf("expected the cleanup Job to be deleted, got %v", err)
+	}
+}
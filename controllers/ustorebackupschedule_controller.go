@@ -0,0 +1,248 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+	"github.com/robfig/cron/v3"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// UStoreBackupScheduleReconciler reconciles a UStoreBackupSchedule object
+type UStoreBackupScheduleReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups=unum.cloud,resources=ustorebackupschedules,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=unum.cloud,resources=ustorebackupschedules/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=unum.cloud,resources=ustorebackupschedules/finalizers,verbs=update
+
+// Reconcile creates a UStoreBackup for the most recent missed run of the schedule, applies the
+// retention rules to the backups of the schedule and requeues at the next run.
+// A run is skipped while a previous backup of the schedule is still in progress, and recorded
+// in lastScheduleTime so it is not caught up once the backup finishes.
+func (r *UStoreBackupScheduleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	var schedule unumv1alpha1.UStoreBackupSchedule
+	if err := r.Get(ctx, req.NamespacedName, &schedule); err != nil {
+		if errors.IsNotFound(err) {
+			logger.Info("UStoreBackupSchedule resource not found. Ignoring since object must be deleted")
+			return ctrl.Result{}, nil
+		}
+		logger.Error(err, "Failed to get UStoreBackupSchedule resource")
+		return ctrl.Result{}, err
+	}
+
+	backups := &unumv1alpha1.UStoreBackupList{}
+	if err := r.List(ctx, backups, client.InNamespace(schedule.Namespace), client.MatchingLabels{ustore_backup_schedule_label: schedule.Name}); err != nil {
+		logger.Error(err, "Failed to list UStoreBackups")
+		return ctrl.Result{}, err
+	}
+
+	setScheduleStatus(&schedule, backups.Items)
+	if err := r.applyRetention(ctx, &schedule, backups.Items); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	result := ctrl.Result{}
+	cronSchedule, err := cron.ParseStandard(schedule.Spec.Schedule)
+	if err != nil {
+		schedule.Status.Message = fmt.Sprintf("Invalid schedule %q: %v", schedule.Spec.Schedule, err)
+	} else {
+		schedule.Status.Message = ""
+		now := time.Now()
+		lastRun, tooManyMissed := lastScheduledRun(&schedule, cronSchedule, now)
+		if tooManyMissed {
+			// like a CronJob, a long outage is not caught up
+			logger.Info("Skipping missed runs", "MaxMissedRuns", maxMissedRuns)
+			schedule.Status.Message = fmt.Sprintf("More than %d runs were missed, they were skipped", maxMissedRuns)
+			skippedAt := metav1.NewTime(now)
+			schedule.Status.LastScheduleTime = &skippedAt
+		} else if lastRun != nil && !schedule.Spec.Suspend {
+			if len(schedule.Status.Active) == 0 {
+				backup, err := r.createScheduledBackup(ctx, &schedule, *lastRun)
+				if err != nil {
+					return ctrl.Result{}, err
+				}
+				schedule.Status.Active = append(schedule.Status.Active, backup.Name)
+			} else {
+				logger.Info("Skipping a scheduled run while a UStoreBackup is in progress", "UStoreBackup.Name", schedule.Status.Active[0])
+			}
+			scheduledAt := metav1.NewTime(*lastRun)
+			schedule.Status.LastScheduleTime = &scheduledAt
+		}
+		result.RequeueAfter = cronSchedule.Next(now).Sub(now)
+	}
+
+	if err := r.Status().Update(ctx, &schedule); err != nil {
+		logger.Error(err, "Failed to update UStoreBackupSchedule status")
+		return ctrl.Result{}, err
+	}
+	return result, nil
+}
+
+// maxMissedRuns is the number of missed runs past which a schedule stops looking for the most
+// recent one, as for a CronJob.
+const maxMissedRuns = 100
+
+// lastScheduledRun returns the most recent run time missed since the last backup, if any, and
+// whether more than maxMissedRuns were missed, in which case no run is returned.
+func lastScheduledRun(schedule *unumv1alpha1.UStoreBackupSchedule, cronSchedule cron.Schedule, now time.Time) (*time.Time, bool) {
+	earliest := schedule.CreationTimestamp.Time
+	if schedule.Status.LastScheduleTime != nil {
+		earliest = schedule.Status.LastScheduleTime.Time
+	}
+	var lastRun *time.Time
+	missed := 0
+	for t := cronSchedule.Next(earliest); !t.After(now); t = cronSchedule.Next(t) {
+		missed++
+		if missed > maxMissedRuns {
+			return nil, true
+		}
+		run := t
+		lastRun = &run
+	}
+	return lastRun, false
+}
+
+// createScheduledBackup creates the backup of a run, named after the run time so a run
+// is never backed up twice.
+func (r *UStoreBackupScheduleReconciler) createScheduledBackup(ctx context.Context, schedule *unumv1alpha1.UStoreBackupSchedule, scheduledTime time.Time) (*unumv1alpha1.UStoreBackup, error) {
+	logger := log.FromContext(ctx)
+	backup := &unumv1alpha1.UStoreBackup{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-%d", schedule.Name, scheduledTime.Unix()/60),
+			Namespace: schedule.Namespace,
+			Labels: map[string]string{
+				ustore_backup_schedule_label: schedule.Name,
+			},
+			Annotations: map[string]string{
+				ustore_scheduled_at_annotation: scheduledTime.UTC().Format(time.RFC3339),
+			},
+		},
+		Spec: unumv1alpha1.UStoreBackupSpec{
+			UStoreName:  schedule.Spec.UStoreName,
+			Destination: *schedule.Spec.Destination.DeepCopy(),
+		},
+	}
+	if err := ctrl.SetControllerReference(schedule, backup, r.Scheme); err != nil {
+		logger.Error(err, "Failed to set owner reference on UStoreBackup")
+		return nil, err
+	}
+	logger.Info("Creating a scheduled UStoreBackup", "UStoreBackup.Namespace", backup.Namespace, "UStoreBackup.Name", backup.Name)
+	if err := r.Create(ctx, backup); err != nil && !errors.IsAlreadyExists(err) {
+		logger.Error(err, "Failed to create UStoreBackup", "UStoreBackup.Name", backup.Name)
+		return nil, err
+	}
+	return backup, nil
+}
+
+// setScheduleStatus records the active backups and the last success and failure.
+func setScheduleStatus(schedule *unumv1alpha1.UStoreBackupSchedule, backups []unumv1alpha1.UStoreBackup) {
+	schedule.Status.Active = nil
+	for i := range backups {
+		backup := &backups[i]
+		switch backup.Status.Phase {
+		case unumv1alpha1.PhaseCompleted:
+			if isNewerBackup(backup.Status.CompletionTime, schedule.Status.LastSuccessfulTime) {
+				schedule.Status.LastSuccessfulBackup = backup.Name
+				schedule.Status.LastSuccessfulTime = backup.Status.CompletionTime
+			}
+		case unumv1alpha1.PhaseFailed:
+			completed := backup.Status.CompletionTime
+			if completed == nil {
+				completed = &backup.CreationTimestamp
+			}
+			if isNewerBackup(completed, schedule.Status.LastFailedTime) {
+				schedule.Status.LastFailedBackup = backup.Name
+				schedule.Status.LastFailedTime = completed
+				schedule.Status.LastFailureMessage = backup.Status.Message
+			}
+		default:
+			schedule.Status.Active = append(schedule.Status.Active, backup.Name)
+		}
+	}
+	sort.Strings(schedule.Status.Active)
+}
+
+func isNewerBackup(t *metav1.Time, than *metav1.Time) bool {
+	return t != nil && (than == nil || t.After(than.Time))
+}
+
+// applyRetention deletes the completed backups no retention rule keeps, and the failed
+// backups older than the last completed one.
+func (r *UStoreBackupScheduleReconciler) applyRetention(ctx context.Context, schedule *unumv1alpha1.UStoreBackupSchedule, backups []unumv1alpha1.UStoreBackup) error {
+	logger := log.FromContext(ctx)
+	for _, backup := range expiredBackups(schedule, backups, time.Now()) {
+		logger.Info("Deleting expired UStoreBackup", "UStoreBackup.Namespace", backup.Namespace, "UStoreBackup.Name", backup.Name)
+		if err := r.Delete(ctx, backup); err != nil && !errors.IsNotFound(err) {
+			logger.Error(err, "Failed to delete UStoreBackup", "UStoreBackup.Name", backup.Name)
+			return err
+		}
+	}
+	return nil
+}
+
+func expiredBackups(schedule *unumv1alpha1.UStoreBackupSchedule, backups []unumv1alpha1.UStoreBackup, now time.Time) []*unumv1alpha1.UStoreBackup {
+	expired := []*unumv1alpha1.UStoreBackup{}
+	lastSuccess := schedule.Status.LastSuccessfulTime
+
+	completed := []*unumv1alpha1.UStoreBackup{}
+	for i := range backups {
+		backup := &backups[i]
+		switch backup.Status.Phase {
+		case unumv1alpha1.PhaseCompleted:
+			if backup.Status.CompletionTime != nil {
+				completed = append(completed, backup)
+			}
+		case unumv1alpha1.PhaseFailed:
+			if lastSuccess != nil && backup.CreationTimestamp.Before(lastSuccess) {
+				expired = append(expired, backup)
+			}
+		}
+	}
+
+	retention := schedule.Spec.Retention
+	if retention.KeepLast == nil && retention.KeepDaily == nil {
+		return expired
+	}
+
+	// Newest first, so the first backup seen on a day is the one kept for that day.
+	sort.Slice(completed, func(i, j int) bool {
+		return completed[i].Status.CompletionTime.After(completed[j].Status.CompletionTime.Time)
+	})
+	keptDays := map[string]bool{}
+	for i, backup := range completed {
+		keep := retention.KeepLast != nil && i < int(*retention.KeepLast)
+		if retention.KeepDaily != nil {
+			completedAt := backup.Status.CompletionTime.UTC()
+			day := completedAt.Format("2006-01-02")
+			if now.Sub(completedAt) < time.Duration(*retention.KeepDaily)*24*time.Hour && !keptDays[day] {
+				keptDays[day] = true
+				keep = true
+			}
+		}
+		if !keep {
+			expired = append(expired, backup)
+		}
+	}
+	return expired
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *UStoreBackupScheduleReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&unumv1alpha1.UStoreBackupSchedule{}).
+		Owns(&unumv1alpha1.UStoreBackup{}).
+		Complete(r)
+}
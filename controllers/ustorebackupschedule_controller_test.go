@@ -0,0 +1,213 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+	"github.com/robfig/cron/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestExpiredBackups(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	hoursAgo := func(hours int) *metav1.Time {
+		at := metav1.NewTime(now.Add(-time.Duration(hours) * time.Hour))
+		return &at
+	}
+	completed := func(name string, hours int) unumv1alpha1.UStoreBackup {
+		return unumv1alpha1.UStoreBackup{
+			ObjectMeta: metav1.ObjectMeta{Name: name, CreationTimestamp: *hoursAgo(hours)},
+			Status:     unumv1alpha1.UStoreBackupStatus{Phase: unumv1alpha1.PhaseCompleted, CompletionTime: hoursAgo(hours)},
+		}
+	}
+	failed := func(name string, hours int) unumv1alpha1.UStoreBackup {
+		return unumv1alpha1.UStoreBackup{
+			ObjectMeta: metav1.ObjectMeta{Name: name, CreationTimestamp: *hoursAgo(hours)},
+			Status:     unumv1alpha1.UStoreBackupStatus{Phase: unumv1alpha1.PhaseFailed},
+		}
+	}
+	tests := []struct {
+		name        string
+		retention   unumv1alpha1.BackupRetention
+		lastSuccess *metav1.Time
+		backups     []unumv1alpha1.UStoreBackup
+		expected    []string
+	}{
+		{
+			name:        "no retention keeps every completed backup",
+			lastSuccess: hoursAgo(2),
+			backups: []unumv1alpha1.UStoreBackup{
+				completed("b1", 2), completed("b2", 100), failed("f1", 3), failed("f2", 1),
+			},
+			expected: []string{"f1"},
+		},
+		{
+			name:    "failed backups are kept until a backup succeeds",
+			backups: []unumv1alpha1.UStoreBackup{failed("f1", 3)},
+		},
+		{
+			name:      "keep last",
+			retention: unumv1alpha1.BackupRetention{KeepLast: int32Ptr(2)},
+			backups: []unumv1alpha1.UStoreBackup{
+				completed("b4", 4), completed("b1", 1), completed("b3", 3), completed("b2", 2),
+			},
+			expected: []string{"b3", "b4"},
+		},
+		{
+			name:      "keep daily keeps the newest backup of each day",
+			retention: unumv1alpha1.BackupRetention{KeepDaily: int32Ptr(2)},
+			backups: []unumv1alpha1.UStoreBackup{
+				completed("today-10h", 2), completed("today-08h", 4),
+				completed("yesterday-20h", 16), completed("yesterday-09h", 27),
+				completed("three-days-ago", 60),
+			},
+			expected: []string{"today-08h", "yesterday-09h", "three-days-ago"},
+		},
+		{
+			name:      "keep last and daily",
+			retention: unumv1alpha1.BackupRetention{KeepLast: int32Ptr(2), KeepDaily: int32Ptr(1)},
+			backups: []unumv1alpha1.UStoreBackup{
+				completed("b1", 1), completed("b2", 2), completed("b3", 3), completed("b4", 30),
+			},
+			expected: []string{"b3", "b4"},
+		},
+		{
+			name:      "backups still running are not expired",
+			retention: unumv1alpha1.BackupRetention{KeepLast: int32Ptr(1)},
+			backups: []unumv1alpha1.UStoreBackup{
+				completed("b1", 1),
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "running", CreationTimestamp: *hoursAgo(2)},
+					Status:     unumv1alpha1.UStoreBackupStatus{Phase: unumv1alpha1.PhaseRunning},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule := &unumv1alpha1.UStoreBackupSchedule{
+				Spec:   unumv1alpha1.UStoreBackupScheduleSpec{Retention: test.retention},
+				Status: unumv1alpha1.UStoreBackupScheduleStatus{LastSuccessfulTime: test.lastSuccess},
+			}
+			names := []string{}
+			for _, backup := range expiredBackups(schedule, test.backups, now) {
+				names = append(names, backup.Name)
+			}
+			expected := test.expected
+			if expected == nil {
+				expected = []string{}
+			}
+			if !reflect.DeepEqual(names, expected) {
+				t.Errorf("expected %v to expire, got %v", expected, names)
+			}
+		})
+	}
+}
+
+func TestReconcileSkipsRunsWhileActive(t *testing.T) {
+	ctx := context.Background()
+	schedule := &unumv1alpha1.UStoreBackupSchedule{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "nightly",
+			Namespace:         "default",
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-3 * time.Hour)),
+		},
+		Spec: unumv1alpha1.UStoreBackupScheduleSpec{UStoreName: "ustore", Schedule: "@hourly"},
+	}
+	running := &unumv1alpha1.UStoreBackup{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "nightly-running",
+			Namespace: "default",
+			Labels:    map[string]string{ustore_backup_schedule_label: "nightly"},
+		},
+		Status: unumv1alpha1.UStoreBackupStatus{Phase: unumv1alpha1.PhaseRunning},
+	}
+	scheme := testScheme(t)
+	r := &UStoreBackupScheduleReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).
+			WithObjects(schedule, running).
+			WithStatusSubresource(schedule, running).
+			Build(),
+		Scheme: scheme,
+	}
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(schedule)}
+	listBackups := func() []unumv1alpha1.UStoreBackup {
+		backups := &unumv1alpha1.UStoreBackupList{}
+		if err := r.List(ctx, backups, client.InNamespace("default")); err != nil {
+			t.Fatal(err)
+		}
+		return backups.Items
+	}
+
+	// the run is skipped while a backup is in progress, but recorded
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if backups := listBackups(); len(backups) != 1 {
+		t.Fatalf("expected no backup while one is in progress, got %d backups", len(backups))
+	}
+	found := &unumv1alpha1.UStoreBackupSchedule{}
+	if err := r.Get(ctx, req.NamespacedName, found); err != nil {
+		t.Fatal(err)
+	}
+	lastRun := time.Now().Truncate(time.Hour)
+	if found.Status.LastScheduleTime == nil || !found.Status.LastScheduleTime.Time.Equal(lastRun) {
+		t.Errorf("expected the skipped run %s to be recorded, got %v", lastRun, found.Status.LastScheduleTime)
+	}
+
+	// and not caught up once the backup finished
+	running.Status.Phase = unumv1alpha1.PhaseCompleted
+	if err := r.Status().Update(ctx, running); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if backups := listBackups(); len(backups) != 1 {
+		t.Errorf("expected the skipped run not to be caught up, got %d backups", len(backups))
+	}
+}
+
+func TestLastScheduledRun(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 30, 0, 0, time.UTC)
+	hourly, err := cron.ParseStandard("0 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		lastSchedule time.Time
+		lastRun      bool
+		tooMany      bool
+	}{
+		{name: "no missed run", lastSchedule: now.Add(-10 * time.Minute)},
+		{name: "missed runs catch up with the last one", lastSchedule: now.Add(-5 * time.Hour), lastRun: true},
+		{name: "too many missed runs", lastSchedule: now.Add(-(maxMissedRuns + 1) * time.Hour), tooMany: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lastSchedule := metav1.NewTime(test.lastSchedule)
+			schedule := &unumv1alpha1.UStoreBackupSchedule{
+				Status: unumv1alpha1.UStoreBackupScheduleStatus{LastScheduleTime: &lastSchedule},
+			}
+			lastRun, tooMany := lastScheduledRun(schedule, hourly, now)
+			if tooMany != test.tooMany {
+				t.Errorf("expected too many missed runs %v, got %v", test.tooMany, tooMany)
+			}
+			if !test.lastRun && lastRun != nil {
+				t.Errorf("expected no run, got %s", lastRun)
+			}
+			if test.lastRun && (lastRun == nil || !lastRun.Equal(now.Truncate(time.Hour))) {
+				t.Errorf("expected the run at %s, got %v", now.Truncate(time.Hour), lastRun)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// UStoreRestoreReconciler reconciles a UStoreRestore object
+type UStoreRestoreReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// Images run by the Jobs, the default ones when unset.
+	Images Images
+
+	// openShift is set when the cluster serves SecurityContextConstraints, which assign the pod users.
+	openShift bool
+}
+
+//+kubebuilder:rbac:groups=unum.cloud,resources=ustorerestores,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=unum.cloud,resources=ustorerestores/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=unum.cloud,resources=ustorerestores/finalizers,verbs=update
+
+// Reconcile provisions the claims of a new UStore, extracts the backup into them with a Job
+// and creates the UStore once the data is in place.
+func (r *UStoreRestoreReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	var restore unumv1alpha1.UStoreRestore
+	if err := r.Get(ctx, req.NamespacedName, &restore); err != nil {
+		if errors.IsNotFound(err) {
+			logger.Info("UStoreRestore resource not found. Ignoring since object must be deleted")
+			return ctrl.Result{}, nil
+		}
+		logger.Error(err, "Failed to get UStoreRestore resource")
+		return ctrl.Result{}, err
+	}
+
+	if restore.Status.Phase == unumv1alpha1.PhaseCompleted || restore.Status.Phase == unumv1alpha1.PhaseFailed {
+		return ctrl.Result{}, nil
+	}
+
+	backup := &unumv1alpha1.UStoreBackup{}
+	err := r.Get(ctx, types.NamespacedName{Name: restore.Spec.BackupName, Namespace: restore.Namespace}, backup)
+	if err != nil && errors.IsNotFound(err) {
+		return ctrl.Result{}, r.setRestorePhase(ctx, &restore, unumv1alpha1.PhaseFailed, fmt.Sprintf("UStoreBackup %s not found", restore.Spec.BackupName))
+	} else if err != nil {
+		logger.Error(err, "Failed to get UStoreBackup")
+		return ctrl.Result{}, err
+	}
+
+	switch backup.Status.Phase {
+	case unumv1alpha1.PhaseCompleted:
+	case unumv1alpha1.PhaseFailed:
+		return ctrl.Result{}, r.setRestorePhase(ctx, &restore, unumv1alpha1.PhaseFailed, fmt.Sprintf("UStoreBackup %s failed", backup.Name))
+	default:
+		if err := r.setRestorePhase(ctx, &restore, unumv1alpha1.PhasePending, fmt.Sprintf("Waiting for UStoreBackup %s to complete", backup.Name)); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+	}
+
+	target := restoredUStore(&restore, backup)
+	if target == nil {
+		return ctrl.Result{}, r.setRestorePhase(ctx, &restore, unumv1alpha1.PhaseFailed, "No UStore spec in the restore or the backup")
+	}
+	if blockVolumes(target) {
+		return ctrl.Result{}, r.setRestorePhase(ctx, &restore, unumv1alpha1.PhaseFailed, "Block volumes cannot be restored from an archive, use a UStoreSnapshot instead")
+	}
+
+	existing := &unumv1alpha1.UStore{}
+	err = r.Get(ctx, types.NamespacedName{Name: target.Name, Namespace: target.Namespace}, existing)
+	if err == nil {
+		if existing.Annotations[ustore_restored_from_annotation] != restore.Name {
+			return ctrl.Result{}, r.setRestorePhase(ctx, &restore, unumv1alpha1.PhaseFailed, fmt.Sprintf("UStore %s already exists", target.Name))
+		}
+	} else if !errors.IsNotFound(err) {
+		logger.Error(err, "Failed to get UStore")
+		return ctrl.Result{}, err
+	}
+
+	job := &batchv1.Job{}
+	err = r.Get(ctx, types.NamespacedName{Name: restoreJobName(&restore), Namespace: restore.Namespace}, job)
+	if err != nil && errors.IsNotFound(err) {
+		return ctrl.Result{}, r.startRestoreJob(ctx, &restore, backup, target)
+	} else if err != nil {
+		logger.Error(err, "Failed to get restore Job")
+		return ctrl.Result{}, err
+	}
+
+	finished, failure := jobFinished(job)
+	if !finished {
+		return ctrl.Result{}, nil
+	}
+	if failure != "" {
+		setCompletion(job, &restore.Status.CompletionTime, &restore.Status.Duration, restore.Status.StartTime)
+		return ctrl.Result{}, r.setRestorePhase(ctx, &restore, unumv1alpha1.PhaseFailed, failure)
+	}
+
+	if err := r.createRestoredUStore(ctx, &restore, target); err != nil {
+		return ctrl.Result{}, err
+	}
+	setCompletion(job, &restore.Status.CompletionTime, &restore.Status.Duration, restore.Status.StartTime)
+	return ctrl.Result{}, r.setRestorePhase(ctx, &restore, unumv1alpha1.PhaseCompleted, "")
+}
+
+// restoredUStore returns the UStore to provision, or nil when no spec is known.
+func restoredUStore(restore *unumv1alpha1.UStoreRestore, backup *unumv1alpha1.UStoreBackup) *unumv1alpha1.UStore {
+	spec := restore.Spec.UStoreSpec
+	if spec == nil {
+		spec = backup.Status.SourceSpec
+	}
+	if spec == nil {
+		return nil
+	}
+	return &unumv1alpha1.UStore{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      restore.Spec.UStoreName,
+			Namespace: restore.Namespace,
+			Annotations: map[string]string{
+				ustore_restored_from_annotation: restore.Name,
+			},
+		},
+		Spec: *spec.DeepCopy(),
+	}
+}
+
+// startRestoreJob creates the claims of the restored UStore and the Job filling them.
+func (r *UStoreRestoreReconciler) startRestoreJob(ctx context.Context, restore *unumv1alpha1.UStoreRestore, backup *unumv1alpha1.UStoreBackup, target *unumv1alpha1.UStore) error {
+	logger := log.FromContext(ctx)
+
+	for _, volume := range target.Spec.Volumes {
+		for _, claimName := range claimNamesForVolume(target, volume) {
+			if err := r.getOrCreateRestoreClaim(ctx, restore, claimName, volume, target); err != nil {
+				return err
+			}
+		}
+	}
+
+	job := restoreJobForUStore(restore, backup, target, r.Images, r.openShift)
+	if err := ctrl.SetControllerReference(restore, job, r.Scheme); err != nil {
+		logger.Error(err, "Failed to set owner reference on restore Job")
+		return err
+	}
+	logger.Info("Creating a new restore Job", "Job.Namespace", job.Namespace, "Job.Name", job.Name)
+	if err := r.Create(ctx, job); err != nil {
+		logger.Error(err, "Failed to create restore Job", "Job.Namespace", job.Namespace, "Job.Name", job.Name)
+		return err
+	}
+
+	now := metav1.Now()
+	restore.Status.JobName = job.Name
+	restore.Status.StartTime = &now
+	return r.setRestorePhase(ctx, restore, unumv1alpha1.PhaseRunning, "")
+}
+
+// getOrCreateRestoreClaim creates a claim under the name the UStore controller will look for.
+// The restore controls the claim until the UStore exists, so a failed restore takes it along.
+func (r *UStoreRestoreReconciler) getOrCreateRestoreClaim(ctx context.Context, restore *unumv1alpha1.UStoreRestore, name string, volume unumv1alpha1.Persistence, target *unumv1alpha1.UStore) error {
+	logger := log.FromContext(ctx)
+	found := &corev1.PersistentVolumeClaim{}
+	err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: target.Namespace}, found)
+	if err == nil {
+		return nil
+	} else if !errors.IsNotFound(err) {
+		logger.Error(err, "Failed to get PVC", "PVC.Name", name)
+		return err
+	}
+
+	claimSpec, err := claimSpecForVolume(volume)
+	if err != nil {
+		return err
+	}
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: claimMetaForVolume(target, name, volume),
+		Spec:       claimSpec,
+	}
+	if err := ctrl.SetControllerReference(restore, pvc, r.Scheme); err != nil {
+		logger.Error(err, "Failed to set owner reference on PVC", "PVC.Name", name)
+		return err
+	}
+	logger.Info("Creating a new PVC", "Namespace", target.Namespace, "Name", name)
+	if err := r.Create(ctx, pvc); err != nil {
+		logger.Error(err, "Failed to create PVC", "PVC.Name", name)
+		return err
+	}
+	return nil
+}
+
+// createRestoredUStore creates the UStore and hands the restored claims over to it. A Deployment
+// UStore becomes their controller as if it had created them itself, StatefulSet claims are left
+// to the retention policy of the StatefulSet like the claims it creates.
+func (r *UStoreRestoreReconciler) createRestoredUStore(ctx context.Context, restore *unumv1alpha1.UStoreRestore, target *unumv1alpha1.UStore) error {
+	logger := log.FromContext(ctx)
+
+	ustoreResource := &unumv1alpha1.UStore{}
+	err := r.Get(ctx, types.NamespacedName{Name: target.Name, Namespace: target.Namespace}, ustoreResource)
+	if err != nil && errors.IsNotFound(err) {
+		logger.Info("Creating the restored UStore", "UStore.Namespace", target.Namespace, "UStore.Name", target.Name)
+		if err := r.Create(ctx, target); err != nil {
+			logger.Error(err, "Failed to create UStore", "UStore.Name", target.Name)
+			return err
+		}
+		ustoreResource = target
+	} else if err != nil {
+		logger.Error(err, "Failed to get UStore")
+		return err
+	}
+
+	for _, name := range claimNamesForUStore(ustoreResource) {
+		pvc := &corev1.PersistentVolumeClaim{}
+		if err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: ustoreResource.Namespace}, pvc); err != nil {
+			logger.Error(err, "Failed to get PVC", "PVC.Name", name)
+			return err
+		}
+		patchDiff := client.MergeFrom(pvc.DeepCopy())
+		pvc.OwnerReferences = removeOwner(pvc.OwnerReferences, restore.UID)
+		if !isStatefulSet(ustoreResource) && metav1.GetControllerOf(pvc) == nil {
+			if err := ctrl.SetControllerReference(ustoreResource, pvc, r.Scheme); err != nil {
+				logger.Error(err, "Failed to set owner reference on PVC", "PVC.Name", name)
+				return err
+			}
+		}
+		if err := r.Patch(ctx, pvc, patchDiff); err != nil {
+			logger.Error(err, "Failed to hand over PVC", "PVC.Name", name)
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *UStoreRestoreReconciler) setRestorePhase(ctx context.Context, restore *unumv1alpha1.UStoreRestore, phase string, message string) error {
+	if restore.Status.Phase == phase && restore.Status.Message == message {
+		return nil
+	}
+	restore.Status.Phase = phase
+	restore.Status.Message = message
+	if err := r.Status().Update(ctx, restore); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to update UStoreRestore status")
+		return err
+	}
+	return nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *UStoreRestoreReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.Images = r.Images.withDefaults()
+	r.openShift = servesSecurityContextConstraints(mgr)
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&unumv1alpha1.UStoreRestore{}).
+		Owns(&batchv1.Job{}).
+		Complete(r)
+}
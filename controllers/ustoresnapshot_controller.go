@@ -0,0 +1,326 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+	"github.com/opdev/ustore-operator/controllers/utils"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// snapshotPollInterval is how often a snapshot in progress is checked when VolumeSnapshot
+// events are not watched or the UStore pods are stopping.
+const snapshotPollInterval = 5 * time.Second
+
+// UStoreSnapshotReconciler reconciles a UStoreSnapshot object
+type UStoreSnapshotReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups=unum.cloud,resources=ustoresnapshots,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=unum.cloud,resources=ustoresnapshots/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=unum.cloud,resources=ustoresnapshots/finalizers,verbs=update
+//+kubebuilder:rbac:groups=snapshot.storage.k8s.io,resources=volumesnapshots,verbs=get;list;watch;create;delete
+
+// Reconcile creates a VolumeSnapshot of every claim of the UStore in one pass. With scaleToZero
+// the UStore is scaled down first and scaled back up as soon as all snapshots are cut, before
+// they are ready to use.
+func (r *UStoreSnapshotReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	var snapshot unumv1alpha1.UStoreSnapshot
+	if err := r.Get(ctx, req.NamespacedName, &snapshot); err != nil {
+		if errors.IsNotFound(err) {
+			logger.Info("UStoreSnapshot resource not found. Ignoring since object must be deleted")
+			return ctrl.Result{}, nil
+		}
+		logger.Error(err, "Failed to get UStoreSnapshot resource")
+		return ctrl.Result{}, err
+	}
+
+	if snapshot.Status.Phase == unumv1alpha1.PhaseCompleted || snapshot.Status.Phase == unumv1alpha1.PhaseFailed {
+		return ctrl.Result{}, nil
+	}
+
+	ustoreResource := &unumv1alpha1.UStore{}
+	err := r.Get(ctx, types.NamespacedName{Name: snapshot.Spec.UStoreName, Namespace: snapshot.Namespace}, ustoreResource)
+	if err != nil && errors.IsNotFound(err) {
+		return ctrl.Result{}, r.setSnapshotPhase(ctx, &snapshot, unumv1alpha1.PhaseFailed, fmt.Sprintf("UStore %s not found", snapshot.Spec.UStoreName))
+	} else if err != nil {
+		logger.Error(err, "Failed to get UStore")
+		return ctrl.Result{}, err
+	}
+	if len(ustoreResource.Spec.Volumes) == 0 {
+		return ctrl.Result{}, r.setSnapshotPhase(ctx, &snapshot, unumv1alpha1.PhaseFailed, fmt.Sprintf("UStore %s has no volumes to snapshot", ustoreResource.Name))
+	}
+
+	volumeSnapshots, err := r.volumeSnapshotsForUStore(ctx, &snapshot, ustoreResource)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	cut := allSnapshotsCut(volumeSnapshots)
+
+	if scaleToZeroForSnapshot(&snapshot, ustoreResource) && !cut {
+		paused, err := r.pauseUStore(ctx, &snapshot, ustoreResource)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if !paused {
+			if err := r.setSnapshotPhase(ctx, &snapshot, unumv1alpha1.PhasePending, "Waiting for UStore pods to stop"); err != nil {
+				return ctrl.Result{}, err
+			}
+			return ctrl.Result{RequeueAfter: snapshotPollInterval}, nil
+		}
+	}
+
+	for _, volumeSnapshot := range volumeSnapshots {
+		if volumeSnapshot.CreationTimestamp.IsZero() {
+			if err := r.createVolumeSnapshot(ctx, &snapshot, volumeSnapshot); err != nil {
+				return ctrl.Result{}, r.failSnapshot(ctx, &snapshot, ustoreResource, fmt.Sprintf("Failed to create VolumeSnapshot %s: %v", volumeSnapshot.Name, err))
+			}
+		}
+	}
+
+	snapshot.Status.Volumes = volumeSnapshotStatuses(ustoreResource, volumeSnapshots)
+	for _, volumeSnapshot := range volumeSnapshots {
+		if volumeSnapshot.Status != nil && volumeSnapshot.Status.Error != nil && volumeSnapshot.Status.Error.Message != nil {
+			return ctrl.Result{}, r.failSnapshot(ctx, &snapshot, ustoreResource, fmt.Sprintf("VolumeSnapshot %s failed: %s", volumeSnapshot.Name, *volumeSnapshot.Status.Error.Message))
+		}
+	}
+
+	if cut {
+		if err := r.resumeUStore(ctx, &snapshot, ustoreResource); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	if allSnapshotsReady(volumeSnapshots) {
+		now := metav1.Now()
+		snapshot.Status.ReadyTime = &now
+		return ctrl.Result{}, r.setSnapshotPhase(ctx, &snapshot, unumv1alpha1.PhaseCompleted, "")
+	}
+	if err := r.setSnapshotPhase(ctx, &snapshot, unumv1alpha1.PhaseRunning, "Waiting for the VolumeSnapshots to be ready"); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: snapshotPollInterval}, nil
+}
+
+// volumeSnapshotsForUStore returns a VolumeSnapshot per UStore claim, the existing object when
+// it was created already and an unsaved one otherwise.
+func (r *UStoreSnapshotReconciler) volumeSnapshotsForUStore(ctx context.Context, snapshot *unumv1alpha1.UStoreSnapshot, ustoreResource *unumv1alpha1.UStore) ([]*snapshotv1.VolumeSnapshot, error) {
+	logger := log.FromContext(ctx)
+	className := ""
+	if ustoreResource.Spec.Snapshots != nil {
+		className = ustoreResource.Spec.Snapshots.VolumeSnapshotClassName
+	}
+	if snapshot.Spec.VolumeSnapshotClassName != "" {
+		className = snapshot.Spec.VolumeSnapshotClassName
+	}
+
+	volumeSnapshots := []*snapshotv1.VolumeSnapshot{}
+	for _, volume := range ustoreResource.Spec.Volumes {
+		for _, claimName := range claimNamesForVolume(ustoreResource, volume) {
+			name := fmt.Sprintf("%s-%s", snapshot.Name, claimName)
+			found := &snapshotv1.VolumeSnapshot{}
+			err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: snapshot.Namespace}, found)
+			if err == nil {
+				volumeSnapshots = append(volumeSnapshots, found)
+				continue
+			} else if !errors.IsNotFound(err) {
+				logger.Error(err, "Failed to get VolumeSnapshot", "VolumeSnapshot.Name", name)
+				return nil, err
+			}
+
+			claim := claimName
+			desired := &snapshotv1.VolumeSnapshot{
+				ObjectMeta: utils.SetObjectMeta(name, snapshot.Namespace, map[string]string{ustore_snapshot_label: snapshot.Name}),
+				Spec: snapshotv1.VolumeSnapshotSpec{
+					Source: snapshotv1.VolumeSnapshotSource{PersistentVolumeClaimName: &claim},
+				},
+			}
+			if className != "" {
+				desired.Spec.VolumeSnapshotClassName = &className
+			}
+			volumeSnapshots = append(volumeSnapshots, desired)
+		}
+	}
+	return volumeSnapshots, nil
+}
+
+func (r *UStoreSnapshotReconciler) createVolumeSnapshot(ctx context.Context, snapshot *unumv1alpha1.UStoreSnapshot, volumeSnapshot *snapshotv1.VolumeSnapshot) error {
+	logger := log.FromContext(ctx)
+	if err := ctrl.SetControllerReference(snapshot, volumeSnapshot, r.Scheme); err != nil {
+		logger.Error(err, "Failed to set owner reference on VolumeSnapshot")
+		return err
+	}
+	logger.Info("Creating a new VolumeSnapshot", "VolumeSnapshot.Namespace", volumeSnapshot.Namespace, "VolumeSnapshot.Name", volumeSnapshot.Name)
+	if err := r.Create(ctx, volumeSnapshot); err != nil {
+		logger.Error(err, "Failed to create VolumeSnapshot", "VolumeSnapshot.Name", volumeSnapshot.Name)
+		return err
+	}
+	return nil
+}
+
+// scaleToZeroForSnapshot returns the scaleToZero setting of the snapshot, defaulting to the UStore one.
+func scaleToZeroForSnapshot(snapshot *unumv1alpha1.UStoreSnapshot, ustoreResource *unumv1alpha1.UStore) bool {
+	if snapshot.Spec.ScaleToZero != nil {
+		return *snapshot.Spec.ScaleToZero
+	}
+	return ustoreResource.Spec.Snapshots != nil && ustoreResource.Spec.Snapshots.ScaleToZero
+}
+
+// pauseUStore scales the UStore to zero through an annotation and reports whether its pods are gone.
+// Only one snapshot may pause a UStore at a time.
+func (r *UStoreSnapshotReconciler) pauseUStore(ctx context.Context, snapshot *unumv1alpha1.UStoreSnapshot, ustoreResource *unumv1alpha1.UStore) (bool, error) {
+	logger := log.FromContext(ctx)
+	switch ustoreResource.Annotations[ustore_snapshot_pause_annotation] {
+	case snapshot.Name:
+	case "":
+		patchDiff := client.MergeFrom(ustoreResource.DeepCopy())
+		if ustoreResource.Annotations == nil {
+			ustoreResource.Annotations = map[string]string{}
+		}
+		ustoreResource.Annotations[ustore_snapshot_pause_annotation] = snapshot.Name
+		logger.Info("Scaling UStore to zero for snapshot", "UStore.Name", ustoreResource.Name)
+		if err := r.Patch(ctx, ustoreResource, patchDiff); err != nil {
+			logger.Error(err, "Failed to pause UStore", "UStore.Name", ustoreResource.Name)
+			return false, err
+		}
+	default:
+		return false, nil
+	}
+
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(ustoreResource.Namespace), client.MatchingLabels(utils.LabelsForUStore(ustoreResource.Name))); err != nil {
+		logger.Error(err, "Failed to list UStore pods")
+		return false, err
+	}
+	return len(pods.Items) == 0, nil
+}
+
+// resumeUStore removes the pause annotation set by this snapshot.
+func (r *UStoreSnapshotReconciler) resumeUStore(ctx context.Context, snapshot *unumv1alpha1.UStoreSnapshot, ustoreResource *unumv1alpha1.UStore) error {
+	if ustoreResource.Annotations[ustore_snapshot_pause_annotation] != snapshot.Name {
+		return nil
+	}
+	logger := log.FromContext(ctx)
+	patchDiff := client.MergeFrom(ustoreResource.DeepCopy())
+	delete(ustoreResource.Annotations, ustore_snapshot_pause_annotation)
+	logger.Info("Scaling UStore back up after snapshot", "UStore.Name", ustoreResource.Name)
+	if err := r.Patch(ctx, ustoreResource, patchDiff); err != nil {
+		logger.Error(err, "Failed to resume UStore", "UStore.Name", ustoreResource.Name)
+		return err
+	}
+	return nil
+}
+
+func (r *UStoreSnapshotReconciler) failSnapshot(ctx context.Context, snapshot *unumv1alpha1.UStoreSnapshot, ustoreResource *unumv1alpha1.UStore, message string) error {
+	if err := r.resumeUStore(ctx, snapshot, ustoreResource); err != nil {
+		return err
+	}
+	return r.setSnapshotPhase(ctx, snapshot, unumv1alpha1.PhaseFailed, message)
+}
+
+func (r *UStoreSnapshotReconciler) setSnapshotPhase(ctx context.Context, snapshot *unumv1alpha1.UStoreSnapshot, phase string, message string) error {
+	snapshot.Status.Phase = phase
+	snapshot.Status.Message = message
+	if err := r.Status().Update(ctx, snapshot); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to update UStoreSnapshot status")
+		return err
+	}
+	return nil
+}
+
+// allSnapshotsCut reports whether the point in time of every snapshot has been taken.
+func allSnapshotsCut(volumeSnapshots []*snapshotv1.VolumeSnapshot) bool {
+	for _, volumeSnapshot := range volumeSnapshots {
+		if volumeSnapshot.Status == nil || volumeSnapshot.Status.CreationTime == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func allSnapshotsReady(volumeSnapshots []*snapshotv1.VolumeSnapshot) bool {
+	for _, volumeSnapshot := range volumeSnapshots {
+		if volumeSnapshot.Status == nil || volumeSnapshot.Status.ReadyToUse == nil || !*volumeSnapshot.Status.ReadyToUse {
+			return false
+		}
+	}
+	return true
+}
+
+func volumeSnapshotStatuses(ustoreResource *unumv1alpha1.UStore, volumeSnapshots []*snapshotv1.VolumeSnapshot) []unumv1alpha1.VolumeSnapshotStatus {
+	statuses := []unumv1alpha1.VolumeSnapshotStatus{}
+	i := 0
+	for _, volume := range ustoreResource.Spec.Volumes {
+		for _, claimName := range claimNamesForVolume(ustoreResource, volume) {
+			volumeSnapshot := volumeSnapshots[i]
+			i++
+			status := unumv1alpha1.VolumeSnapshotStatus{
+				MountPath:          volume.MountPath,
+				ClaimName:          claimName,
+				VolumeSnapshotName: volumeSnapshot.Name,
+			}
+			if volumeSnapshot.Status != nil {
+				status.ReadyToUse = volumeSnapshot.Status.ReadyToUse != nil && *volumeSnapshot.Status.ReadyToUse
+				status.RestoreSize = volumeSnapshot.Status.RestoreSize
+			}
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
+
+// SetupWithManager sets up the controller with the Manager. VolumeSnapshots are only watched
+// when the snapshot API is installed, otherwise snapshots fail when they are created.
+func (r *UStoreSnapshotReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	builder := ctrl.NewControllerManagedBy(mgr).
+		For(&unumv1alpha1.UStoreSnapshot{})
+	volumeSnapshotKind := schema.GroupKind{Group: snapshotv1.GroupName, Kind: "VolumeSnapshot"}
+	if _, err := mgr.GetRESTMapper().RESTMapping(volumeSnapshotKind, snapshotv1.SchemeGroupVersion.Version); err == nil {
+		builder = builder.Owns(&snapshotv1.VolumeSnapshot{})
+	}
+	return builder.Complete(r)
+}
+
+// releaseSnapshotPause scales the UStore back up when the UStoreSnapshot that paused it is gone
+// or finished, e.g. when it was deleted while the UStore was scaled to zero.
+func (r *UStoreReconciler) releaseSnapshotPause(ctx context.Context, ustoreResource *unumv1alpha1.UStore) error {
+	name := ustoreResource.Annotations[ustore_snapshot_pause_annotation]
+	if name == "" {
+		return nil
+	}
+	logger := log.FromContext(ctx)
+	snapshot := &unumv1alpha1.UStoreSnapshot{}
+	err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: ustoreResource.Namespace}, snapshot)
+	if err != nil && !errors.IsNotFound(err) {
+		logger.Error(err, "Failed to get UStoreSnapshot", "UStoreSnapshot.Name", name)
+		return err
+	}
+	if err == nil && snapshot.DeletionTimestamp.IsZero() &&
+		snapshot.Status.Phase != unumv1alpha1.PhaseCompleted && snapshot.Status.Phase != unumv1alpha1.PhaseFailed {
+		return nil
+	}
+
+	patchDiff := client.MergeFrom(ustoreResource.DeepCopy())
+	delete(ustoreResource.Annotations, ustore_snapshot_pause_annotation)
+	logger.Info("Releasing stale snapshot pause", "UStoreSnapshot.Name", name)
+	if err := r.Patch(ctx, ustoreResource, patchDiff); err != nil {
+		logger.Error(err, "Failed to release snapshot pause")
+		return err
+	}
+	return nil
+}
@@ -2,40 +2,369 @@ package controllers
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 
 	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
 	"github.com/opdev/ustore-operator/controllers/utils"
 	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
-type volumeToMount struct {
-	Name      string
-	ClaimName string
-	MountPath string
-	Owner     string
-}
-
-var volumeList []volumeToMount
-
+// reconcileVolumesForUStore creates the claims requested in spec.volumes and releases the claims
+// of volumes removed from it.
 func (r *UStoreReconciler) reconcileVolumesForUStore(ctx context.Context, ustoreResource *unumv1alpha1.UStore) error {
 	logger := log.FromContext(ctx)
 	for _, volume := range ustoreResource.Spec.Volumes {
-		mountName := strings.ReplaceAll(volume.MountPath, "/", "-")
-		name := ustoreResource.Name + mountName + "-volume"
+		name := claimNameForVolume(ustoreResource, volume)
 		if err := r.getOrCreatePersistence(ctx, name, volume, ustoreResource); err != nil {
 			logger.Error(err, "Failed to reconcile PVC")
 			return err
 		}
 	}
+	return r.releaseRemovedClaims(ctx, ustoreResource)
+}
+
+// releaseRemovedClaims handles the claims owned by the UStore that no longer back a volume
+// in spec.volumes. They are no longer mounted, and are deleted with the Delete retention policy
+// or released otherwise. The claims of scaled down StatefulSet replicas still back their volume.
+func (r *UStoreReconciler) releaseRemovedClaims(ctx context.Context, ustoreResource *unumv1alpha1.UStore) error {
+	logger := log.FromContext(ctx)
+	pvcs := &corev1.PersistentVolumeClaimList{}
+	if err := r.List(ctx, pvcs, client.InNamespace(ustoreResource.Namespace), client.MatchingLabels(utils.LabelsForUStore(ustoreResource.Name))); err != nil {
+		logger.Error(err, "Failed to list PVCs")
+		return err
+	}
+
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+		if claimBacksUStore(ustoreResource, pvc.Name) || !isOwnedBy(pvc, ustoreResource.UID) || !pvc.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if persistenceRetention(ustoreResource) == unumv1alpha1.PersistenceRetentionDelete {
+			logger.Info("Deleting PVC of a removed volume", "PVC.Name", pvc.Name)
+			if err := r.Delete(ctx, pvc); err != nil && !errors.IsNotFound(err) {
+				logger.Error(err, "Failed to delete PVC", "PVC.Name", pvc.Name)
+				return err
+			}
+			continue
+		}
+		patchDiff := client.MergeFrom(pvc.DeepCopy())
+		pvc.OwnerReferences = removeOwner(pvc.OwnerReferences, ustoreResource.UID)
+		// the ownerInstance label would otherwise make a UStore of the same name adopt it again
+		delete(pvc.Labels, "ownerInstance")
+		logger.Info("Retaining PVC of a removed volume", "PVC.Name", pvc.Name)
+		if err := r.Patch(ctx, pvc, patchDiff); err != nil {
+			logger.Error(err, "Failed to retain PVC", "PVC.Name", pvc.Name)
+			return err
+		}
+	}
+	return nil
+}
+
+// claimBacksUStore reports whether the claim of the given name backs a volume in spec.volumes.
+func claimBacksUStore(ustoreResource *unumv1alpha1.UStore, claimName string) bool {
+	for _, volume := range ustoreResource.Spec.Volumes {
+		if claimBacksVolume(ustoreResource, volume, claimName) {
+			return true
+		}
+	}
+	return false
+}
+
+// claimBacksVolume reports whether the claim of the given name backs a UStore volume. For a
+// StatefulSet, the claims of every ordinal do, including the ones of scaled down replicas the
+// StatefulSet keeps for when it scales up again.
+func claimBacksVolume(ustoreResource *unumv1alpha1.UStore, volume unumv1alpha1.Persistence, claimName string) bool {
+	if !isStatefulSet(ustoreResource) {
+		return claimName == claimNameForVolume(ustoreResource, volume)
+	}
+	prefix := claimTemplateNameForVolume(volume) + "-" + ustoreResource.Name + "-"
+	if !strings.HasPrefix(claimName, prefix) {
+		return false
+	}
+	_, err := strconv.ParseUint(strings.TrimPrefix(claimName, prefix), 10, 32)
+	return err == nil
+}
+
+// isOwnedBy reports whether the object has an owner reference to the given owner.
+func isOwnedBy(object metav1.Object, uid types.UID) bool {
+	for _, owner := range object.GetOwnerReferences() {
+		if owner.UID == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// claimsForVolume returns the existing claims backing a UStore volume, sorted by name. Unlike
+// claimNamesForVolume, it includes the claims of scaled down StatefulSet replicas.
+func (r *UStoreReconciler) claimsForVolume(ctx context.Context, ustoreResource *unumv1alpha1.UStore, volume unumv1alpha1.Persistence) ([]corev1.PersistentVolumeClaim, error) {
+	pvcs := &corev1.PersistentVolumeClaimList{}
+	if err := r.List(ctx, pvcs, client.InNamespace(ustoreResource.Namespace), client.MatchingLabels(utils.LabelsForUStore(ustoreResource.Name))); err != nil {
+		return nil, err
+	}
+	claims := []corev1.PersistentVolumeClaim{}
+	for _, pvc := range pvcs.Items {
+		if claimBacksVolume(ustoreResource, volume, pvc.Name) {
+			claims = append(claims, pvc)
+		}
+	}
+	sort.Slice(claims, func(i, j int) bool { return claims[i].Name < claims[j].Name })
+	return claims, nil
+}
+
+// claimNameForVolume returns the name of the PVC backing the given UStore volume.
+func claimNameForVolume(ustoreResource *unumv1alpha1.UStore, volume unumv1alpha1.Persistence) string {
+	mountName := strings.ReplaceAll(volume.MountPath, "/", "-")
+	return ustoreResource.Name + mountName + "-volume"
+}
+
+// claimNamesForUStore returns the names of all PVCs expected to back the UStore volumes.
+func claimNamesForUStore(ustoreResource *unumv1alpha1.UStore) []string {
+	names := []string{}
+	for _, volume := range ustoreResource.Spec.Volumes {
+		names = append(names, claimNamesForVolume(ustoreResource, volume)...)
+	}
+	return names
+}
+
+// claimNamesForVolume returns the names of the PVCs backing a UStore volume, one per
+// replica for a StatefulSet.
+func claimNamesForVolume(ustoreResource *unumv1alpha1.UStore, volume unumv1alpha1.Persistence) []string {
+	if isStatefulSet(ustoreResource) {
+		return statefulSetClaimNames(ustoreResource, volume)
+	}
+	return []string{claimNameForVolume(ustoreResource, volume)}
+}
+
+// claimSpecForVolume returns the PVC spec requested by a UStore volume.
+func claimSpecForVolume(volume unumv1alpha1.Persistence) (corev1.PersistentVolumeClaimSpec, error) {
+	size, err := volumeSize(volume)
+	if err != nil {
+		return corev1.PersistentVolumeClaimSpec{}, err
+	}
+	pvcmode := corev1.PersistentVolumeFilesystem
+	if isBlockVolume(volume) {
+		pvcmode = corev1.PersistentVolumeBlock
+	}
+	var storageClassName *string
+	if volume.StorageClassName != nil {
+		name := *volume.StorageClassName
+		storageClassName = &name
+	}
+	return corev1.PersistentVolumeClaimSpec{
+		AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.PersistentVolumeAccessMode(volume.AccessMode)},
+		VolumeMode:       &pvcmode,
+		StorageClassName: storageClassName,
+		Selector:         volume.Selector.DeepCopy(),
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{
+				"storage": size,
+			},
+		},
+		DataSource: volume.DataSource.DeepCopy(),
+	}, nil
+}
+
+// volumeSize returns the size requested by a UStore volume.
+func volumeSize(volume unumv1alpha1.Persistence) (resource.Quantity, error) {
+	size, err := resource.ParseQuantity(volume.Size)
+	if err != nil {
+		return size, fmt.Errorf("volume %s has an invalid size %q: %v", volume.MountPath, volume.Size, err)
+	}
+	return size, nil
+}
+
+// validateVolumeSizes returns an error for the first volume with an invalid size.
+func validateVolumeSizes(ustoreResource *unumv1alpha1.UStore) error {
+	for _, volume := range ustoreResource.Spec.Volumes {
+		if _, err := volumeSize(volume); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimMetaForVolume returns the metadata of a PVC backing a UStore volume, with the volume
+// labels and annotations. The UStore labels take precedence so claims can still be selected.
+func claimMetaForVolume(ustoreResource *unumv1alpha1.UStore, name string, volume unumv1alpha1.Persistence) metav1.ObjectMeta {
+	labels := map[string]string{}
+	for key, value := range volume.Labels {
+		labels[key] = value
+	}
+	for key, value := range utils.LabelsForUStore(ustoreResource.Name) {
+		labels[key] = value
+	}
+	objectMeta := utils.SetObjectMeta(name, ustoreResource.Namespace, labels)
+	if len(volume.Annotations) > 0 {
+		objectMeta.Annotations = map[string]string{}
+		for key, value := range volume.Annotations {
+			objectMeta.Annotations[key] = value
+		}
+	}
+	return objectMeta
+}
+
+// isBlockVolume reports whether the volume is exposed to the container as a raw block device.
+func isBlockVolume(volume unumv1alpha1.Persistence) bool {
+	return volume.VolumeMode == string(corev1.PersistentVolumeBlock)
+}
+
+// reconcileExistingClaims adds the volume labels and annotations to existing claims, grows them
+// to the size requested in spec.volumes and records the size and resize progress of every claim
+// in the UStore status. Claims not created yet are skipped.
+func (r *UStoreReconciler) reconcileExistingClaims(ctx context.Context, ustoreResource *unumv1alpha1.UStore) error {
+	volumeStatuses := []unumv1alpha1.VolumeStatus{}
+	for _, volume := range ustoreResource.Spec.Volumes {
+		pvcs, err := r.claimsForVolume(ctx, ustoreResource, volume)
+		if err != nil {
+			log.FromContext(ctx).Error(err, "Failed to list PVCs")
+			return err
+		}
+		for i := range pvcs {
+			pvc := &pvcs[i]
+			if err := r.reconcileClaimMeta(ctx, ustoreResource, pvc, volume); err != nil {
+				return err
+			}
+			resizeStatus, err := r.resizeClaim(ctx, pvc, volume)
+			if err != nil {
+				return err
+			}
+			volumeStatus := unumv1alpha1.VolumeStatus{
+				ClaimName:     pvc.Name,
+				MountPath:     volume.MountPath,
+				RequestedSize: volume.Size,
+				ResizeStatus:  resizeStatus,
+			}
+			if capacity, found := pvc.Status.Capacity[corev1.ResourceStorage]; found {
+				volumeStatus.Capacity = capacity.String()
+			}
+			volumeStatuses = append(volumeStatuses, volumeStatus)
+		}
+	}
+	ustoreResource.Status.Volumes = volumeStatuses
+	return nil
+}
+
+// reconcileClaimMeta adds the labels and annotations of the volume to the claim. Labels and
+// annotations removed from the volume are left on the claim. The claims the StatefulSet creates
+// get the UStore as owner, so they can be released once their volume is removed, or retained
+// with the UStore, even after the StatefulSet is re-created.
+func (r *UStoreReconciler) reconcileClaimMeta(ctx context.Context, ustoreResource *unumv1alpha1.UStore, pvc *corev1.PersistentVolumeClaim, volume unumv1alpha1.Persistence) error {
+	patchDiff := client.MergeFrom(pvc.DeepCopy())
+	changed := false
+	if isStatefulSet(ustoreResource) && !isOwnedBy(pvc, ustoreResource.UID) {
+		// the StatefulSet may be the controller of the claim
+		if err := controllerutil.SetOwnerReference(ustoreResource, pvc, r.Scheme); err != nil {
+			return err
+		}
+		changed = true
+	}
+	for key, value := range volume.Labels {
+		if _, reserved := utils.LabelsForUStore("")[key]; reserved || pvc.Labels[key] == value {
+			continue
+		}
+		if pvc.Labels == nil {
+			pvc.Labels = map[string]string{}
+		}
+		pvc.Labels[key] = value
+		changed = true
+	}
+	for key, value := range volume.Annotations {
+		if pvc.Annotations[key] == value {
+			continue
+		}
+		if pvc.Annotations == nil {
+			pvc.Annotations = map[string]string{}
+		}
+		pvc.Annotations[key] = value
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	if err := r.Patch(ctx, pvc, patchDiff); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to update PVC labels and annotations", "PVC.Name", pvc.Name)
+		return err
+	}
 	return nil
 }
 
+// resizeClaim requests the volume size on the claim when it grew and returns the resize status.
+func (r *UStoreReconciler) resizeClaim(ctx context.Context, pvc *corev1.PersistentVolumeClaim, volume unumv1alpha1.Persistence) (string, error) {
+	logger := log.FromContext(ctx)
+	desired, err := volumeSize(volume)
+	if err != nil {
+		return "", err
+	}
+	requested := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+
+	switch desired.Cmp(requested) {
+	case -1:
+		return unumv1alpha1.ResizeStatusShrinkNotSupported, nil
+	case 1:
+		allowed, err := r.allowsVolumeExpansion(ctx, pvc)
+		if err != nil {
+			return "", err
+		}
+		if !allowed {
+			return unumv1alpha1.ResizeStatusExpansionNotAllowed, nil
+		}
+		patchDiff := client.MergeFrom(pvc.DeepCopy())
+		pvc.Spec.Resources.Requests[corev1.ResourceStorage] = desired
+		logger.Info("Expanding PVC", "PVC.Name", pvc.Name, "From", requested.String(), "To", desired.String())
+		if err := r.Patch(ctx, pvc, patchDiff); err != nil {
+			logger.Error(err, "Failed to expand PVC", "PVC.Name", pvc.Name)
+			return "", err
+		}
+		return unumv1alpha1.ResizeStatusInProgress, nil
+	}
+
+	for _, condition := range pvc.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case corev1.PersistentVolumeClaimFileSystemResizePending:
+			return unumv1alpha1.ResizeStatusFileSystemResizePending, nil
+		case corev1.PersistentVolumeClaimResizing:
+			return unumv1alpha1.ResizeStatusInProgress, nil
+		}
+	}
+	if capacity, found := pvc.Status.Capacity[corev1.ResourceStorage]; found && capacity.Cmp(desired) < 0 {
+		return unumv1alpha1.ResizeStatusInProgress, nil
+	}
+	return "", nil
+}
+
+// allowsVolumeExpansion reports whether the StorageClass of the claim allows expanding it.
+// Claims without a StorageClass are statically provisioned and cannot be expanded.
+func (r *UStoreReconciler) allowsVolumeExpansion(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (bool, error) {
+	if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName == "" {
+		return false, nil
+	}
+	storageClass := &storagev1.StorageClass{}
+	err := r.Get(ctx, types.NamespacedName{Name: *pvc.Spec.StorageClassName}, storageClass)
+	if err != nil && errors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to get StorageClass", "StorageClass.Name", *pvc.Spec.StorageClassName)
+		return false, err
+	}
+	return storageClass.AllowVolumeExpansion != nil && *storageClass.AllowVolumeExpansion, nil
+}
+
 func (r *UStoreReconciler) getOrCreatePersistence(ctx context.Context, name string, vol unumv1alpha1.Persistence, ustoreResource *unumv1alpha1.UStore) error {
 	logger := log.FromContext(ctx)
 	foundPvc := &corev1.PersistentVolumeClaim{}
@@ -43,18 +372,13 @@ func (r *UStoreReconciler) getOrCreatePersistence(ctx context.Context, name stri
 	if err != nil && errors.IsNotFound(err) {
 		// create a PVC
 		logger.Info("Creating a new PVC", "Namespace", ustoreResource.Namespace, "Name", name)
-		pvcmode := corev1.PersistentVolumeFilesystem
+		claimSpec, err := claimSpecForVolume(vol)
+		if err != nil {
+			return err
+		}
 		pvc := &corev1.PersistentVolumeClaim{
-			ObjectMeta: utils.SetObjectMeta(name, ustoreResource.Namespace, utils.LabelsForUStore(ustoreResource.Name)),
-			Spec: corev1.PersistentVolumeClaimSpec{
-				AccessModes: []corev1.PersistentVolumeAccessMode{corev1.PersistentVolumeAccessMode(vol.AccessMode)},
-				VolumeMode:  &pvcmode,
-				Resources: corev1.ResourceRequirements{
-					Requests: corev1.ResourceList{
-						"storage": resource.MustParse(vol.Size),
-					},
-				},
-			},
+			ObjectMeta: claimMetaForVolume(ustoreResource, name, vol),
+			Spec:       claimSpec,
 		}
 		// Set ustore instance as the owner and controller
 		if err := ctrl.SetControllerReference(ustoreResource, pvc, r.Scheme); err != nil {
@@ -63,34 +387,16 @@ func (r *UStoreReconciler) getOrCreatePersistence(ctx context.Context, name stri
 		}
 
 		// create in k8s
-		err := r.Create(ctx, pvc)
+		err = r.Create(ctx, pvc)
 		if err != nil {
 			logger.Error(err, "Failed to create PVC", name)
 			return err
 		}
+	} else if err != nil {
+		logger.Error(err, "Failed to get PVC", "PVC.Name", name)
+		return err
+	} else if err := r.adoptRetainedClaim(ctx, foundPvc, ustoreResource); err != nil {
+		return err
 	}
-	listedVolume := volumeToMount{
-		Name:      name,
-		ClaimName: name,
-		MountPath: vol.MountPath,
-		Owner:     ustoreResource.Name,
-	}
-	if !containsVolume(volumeList, listedVolume) {
-		volumeList = append(volumeList, listedVolume)
-	}
-
 	return nil
 }
-
-func (r *UStoreReconciler) getVolumeList() []volumeToMount {
-	return volumeList
-}
-
-func containsVolume(slice []volumeToMount, element volumeToMount) bool {
-	for _, a := range slice {
-		if a == element {
-			return true
-		}
-	}
-	return false
-}
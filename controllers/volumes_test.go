@@ -0,0 +1,401 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func stringPtr(value string) *string {
+	return &value
+}
+
+func TestClaimSpecForVolume(t *testing.T) {
+	filesystem := corev1.PersistentVolumeFilesystem
+	block := corev1.PersistentVolumeBlock
+	tests := []struct {
+		name     string
+		volume   unumv1alpha1.Persistence
+		expected corev1.PersistentVolumeClaimSpec
+		invalid  bool
+	}{
+		{
+			name:   "filesystem volume",
+			volume: unumv1alpha1.Persistence{Size: "10Gi", AccessMode: "ReadWriteOnce", MountPath: "/mnt/ustore"},
+			expected: corev1.PersistentVolumeClaimSpec{
+				AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+				VolumeMode:  &filesystem,
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("10Gi")},
+				},
+			},
+		},
+		{
+			name: "volume from a snapshot",
+			volume: unumv1alpha1.Persistence{
+				Size:       "1Ti",
+				AccessMode: "ReadWriteOnce",
+				DataSource: &corev1.TypedLocalObjectReference{Kind: "VolumeSnapshot", Name: "snapshot"},
+			},
+			expected: corev1.PersistentVolumeClaimSpec{
+				AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+				VolumeMode:  &filesystem,
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1Ti")},
+				},
+				DataSource: &corev1.TypedLocalObjectReference{Kind: "VolumeSnapshot", Name: "snapshot"},
+			},
+		},
+		{
+			name: "block volume with a storage class and selector",
+			volume: unumv1alpha1.Persistence{
+				Size:             "1Ti",
+				AccessMode:       "ReadWriteOnce",
+				VolumeMode:       string(corev1.PersistentVolumeBlock),
+				StorageClassName: stringPtr("fast"),
+				Selector:         &metav1.LabelSelector{MatchLabels: map[string]string{"disk": "nvme"}},
+			},
+			expected: corev1.PersistentVolumeClaimSpec{
+				AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+				VolumeMode:       &block,
+				StorageClassName: stringPtr("fast"),
+				Selector:         &metav1.LabelSelector{MatchLabels: map[string]string{"disk": "nvme"}},
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1Ti")},
+				},
+			},
+		},
+		{
+			name:    "invalid size",
+			volume:  unumv1alpha1.Persistence{Size: "ten gigs", MountPath: "/mnt/ustore"},
+			invalid: true,
+		},
+		{
+			name:    "empty size",
+			volume:  unumv1alpha1.Persistence{MountPath: "/mnt/ustore"},
+			invalid: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claimSpec, err := claimSpecForVolume(test.volume)
+			if test.invalid {
+				if err == nil {
+					t.Errorf("expected an error for size %q", test.volume.Size)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !equality.Semantic.DeepEqual(claimSpec, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, claimSpec)
+			}
+		})
+	}
+}
+
+func TestResizeClaim(t *testing.T) {
+	allowed, notAllowed := true, false
+	storageClasses := []*storagev1.StorageClass{
+		{ObjectMeta: metav1.ObjectMeta{Name: "expandable"}, AllowVolumeExpansion: &allowed},
+		{ObjectMeta: metav1.ObjectMeta{Name: "fixed"}, AllowVolumeExpansion: &notAllowed},
+	}
+	tests := []struct {
+		name         string
+		size         string
+		storageClass *string
+		requested    string
+		capacity     string
+		conditions   []corev1.PersistentVolumeClaimCondition
+		expected     string
+		expectedSize string
+		invalid      bool
+	}{
+		{
+			name:         "same size",
+			size:         "10Gi",
+			storageClass: stringPtr("expandable"),
+			capacity:     "10Gi",
+			expectedSize: "10Gi",
+		},
+		{
+			name:         "expansion",
+			size:         "20Gi",
+			storageClass: stringPtr("expandable"),
+			capacity:     "10Gi",
+			expected:     unumv1alpha1.ResizeStatusInProgress,
+			expectedSize: "20Gi",
+		},
+		{
+			name:         "expansion not allowed by the StorageClass",
+			size:         "20Gi",
+			storageClass: stringPtr("fixed"),
+			capacity:     "10Gi",
+			expected:     unumv1alpha1.ResizeStatusExpansionNotAllowed,
+			expectedSize: "10Gi",
+		},
+		{
+			name:         "StorageClass not found",
+			size:         "20Gi",
+			storageClass: stringPtr("missing"),
+			capacity:     "10Gi",
+			expected:     unumv1alpha1.ResizeStatusExpansionNotAllowed,
+			expectedSize: "10Gi",
+		},
+		{
+			name:         "statically provisioned",
+			size:         "20Gi",
+			capacity:     "10Gi",
+			expected:     unumv1alpha1.ResizeStatusExpansionNotAllowed,
+			expectedSize: "10Gi",
+		},
+		{
+			name:         "shrink",
+			size:         "5Gi",
+			storageClass: stringPtr("expandable"),
+			capacity:     "10Gi",
+			expected:     unumv1alpha1.ResizeStatusShrinkNotSupported,
+			expectedSize: "10Gi",
+		},
+		{
+			name:         "file system resize pending",
+			size:         "10Gi",
+			storageClass: stringPtr("expandable"),
+			requested:    "10Gi",
+			capacity:     "5Gi",
+			conditions: []corev1.PersistentVolumeClaimCondition{
+				{Type: corev1.PersistentVolumeClaimFileSystemResizePending, Status: corev1.ConditionTrue},
+			},
+			expected:     unumv1alpha1.ResizeStatusFileSystemResizePending,
+			expectedSize: "10Gi",
+		},
+		{
+			name:         "capacity not grown yet",
+			size:         "10Gi",
+			storageClass: stringPtr("expandable"),
+			requested:    "10Gi",
+			capacity:     "5Gi",
+			expected:     unumv1alpha1.ResizeStatusInProgress,
+			expectedSize: "10Gi",
+		},
+		{
+			name:         "invalid size",
+			size:         "ten gigs",
+			storageClass: stringPtr("expandable"),
+			capacity:     "10Gi",
+			invalid:      true,
+			expectedSize: "10Gi",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			requested := test.requested
+			if requested == "" {
+				requested = test.capacity
+			}
+			pvc := &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "ustore-data", Namespace: "default"},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					StorageClassName: test.storageClass,
+					Resources: corev1.ResourceRequirements{
+						Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(requested)},
+					},
+				},
+				Status: corev1.PersistentVolumeClaimStatus{
+					Capacity:   corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(test.capacity)},
+					Conditions: test.conditions,
+				},
+			}
+			builder := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(pvc.DeepCopy())
+			for _, storageClass := range storageClasses {
+				builder = builder.WithObjects(storageClass.DeepCopy())
+			}
+			r := &UStoreReconciler{Client: builder.Build(), Scheme: clientgoscheme.Scheme}
+
+			resizeStatus, err := r.resizeClaim(ctx, pvc, unumv1alpha1.Persistence{Size: test.size, MountPath: "/mnt/ustore"})
+			if test.invalid != (err != nil) {
+				t.Fatalf("expected invalid %t, got error %v", test.invalid, err)
+			}
+			if resizeStatus != test.expected {
+				t.Errorf("expected resize status %q, got %q", test.expected, resizeStatus)
+			}
+			found := &corev1.PersistentVolumeClaim{}
+			if err := r.Get(ctx, types.NamespacedName{Name: pvc.Name, Namespace: pvc.Namespace}, found); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if size := found.Spec.Resources.Requests[corev1.ResourceStorage]; size.Cmp(resource.MustParse(test.expectedSize)) != 0 {
+				t.Errorf("expected a %s request, got %s", test.expectedSize, size.String())
+			}
+		})
+	}
+}
+
+func TestReleaseRemovedClaims(t *testing.T) {
+	ownedBy := func(uid types.UID) []metav1.OwnerReference {
+		return []metav1.OwnerReference{{APIVersion: "unum.cloud/v1alpha1", Kind: "UStore", Name: "ustore", UID: uid}}
+	}
+	claim := func(name string, owners []metav1.OwnerReference) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       "default",
+			Labels:          map[string]string{"app": "ustore", "ownerInstance": "ustore"},
+			OwnerReferences: owners,
+		}}
+	}
+	tests := []struct {
+		name         string
+		workloadKind string
+		retention    string
+		claims       []*corev1.PersistentVolumeClaim
+		deleted      []string
+		released     []string
+	}{
+		{
+			name:     "removed Deployment volume",
+			claims:   []*corev1.PersistentVolumeClaim{claim("ustore-mnt-ustore-volume", ownedBy("uid")), claim("ustore-mnt-wal-volume", ownedBy("uid"))},
+			deleted:  []string{"ustore-mnt-wal-volume"},
+			released: []string{},
+		},
+		{
+			name:         "scaled down StatefulSet replica",
+			workloadKind: unumv1alpha1.WorkloadKindStatefulSet,
+			claims: []*corev1.PersistentVolumeClaim{
+				claim("data-mnt-ustore-ustore-0", ownedBy("uid")),
+				claim("data-mnt-ustore-ustore-3", ownedBy("uid")),
+			},
+			deleted:  []string{},
+			released: []string{},
+		},
+		{
+			name:         "removed StatefulSet volume of every replica",
+			workloadKind: unumv1alpha1.WorkloadKindStatefulSet,
+			claims: []*corev1.PersistentVolumeClaim{
+				claim("data-mnt-ustore-ustore-0", ownedBy("uid")),
+				claim("data-mnt-wal-ustore-0", ownedBy("uid")),
+				claim("data-mnt-wal-ustore-3", ownedBy("uid")),
+			},
+			deleted:  []string{"data-mnt-wal-ustore-0", "data-mnt-wal-ustore-3"},
+			released: []string{},
+		},
+		{
+			name:         "removed StatefulSet volume retained",
+			workloadKind: unumv1alpha1.WorkloadKindStatefulSet,
+			retention:    unumv1alpha1.PersistenceRetentionRetain,
+			claims:       []*corev1.PersistentVolumeClaim{claim("data-mnt-wal-ustore-3", ownedBy("uid"))},
+			deleted:      []string{},
+			released:     []string{"data-mnt-wal-ustore-3"},
+		},
+		{
+			name:         "claims retained by a previous UStore",
+			workloadKind: unumv1alpha1.WorkloadKindStatefulSet,
+			claims:       []*corev1.PersistentVolumeClaim{claim("data-mnt-wal-ustore-0", nil), claim("data-mnt-logs-ustore-0", ownedBy("old"))},
+			deleted:      []string{},
+			released:     []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			ustoreResource := &unumv1alpha1.UStore{
+				ObjectMeta: metav1.ObjectMeta{Name: "ustore", Namespace: "default", UID: "uid"},
+				Spec: unumv1alpha1.UStoreSpec{
+					NumOfInstances:       1,
+					WorkloadKind:         test.workloadKind,
+					PersistenceRetention: test.retention,
+					Volumes:              []unumv1alpha1.Persistence{{MountPath: "/mnt/ustore", Size: "1Gi"}},
+				},
+			}
+			scheme := testScheme(t)
+			builder := fake.NewClientBuilder().WithScheme(scheme)
+			for _, pvc := range test.claims {
+				builder = builder.WithObjects(pvc)
+			}
+			r := &UStoreReconciler{Client: builder.Build(), Scheme: scheme}
+
+			if err := r.releaseRemovedClaims(ctx, ustoreResource); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			deleted, released := []string{}, []string{}
+			for _, pvc := range test.claims {
+				found := &corev1.PersistentVolumeClaim{}
+				err := r.Get(ctx, types.NamespacedName{Name: pvc.Name, Namespace: "default"}, found)
+				if errors.IsNotFound(err) {
+					deleted = append(deleted, pvc.Name)
+					continue
+				} else if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if len(found.OwnerReferences) < len(pvc.OwnerReferences) && found.Labels["ownerInstance"] == "" {
+					released = append(released, pvc.Name)
+				}
+			}
+			if !equality.Semantic.DeepEqual(deleted, test.deleted) {
+				t.Errorf("expected %v to be deleted, got %v", test.deleted, deleted)
+			}
+			if !equality.Semantic.DeepEqual(released, test.released) {
+				t.Errorf("expected %v to be released, got %v", test.released, released)
+			}
+		})
+	}
+}
+
+func TestReconcileExistingClaimsOwnsStatefulSetClaims(t *testing.T) {
+	ctx := context.Background()
+	ustoreResource := &unumv1alpha1.UStore{
+		ObjectMeta: metav1.ObjectMeta{Name: "ustore", Namespace: "default", UID: "uid"},
+		Spec: unumv1alpha1.UStoreSpec{
+			NumOfInstances: 1,
+			WorkloadKind:   unumv1alpha1.WorkloadKindStatefulSet,
+			Volumes:        []unumv1alpha1.Persistence{{MountPath: "/mnt/ustore", Size: "1Gi"}},
+		},
+	}
+	statefulSetOwner := metav1.OwnerReference{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "ustore", UID: "statefulset"}
+	scheme := testScheme(t)
+	builder := fake.NewClientBuilder().WithScheme(scheme)
+	// the claim of a replica scaled down is still listed
+	for _, name := range []string{"data-mnt-ustore-ustore-0", "data-mnt-ustore-ustore-1"} {
+		builder = builder.WithObjects(&corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            name,
+				Namespace:       "default",
+				Labels:          map[string]string{"app": "ustore", "ownerInstance": "ustore"},
+				OwnerReferences: []metav1.OwnerReference{statefulSetOwner},
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1Gi")}},
+			},
+		})
+	}
+	r := &UStoreReconciler{Client: builder.Build(), Scheme: scheme}
+
+	if err := r.reconcileExistingClaims(ctx, ustoreResource); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ustoreResource.Status.Volumes) != 2 {
+		t.Errorf("expected the status of both claims, got %v", ustoreResource.Status.Volumes)
+	}
+	for _, name := range []string{"data-mnt-ustore-ustore-0", "data-mnt-ustore-ustore-1"} {
+		found := &corev1.PersistentVolumeClaim{}
+		if err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: "default"}, found); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !isOwnedBy(found, ustoreResource.UID) || !isOwnedBy(found, statefulSetOwner.UID) {
+			t.Errorf("expected %s to be owned by the UStore and the StatefulSet, got %v", name, found.OwnerReferences)
+		}
+	}
+}
@@ -31,6 +31,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
 	unumv1alpha1 "github.com/opdev/ustore-operator/api/v1alpha1"
 	"github.com/opdev/ustore-operator/controllers"
 	//+kubebuilder:scaffold:imports
@@ -45,6 +46,7 @@ func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
 	utilruntime.Must(unumv1alpha1.AddToScheme(scheme))
+	utilruntime.Must(snapshotv1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
@@ -52,11 +54,19 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var maxConcurrentReconciles int
+	images := controllers.DefaultImages()
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&images.UStore, "ustore-image", images.UStore, "The default UStore server image of leveldb, rocksdb and ucset.")
+	flag.StringVar(&images.UDisk, "udisk-image", images.UDisk, "The default UStore server image of udisk.")
+	flag.StringVar(&images.UDiskPullSecret, "udisk-pull-secret", images.UDiskPullSecret, "The pull secret of the default udisk image, empty for none.")
+	flag.StringVar(&images.Backup, "backup-image", images.Backup, "The image archiving and extracting backups.")
+	flag.StringVar(&images.BackupS3, "backup-s3-image", images.BackupS3, "The image uploading and downloading backups to S3.")
+	flag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", 1, "The number of UStores reconciled in parallel.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -90,12 +100,50 @@ func main() {
 	}
 
 	if err = (&controllers.UStoreReconciler{
+		Client:                  mgr.GetClient(),
+		Scheme:                  mgr.GetScheme(),
+		MaxConcurrentReconciles: maxConcurrentReconciles,
+		Images:                  images,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "UStore")
+		os.Exit(1)
+	}
+	if err = (&controllers.UStoreBackupReconciler{
 		Client: mgr.GetClient(),
 		Scheme: mgr.GetScheme(),
+		Images: images,
 	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "UStore")
+		setupLog.Error(err, "unable to create controller", "controller", "UStoreBackup")
 		os.Exit(1)
 	}
+	if err = (&controllers.UStoreRestoreReconciler{
+		Client: mgr.GetClient(),
+		Scheme: mgr.GetScheme(),
+		Images: images,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "UStoreRestore")
+		os.Exit(1)
+	}
+	if err = (&controllers.UStoreBackupScheduleReconciler{
+		Client: mgr.GetClient(),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "UStoreBackupSchedule")
+		os.Exit(1)
+	}
+	if err = (&controllers.UStoreSnapshotReconciler{
+		Client: mgr.GetClient(),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "UStoreSnapshot")
+		os.Exit(1)
+	}
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = (&unumv1alpha1.UStore{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "UStore")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {